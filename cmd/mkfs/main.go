@@ -3,26 +3,101 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/PsychoPunkSage/ErgoFS/pkg/compression"
 	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
 	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
 	"github.com/PsychoPunkSage/ErgoFS/pkg/util"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/writer"
 )
 
+// tarFlag is --tar[=f|i], a bare --tar imports the full data of the archive
+// and --tar=i generates an index of the archive without its data
+type tarFlag string
+
+func (t *tarFlag) String() string   { return string(*t) }
+func (t *tarFlag) IsBoolFlag() bool { return true }
+
+func (t *tarFlag) Set(mode string) error {
+	switch mode {
+	case "true", "f":
+		*t = "f"
+	case "i":
+		*t = "i"
+	case "false":
+		*t = ""
+	default:
+		return fmt.Errorf("invalid tar mode %q", mode)
+	}
+	return nil
+}
+
 func main() {
+	var tarMode tarFlag
+
 	// Define command-line flags
 	dbgLevel := flag.Int("d", 0, "Debug level") // Default debug level = 0
 	compressHints := flag.String("C", "", "Path to compression hints file")
 	compressionAlg := flag.String("c", "lz4", "Compression algorithm (lz4, lzma, etc.)")
 	compressionLevel := flag.Int("l", -1, "Compression level")
+	chunkSize := flag.Uint64("chunksize", 0, "Generate chunk-based files with #-byte chunks")
+	xattrTolerance := flag.Int("x", 2, "Set xattr tolerance to # (< 0, disable xattrs)")
+	deviceSize := flag.Uint64("device-size", 0, "Cap each device (including the primary) at # bytes, chunked file data moves on to the next --device once one is full")
+	flag.Func("device", "Extra device to hold chunked file data (repeatable), created if missing and sized to its data. Devices aren't added on demand, so list as many as the data needs at --device-size", func(path string) error {
+		types.GCfg.DevicePaths = append(types.GCfg.DevicePaths, path)
+		return nil
+	})
+	flag.Func("xattr-prefix", "Register a long xattr name prefix for better compression (repeatable)", func(prefix string) error {
+		if err := writer.ErofsXattrInsertNamePrefix(prefix); err != nil {
+			return fmt.Errorf("failed to parse xattr name prefix %q: %w", prefix, err)
+		}
+		types.GCfg.ExtraEANamePrefixes = true
+		return nil
+	})
+	flag.StringVar(&types.GCfg.MountPoint, "mount-point", "", "Prefix of target fs path (default: root)")
+	flag.Func("file-contexts", "Specify a file_contexts file to setup selinux labels", func(path string) error {
+		return writer.ErofsSelabelOpen(path)
+	})
+	flag.StringVar(&types.GCfg.FsConfigFile, "fs-config-file", "", "Android canned fs_config file")
+	flag.Func("file-caps", "Set file capabilities as path=caps[@rootid] (repeatable)", writer.ErofsAddFileCaps)
+	flag.Func("manifest", "Override uid, gid, mode, mtime and xattrs of listed paths", writer.ErofsLoadManifest)
+	aufs := flag.Bool("aufs", false, "Replace aufs whiteouts and opaque markers of tar archives with overlayfs metadata")
+	flag.BoolVar(&types.GCfg.OvlfsUserXattr, "ovlfs-userxattr", false, "Use user.overlay.* instead of trusted.overlay.* xattrs")
+	flag.BoolVar(&types.GCfg.OvlfsStrip, "ovlfs-strip", false, "Strip overlayfs metadata (whiteouts, opaque markers and overlay xattrs)")
+	oci := flag.Bool("oci", false, "Flatten the layers of an OCI image layout given as the source")
+	ociPlatform := flag.String("oci-platform", "", "Platform of the OCI image as os/arch[/variant] (default: the host one)")
+	cpio := flag.Bool("cpio", false, "Build the image from a newc or crc cpio archive given as the source, e.g. an initramfs")
+	zipFlag := flag.Bool("zip", false, "Build the image from a ZIP archive given as the source")
+	flag.Var(&tarMode, "tar", "Build the image from a tar archive (--tar=f) given as the source, which may be gzip or bzip2 compressed, or index it (--tar=i)")
+	flag.Func("clean", "Data import mode: data (import complete data) or sparse (keep holes and zeroed blocks sparse)", func(mode string) error {
+		switch mode {
+		case "data":
+			types.GCfg.DataImportMode = types.EROFS_MKFS_DATA_IMPORT_FULLDATA
+		case "rvsp":
+			// file data would only be zeroed, keep it in the tar archive instead
+			return fmt.Errorf("data import mode rvsp isn't supported, use --tar=i to reference file data in the tar archive")
+		case "sparse":
+			types.GCfg.DataImportMode = types.EROFS_MKFS_DATA_IMPORT_SPARSE
+		default:
+			return fmt.Errorf("invalid data import mode %q", mode)
+		}
+		return nil
+	})
 	flag.Parse()
+	// lz4 is only the default, sparse files are kept as they are unless
+	// compression is asked for
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "c" {
+			types.GCfg.CompressionRequested = true
+		}
+	})
 
 	// Get positional arguments
 	args := flag.Args()
 	if len(args) < 2 {
-		fmt.Println("Usage: program [-d dbglevel] [-C compression_hints_file] [-c compression_alg] [-l compression_level] <image_path> <src_path>")
+		fmt.Println("Usage: program [-d dbglevel] [-C compression_hints_file] [-c compression_alg] [-l compression_level] [-x #] [--xattr-prefix prefix]... [--mount-point path] [--file-contexts path] [--fs-config-file path] [--file-caps path=caps]... [--manifest path] [--chunksize #] [--device path]... [--device-size #] [--clean data|sparse] [--tar[=f|i]] [--aufs] [--ovlfs-userxattr] [--ovlfs-strip] [--oci [--oci-platform os/arch[/variant]]] [--cpio] [--zip] <image_path> <src_path|tar_file|cpio_file|zip_file|-|oci_layout|src_image...>")
 		os.Exit(1)
 	}
 
@@ -30,10 +105,51 @@ func main() {
 	srcPath := args[1]
 	fmt.Printf("Debug Level: %d, Image Path: %s, Source Path: %s\n", *dbgLevel, imagePath, srcPath)
 
+	if *oci && tarMode != "" {
+		fmt.Println("--oci can't be used along with --tar")
+		os.Exit(1)
+	}
+	if *cpio && (*oci || tarMode != "") {
+		fmt.Println("--cpio can't be used along with --tar or --oci")
+		os.Exit(1)
+	}
+	if *zipFlag && (*cpio || *oci || tarMode != "") {
+		fmt.Println("--zip can't be used along with --tar, --oci or --cpio")
+		os.Exit(1)
+	}
+	// existing images given as sources are merged into the new one
+	var images []string
+	if tarMode == "" && !*oci && !*cpio && !*zipFlag {
+		if fi, e := os.Stat(srcPath); e == nil && (fi.Mode().IsRegular() || fi.Mode()&os.ModeDevice != 0) {
+			images = args[1:]
+		}
+	}
+	if images == nil && len(args) > 2 {
+		fmt.Println("only source images can be given more than once")
+		os.Exit(1)
+	}
+	// the tree is rebuilt from archives or images instead of the source directory
+	rebuild := tarMode != "" || *oci || *cpio || *zipFlag || images != nil
+
 	types.GCfg.SourcePath = srcPath
+	if rebuild {
+		// paths of archive members are relative to the root
+		types.ErofsSetFsRoot("/")
+	} else {
+		types.ErofsSetFsRoot(srcPath)
+	}
+
+	if types.GCfg.FsConfigFile != "" {
+		if e := types.LoadCannedFsConfig(types.GCfg.FsConfigFile); e != nil {
+			fmt.Println("failed to load fs config", types.GCfg.FsConfigFile, ":", e)
+			os.Exit(1)
+		}
+	}
 	types.GCfg.ImagePath = imagePath
 	types.GCfg.DebugLevel = *dbgLevel
 	types.GCfg.CompressHintsFile = *compressHints
+	types.GCfg.MaxDeviceSize = *deviceSize
+	types.GCfg.InlineXattrTolerance = *xattrTolerance
 
 	var err int
 	var sbBh *types.BufferHead
@@ -57,6 +173,43 @@ func main() {
 
 	types.InitConfigure()
 	types.MkfsDefaultOptions(&types.GSbi)
+	types.GSbi.SetTimestamp()
+
+	if tarMode == "i" {
+		// data in tar archives is only aligned to 512 bytes
+		types.GSbi.BlkSzBits = 9
+		types.GCfg.MkfsPclusterSizeMax = 1 << types.GSbi.BlkSzBits
+		types.GCfg.MkfsPclusterSizeDef = types.GCfg.MkfsPclusterSizeMax
+	}
+
+	// source images are kept open as file data is read until it's dumped
+	var srcs []*types.SuperBlkInfo
+	for _, path := range images {
+		src, e := writer.ErofsRebuildOpen(path)
+		if e != nil {
+			fmt.Println("Failed to open source image:", e)
+			os.Exit(1)
+		}
+		srcs = append(srcs, src)
+	}
+	// source images are referenced as extra devices unless data is imported
+	blobIndex := srcs != nil && types.GCfg.DataImportMode == types.EROFS_MKFS_DATA_IMPORT_DEFAULT
+	if blobIndex {
+		types.GSbi.BlkSzBits = srcs[0].BlkSzBits
+		types.GCfg.MkfsPclusterSizeMax = 1 << types.GSbi.BlkSzBits
+		types.GCfg.MkfsPclusterSizeDef = types.GCfg.MkfsPclusterSizeMax
+	}
+
+	if *chunkSize != 0 {
+		if e := writer.ErofsSetChunksize(&types.GSbi, *chunkSize); e != nil {
+			fmt.Println(e)
+			os.Exit(1)
+		}
+	}
+	if types.GCfg.MaxDeviceSize != 0 && types.GCfg.MaxDeviceSize < types.GSbi.ErofsBlockSize() {
+		fmt.Printf("device size %d is smaller than the block size\n", types.GCfg.MaxDeviceSize)
+		os.Exit(1)
+	}
 
 	if types.GSbi.BDev == nil {
 		fmt.Println("I'm here")
@@ -68,8 +221,16 @@ func main() {
 	// errs := util.DevOpen(&types.GSbi, types.GCfg.ImagePath, os.O_RDWR|os.O_TRUNC) // Assuming incremental_mode = true
 	if errr != nil {
 		fmt.Println("Something went wrong")
-		return
+		os.Exit(1)
 	}
+	// every return short of the end is a failure, which drops the image
+	// once the deferred cleanups have run
+	done := false
+	defer func() {
+		if !done {
+			mkfsExit()
+		}
+	}()
 
 	// increamental mode = true
 	types.GSbi.Bmgr = types.ErofsBufferInit(&types.GSbi, 0)
@@ -104,12 +265,188 @@ func main() {
 
 	fmt.Println("Compress Initialization successfully Done")
 
+	if rebuild {
+		if e := types.ErofsDiskbufInit(1); e != nil {
+			fmt.Println("Failed to initialize diskbuf:", e)
+			return // goto exit
+		}
+		defer types.ErofsDiskbufExit()
+	}
+
+	// layers are kept open as file data is referenced until it's dumped
+	var tars []*writer.ErofsTarfile
+	if *oci {
+		layers, e := writer.ErofsOciLayers(srcPath, *ociPlatform)
+		if e != nil {
+			fmt.Println("Failed to resolve OCI image:", e)
+			return // goto exit
+		}
+		for _, layer := range layers {
+			tar, e := writer.ErofsTarOpen(layer)
+			if e != nil {
+				fmt.Println("Failed to open OCI layer:", e)
+				return // goto exit
+			}
+			defer writer.ErofsTarClose(tar)
+			tar.Flatten = true
+			tars = append(tars, tar)
+		}
+	} else if tarMode != "" {
+		tar, e := writer.ErofsTarOpen(srcPath)
+		if e != nil {
+			fmt.Println("Failed to open tar file:", e)
+			return // goto exit
+		}
+		defer writer.ErofsTarClose(tar)
+		tar.Aufs = *aufs
+		tars = append(tars, tar)
+	}
+	var cpiofile *writer.ErofsCpiofile
+	if *cpio {
+		f, e := writer.ErofsCpioOpen(srcPath)
+		if e != nil {
+			fmt.Println("Failed to open cpio file:", e)
+			return // goto exit
+		}
+		defer writer.ErofsCpioClose(f)
+		cpiofile = f
+	}
+	var zipfile *writer.ErofsZipfile
+	if *zipFlag {
+		f, e := writer.ErofsZipOpen(srcPath)
+		if e != nil {
+			fmt.Println("Failed to open zip file:", e)
+			return // goto exit
+		}
+		defer writer.ErofsZipClose(f)
+		zipfile = f
+	}
+
+	if e := writer.ErofsMkfsInitDevices(&types.GSbi, types.GCfg.DevicePaths); e != nil {
+		fmt.Println("Failed to generate device table:", e)
+		return // goto exit
+	}
+	if tarMode == "i" {
+		if e := writer.ErofsTarIndexInit(&types.GSbi, tars[0]); e != nil {
+			fmt.Println("Failed to index tar file:", e)
+			return // goto exit
+		}
+	}
+	if blobIndex {
+		if e := writer.ErofsRebuildInitDevices(&types.GSbi, srcs); e != nil {
+			fmt.Println("Failed to reference source images:", e)
+			return // goto exit
+		}
+	}
+
+	if types.GSbi.ExtraDevices != 0 || types.GCfg.ChunkBits != 0 {
+		// chunks of a single block by default when spilling to devices
+		if types.GCfg.ChunkBits == 0 {
+			types.GCfg.ChunkBits = types.GSbi.BlkSzBits
+		}
+		if e := writer.ErofsBlobInit(&types.GSbi); e != nil {
+			fmt.Println("Failed to initialize blob:", e)
+			return // goto exit
+		}
+	}
+	// sparse files may still set up the blob lazily
+	defer writer.ErofsBlobExit()
+
+	if !rebuild {
+		if e := writer.ErofsBuildSharedXattrsFromPath(&types.GSbi, srcPath); e != nil {
+			fmt.Println("Failed to build shared xattrs:", e)
+			return // goto exit
+		}
+	}
+
+	if types.GCfg.XattrNameFilter && types.GCfg.InlineXattrTolerance >= 0 {
+		types.ErofsSbSetXattrFilter(&types.GSbi)
+	}
+
+	if types.GCfg.ExtraEANamePrefixes {
+		if e := writer.ErofsXattrFlushNamePrefixes(&types.GSbi); e != nil {
+			fmt.Println("Failed to flush long xattr name prefixes:", e)
+			return // goto exit
+		}
+	}
+
+	types.ErofsInodeManagerInit()
+
+	var root *types.ErofsInode
+	var e error
+	if rebuild {
+		if root, e = writer.ErofsRebuildMakeRoot(&types.GSbi); e != nil {
+			fmt.Println("Failed to make root:", e)
+			return // goto exit
+		}
+		for _, tar := range tars {
+			for e == nil {
+				e = writer.TarerofsParseTar(root, tar)
+			}
+			if e != io.EOF {
+				fmt.Println("Failed to parse tar file:", e)
+				return // goto exit
+			}
+			e = nil
+		}
+		for cpiofile != nil && e == nil {
+			e = writer.ErofsCpioParse(root, cpiofile)
+		}
+		if e != nil && e != io.EOF {
+			fmt.Println("Failed to parse cpio file:", e)
+			return // goto exit
+		}
+		for e = nil; zipfile != nil && e == nil; {
+			e = writer.ErofsZipParse(root, zipfile)
+		}
+		if e != nil && e != io.EOF {
+			fmt.Println("Failed to parse zip file:", e)
+			return // goto exit
+		}
+		for i, src := range srcs {
+			var deviceID uint16
+
+			if blobIndex {
+				deviceID = uint16(i + 1)
+			}
+			if e = writer.ErofsRebuildLoadTree(root, src, deviceID); e != nil {
+				fmt.Println("Failed to load source image:", e)
+				return // goto exit
+			}
+		}
+		e = writer.ErofsRebuildDumpTree(root)
+	} else {
+		root, e = writer.ErofsMkfsBuildTreeFromPath(&types.GSbi, srcPath)
+	}
+	if e != nil {
+		fmt.Println("Failed to build tree:", e)
+		return // goto exit
+	}
+	types.GSbi.RootNid = uint32(types.ErofsLookupNid(root))
+
+	if e = writer.ErofsManifestCheckUnused(); e != nil {
+		fmt.Println("Failed to apply manifest:", e)
+		return // goto exit
+	}
+
+	if e = writer.ErofsMkfsDumpBlobs(&types.GSbi); e != nil {
+		fmt.Println("Failed to dump blobs:", e)
+		return // goto exit
+	}
+
+	// the metadata left is mapped to the primary device before it's written
+	if e = types.ErofsDevCheckSize(&types.GSbi, types.MapBh(types.GSbi.Bmgr, nil)); e != nil {
+		fmt.Println("Failed to allocate blocks:", e)
+		return // goto exit
+	}
+
 	// flush all buffers except for superblock
 	err = types.ErofsBflush(types.GSbi.Bmgr, nil)
 	if err != 0 {
 		fmt.Println("Failed to flush buffers")
 		return // goto exit
 	}
+	types.ErofsIput(root)
 
 	err = types.WriteSuperBlock(&types.GSbi, sbBh, &nblocks)
 	if err != 0 {
@@ -120,11 +457,11 @@ func main() {
 	fmt.Println("Superblock successfully Written")
 
 	// flush all remaining buffers
-	// err = types.ErofsBflush(types.GSbi.Bmgr, nil)
-	// if err != 0 {
-	// 	fmt.Println("Failed to flush buffers")
-	// 	return // goto exit
-	// }
+	err = types.ErofsBflush(types.GSbi.Bmgr, nil)
+	if err != 0 {
+		fmt.Println("Failed to flush buffers")
+		return // goto exit
+	}
 
 	err = types.ErofsDevResize(&types.GSbi, nblocks)
 
@@ -132,7 +469,23 @@ func main() {
 		err = types.ErofsEnableSbChksum(&types.GSbi, &crc)
 		if err == 0 {
 			fmt.Printf("SuperBlock checksum 0x%08x written\n", crc)
-			return // goto exit
 		}
 	}
+	if err != 0 {
+		fmt.Println("Failed to finish the image")
+		return // goto exit
+	}
+	done = true
+}
+
+// mkfsExit removes the partially written image and the extra devices
+// filled along with it, which are kept if they aren't regular files, and
+// exits with a failure status
+func mkfsExit() {
+	for _, path := range append([]string{types.GCfg.ImagePath}, types.GCfg.DevicePaths...) {
+		if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+			os.Remove(path)
+		}
+	}
+	os.Exit(1)
 }
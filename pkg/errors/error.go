@@ -151,4 +151,6 @@ const (
 	ERFKILL = 132 /* Operation not possible due to RF-kill */
 
 	EHWPOISON = 133 /* Memory page has hardware error */
+
+	EFSCORRUPTED = EUCLEAN /* Filesystem is corrupted */
 )
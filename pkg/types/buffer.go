@@ -52,11 +52,7 @@ type ErofsDeviceSlot struct {
 const EROFS_DEVT_SLOT_SIZE = 64 + 4 + 4 + 56
 
 // SkipWriteOps defines operations that skip writing
-var SkipWriteOps = &BufferHeadOps{
-	Flush: func(bh *BufferHead) int {
-		return -errs.EBUSY
-	},
-}
+var SkipWriteOps = &SkipWriteBhops
 
 var DropDirectlyBhops = BufferHeadOps{
 	Flush: func(bh *BufferHead) int {
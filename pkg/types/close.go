@@ -1,6 +1,11 @@
 package types
 
-import "fmt"
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
 
 // ///////////
 // / CLOSE ///
@@ -15,23 +20,111 @@ import "fmt"
 // } *dbufstrm;
 
 type ErofsDiskBufStrm struct {
-	count      uint64
+	count      int32
 	TailOffset uint64
 	DevPos     uint64
 	Fd         int
 	AlignSize  uint
 	locked     bool
+	file       *os.File
 }
 
-func ErofsDiskbufClose(diskBuf *ErofsDiskbuf) {
-	var strm *ErofsDiskBufStrm
+// spooling streams set up by ErofsDiskbufInit
+var dbufstrm []ErofsDiskBufStrm
 
-	strm = (*ErofsDiskBufStrm)(diskBuf.Sp)
+// ErofsDiskbufInit sets up nstrms streams to spool file data which can't
+// be read again from its source. Streams use unlinked temporary files
+// rather than space beyond the end of the output, so that nothing is left
+// in the output if mkfs fails.
+func ErofsDiskbufInit(nstrms int) error {
+	dbufstrm = make([]ErofsDiskBufStrm, nstrms)
+
+	for i := range dbufstrm {
+		strm := &dbufstrm[i]
+		var st syscall.Stat_t
+
+		f, err := os.CreateTemp(os.Getenv("TMPDIR"), "erofs-diskbuf.*")
+		if err != nil {
+			return err
+		}
+		os.Remove(f.Name())
+		strm.file = f
+		strm.Fd = int(f.Fd())
+		strm.TailOffset = 0
+		strm.DevPos = 0
+		strm.count = 1
+		if err := syscall.Fstat(strm.Fd, &st); err != nil {
+			return err
+		}
+		strm.AlignSize = uint(max(int(st.Blksize), os.Getpagesize()))
+	}
+	return nil
+}
+
+// ErofsDiskbufExit closes all spooling streams
+func ErofsDiskbufExit() {
+	for i := range dbufstrm {
+		strm := &dbufstrm[i]
+
+		if atomic.LoadInt32(&strm.count) != 1 {
+			Debug(EROFS_DBG, "diskbuf stream %d still has %d spans", i, strm.count-1)
+		}
+		strm.file.Close()
+		strm.Fd = -1
+	}
+	dbufstrm = nil
+}
+
+// ErofsDiskbufStream returns the spooling stream sid, or nil if it
+// hasn't been set up
+func ErofsDiskbufStream(sid int) *ErofsDiskBufStrm {
+	if sid >= len(dbufstrm) {
+		return nil
+	}
+	return &dbufstrm[sid]
+}
+
+// ErofsDiskbufClose drops the reference of db to its stream
+func ErofsDiskbufClose(db *ErofsDiskbuf) {
+	strm := (*ErofsDiskBufStrm)(db.Sp)
+
+	if strm == nil {
+		return
+	}
+	ErofsAtomicDecReturn(&strm.count)
+	db.Sp = nil
+}
+
+// ErofsDiskbufReserve starts a new span at the (aligned) tail of strm and
+// returns the fd and the offset where the span data should be placed
+func ErofsDiskbufReserve(db *ErofsDiskbuf, strm *ErofsDiskBufStrm) (int, uint64) {
+	if strm.AlignSize > 1 {
+		strm.TailOffset = RoundUp(strm.TailOffset, uint64(strm.AlignSize))
+	}
+	db.Offset = strm.TailOffset
+	db.Sp = unsafe.Pointer(strm)
+	atomic.AddInt32(&strm.count, 1)
+	strm.locked = true
+	return strm.Fd, db.Offset + strm.DevPos
+}
+
+// ErofsDiskbufCommit finishes the span reserved by ErofsDiskbufReserve
+func ErofsDiskbufCommit(db *ErofsDiskbuf, len uint64) {
+	strm := (*ErofsDiskBufStrm)(db.Sp)
+
+	if !strm.locked || strm.TailOffset != db.Offset {
+		panic("diskbuf span isn't the tail of its stream")
+	}
+	strm.TailOffset += len
+	strm.locked = false
+}
+
+// ErofsDiskbufGetfd returns the fd and the offset of the span data
+func ErofsDiskbufGetfd(db *ErofsDiskbuf) (int, uint64) {
+	strm := (*ErofsDiskBufStrm)(db.Sp)
 
 	if strm == nil {
-		fmt.Println("strm is Empty")
+		return -1, 0
 	}
-	// 	DBG_BUGON(erofs_atomic_read(&strm->count) <= 1);
-	ErofsAtomicDecReturn(&strm.count) // 	(void)erofs_atomic_dec_return(&strm->count);
-	diskBuf.Sp = nil
+	return strm.Fd, db.Offset + strm.DevPos
 }
@@ -41,6 +41,7 @@ type Config struct {
 
 	// Compression settings
 	CompressionOptions    []CompressionOption
+	CompressionRequested  bool // -c given rather than its default
 	MaxDecompressedExtent uint64
 
 	// Time handling
@@ -57,6 +58,13 @@ type Config struct {
 	BlobDevPath string
 	ChunkBits   uint8
 
+	// Data import
+	DataImportMode int // dataimport_mode, EROFS_MKFS_DATA_IMPORT_*
+
+	// Multi-device output
+	DevicePaths   []string // extra devices holding chunked file data, all listed upfront
+	MaxDeviceSize uint64   // per-device size cap in bytes, 0 means unlimited
+
 	// Visualization
 	ShowProgress bool
 
@@ -64,6 +72,7 @@ type Config struct {
 	CompressHintsFile string // c_compress_hints_file
 	FragmentDedupe    uint8  // c_fragdedupe
 	OvlfsStrip        bool   // c_ovlfs_strip
+	OvlfsUserXattr    bool   // user.overlay.* xattrs for unprivileged overlayfs
 	HardDereference   bool   // c_hard_dereference
 
 	// MT support
@@ -107,6 +107,15 @@ const (
 	EROFS_INODE_CHUNK_BASED        = 4
 	EROFS_INODE_DATALAYOUT_MAX     = 5
 	NR_INODE_HASHTABLE             = 16384
+
+	// on-disk sizes of the inode and directory structures
+	EROFS_INODE_COMPACT_SIZE   = 32
+	EROFS_INODE_EXTENDED_SIZE  = 64
+	EROFS_DIRENT_SIZE          = 12
+	EROFS_BLOCK_MAP_ENTRY_SIZE = 4
+	EROFS_CHUNK_INDEX_SIZE     = 8
+	EROFS_XATTR_IBODY_HDR_SIZE = 12
+	EROFS_XATTR_ENTRY_SIZE     = 4
 )
 
 // seek
@@ -159,7 +168,7 @@ const (
 )
 
 const (
-	EROFS_PACKED_NID_UNALLOCATED = 0
+	EROFS_PACKED_NID_UNALLOCATED = ^uint64(0) // -1 as in erofs-utils
 )
 
 // config const.
@@ -0,0 +1,162 @@
+package types
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"syscall"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+)
+
+// erofsMapBlocks is an extent of file data starting at the logical offset
+// la, which is stored at pa of device deviceID unless it's a hole
+type erofsMapBlocks struct {
+	la, pa   uint64
+	llen     uint64
+	deviceID int
+	mapped   bool
+}
+
+// erofsMapBlocksFlat maps the logical offset of a flat inode to its
+// physical offset on the primary device
+func erofsMapBlocksFlat(inode *ErofsInode, m *erofsMapBlocks) error {
+	sbi := inode.Sbi
+	nblocks := BlkRoundUp(sbi, inode.ISize)
+	lastblk := nblocks
+	if inode.DataLayout == EROFS_INODE_FLAT_INLINE {
+		lastblk--
+	}
+
+	m.mapped = true
+	if m.la < ErofsPos(sbi, lastblk) {
+		m.pa = ErofsPos(sbi, uint64(inode.IBlkaddr)) + m.la
+		m.llen = ErofsPos(sbi, lastblk) - m.la
+		return nil
+	}
+	if inode.DataLayout != EROFS_INODE_FLAT_INLINE {
+		return syscall.Errno(errs.EINVAL)
+	}
+
+	// the tail block is inlined right after the inode
+	m.pa = ErofsIloc(inode) + uint64(inode.InodeIsize) + uint64(inode.XattrIsize) +
+		ErofsBlkoff(sbi, m.la)
+	m.llen = inode.ISize - m.la
+	if ErofsBlkoff(sbi, m.pa)+m.llen > uint64(ErofsBlkSiz(sbi)) {
+		Error("inline data of nid %d crosses the block boundary", inode.Nid)
+		return syscall.Errno(errs.EFSCORRUPTED)
+	}
+	return nil
+}
+
+// erofsMapBlocksChunk maps the logical offset of a chunk-based inode by its
+// block map or chunk indexes, which follow the xattrs of the inode
+func erofsMapBlocksChunk(inode *ErofsInode, m *erofsMapBlocks) error {
+	var unit uint64
+	var blkaddr uint32
+
+	sbi := inode.Sbi
+	if uint32(inode.ChunkFormat)&EROFS_CHUNK_FORMAT_INDEXES != 0 {
+		unit = EROFS_CHUNK_INDEX_SIZE
+	} else {
+		unit = EROFS_BLOCK_MAP_ENTRY_SIZE
+	}
+	chunknr := m.la >> inode.ChunkBits
+	pos := RoundUp(ErofsIloc(inode)+uint64(inode.InodeIsize)+uint64(inode.XattrIsize), unit) +
+		unit*chunknr
+
+	buf := make([]byte, unit)
+	if _, err := ErofsDevRead(sbi, 0, buf, pos, int64(unit)); err != nil {
+		return err
+	}
+
+	m.deviceID = 0
+	if unit == EROFS_BLOCK_MAP_ENTRY_SIZE {
+		blkaddr = binary.LittleEndian.Uint32(buf)
+	} else {
+		// device ids are masked by the number of devices
+		mask := uint16(1)<<bits.Len16(sbi.ExtraDevices) - 1
+		m.deviceID = int(binary.LittleEndian.Uint16(buf[2:]) & mask)
+		blkaddr = binary.LittleEndian.Uint32(buf[4:])
+	}
+
+	chunksize := uint64(1) << inode.ChunkBits
+	m.llen = min(chunksize-m.la&(chunksize-1), inode.ISize-m.la)
+	m.mapped = blkaddr != NULL_ADDR
+	if m.mapped {
+		m.pa = ErofsPos(sbi, uint64(blkaddr)) + m.la&(chunksize-1)
+	}
+	return nil
+}
+
+// erofsMapDev finds the device to read a mapped extent from. Extra devices
+// may be opened as blobs or only be mapped behind the primary device, and
+// blocks of the primary device may be mapped to extra devices.
+func erofsMapDev(sbi *SuperBlkInfo, m *erofsMapBlocks) error {
+	if m.deviceID > int(sbi.ExtraDevices) || m.deviceID > len(sbi.Devs) {
+		Error("invalid device id %d", m.deviceID)
+		return syscall.Errno(errs.EFSCORRUPTED)
+	}
+
+	if m.deviceID != 0 {
+		if m.deviceID > int(sbi.NBlobs) {
+			m.pa += ErofsPos(sbi, uint64(sbi.Devs[m.deviceID-1].MappedBlkAddr))
+			m.deviceID = 0
+		}
+		return nil
+	}
+
+	blkaddr := ErofsBlknr(sbi, uint(m.pa))
+	for i := 0; i < int(sbi.NBlobs) && i < len(sbi.Devs); i++ {
+		dev := &sbi.Devs[i]
+
+		if dev.MappedBlkAddr != 0 && blkaddr >= uint(dev.MappedBlkAddr) &&
+			blkaddr < uint(dev.MappedBlkAddr)+uint(dev.Blocks) {
+			m.pa -= ErofsPos(sbi, uint64(dev.MappedBlkAddr))
+			m.deviceID = i + 1
+			break
+		}
+	}
+	return nil
+}
+
+// ErofsPread reads len(buf) bytes of the data of inode at offset, holes of
+// chunk-based inodes are read as zeroes
+func ErofsPread(inode *ErofsInode, buf []byte, offset uint64) error {
+	var m erofsMapBlocks
+	var mapBlocks func(*ErofsInode, *erofsMapBlocks) error
+
+	if offset+uint64(len(buf)) > inode.ISize {
+		return syscall.Errno(errs.EINVAL)
+	}
+	switch inode.DataLayout {
+	case EROFS_INODE_FLAT_PLAIN, EROFS_INODE_FLAT_INLINE:
+		mapBlocks = erofsMapBlocksFlat
+	case EROFS_INODE_CHUNK_BASED:
+		mapBlocks = erofsMapBlocksChunk
+	default:
+		Error("unsupported data layout %d of nid %d", inode.DataLayout, inode.Nid)
+		return syscall.Errno(errs.EOPNOTSUPP)
+	}
+
+	for len(buf) != 0 {
+		m.la = offset
+		if err := mapBlocks(inode, &m); err != nil {
+			return err
+		}
+		n := min(m.llen, uint64(len(buf)))
+
+		if !m.mapped {
+			clear(buf[:n])
+		} else {
+			if err := erofsMapDev(inode.Sbi, &m); err != nil {
+				return err
+			}
+			if _, err := ErofsDevRead(inode.Sbi, m.deviceID, buf[:n], m.pa, int64(n)); err != nil {
+				return err
+			}
+		}
+		buf = buf[n:]
+		offset += n
+	}
+	return nil
+}
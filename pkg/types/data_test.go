@@ -0,0 +1,206 @@
+package types_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+// dataTestPattern returns n bytes which differ from block to block
+func dataTestPattern(n int, seed byte) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = seed + byte(i>>12) + byte(i%251)
+	}
+	return buf
+}
+
+// dataTestRead reads the whole data of the inode nid of img, extra devices
+// are opened as blobs
+func dataTestRead(t *testing.T, img string, nid uint64, devs ...string) (*types.ErofsInode, []byte) {
+	t.Helper()
+
+	sbi, err := mkfsTestOpen(t, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, dev := range devs {
+		f, err := os.Open(dev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		sbi.BlobFd[i] = uint32(f.Fd())
+		sbi.NBlobs++
+	}
+
+	vi := &types.ErofsInode{Sbi: sbi, Nid: nid}
+	if err = types.ErofsReadInodeFromDisk(vi); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, vi.ISize)
+	if err = types.ErofsPread(vi, buf, 0); err != nil {
+		t.Fatalf("ErofsPread() = %v", err)
+	}
+	return vi, buf
+}
+
+func TestErofsPreadFlat(t *testing.T) {
+	files := map[string][]byte{
+		"inline": []byte("inline data"),
+		"plain":  dataTestPattern(2<<12, 1),
+		"tail":   dataTestPattern(3<<12+100, 2),
+	}
+	src := t.TempDir()
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(src, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	img, nids := mkfsTestImage(t, src, nil)
+
+	tests := []struct {
+		name       string
+		datalayout uint8
+	}{
+		{"inline", types.EROFS_INODE_FLAT_INLINE},
+		{"plain", types.EROFS_INODE_FLAT_PLAIN},
+		{"tail", types.EROFS_INODE_FLAT_INLINE},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vi, data := dataTestRead(t, img, nids[tt.name])
+			if vi.DataLayout != tt.datalayout {
+				t.Errorf("data layout %d, want %d", vi.DataLayout, tt.datalayout)
+			}
+			if !bytes.Equal(data, files[tt.name]) {
+				t.Fatal("ErofsPread() read data other than written")
+			}
+
+			// unaligned reads across the block boundaries
+			size := uint64(len(data))
+			for _, off := range []uint64{1, size / 2, size - 1} {
+				buf := make([]byte, min(5000, size-off))
+				if err := types.ErofsPread(vi, buf, off); err != nil {
+					t.Fatalf("ErofsPread(@%d) = %v", off, err)
+				}
+				if !bytes.Equal(buf, data[off:off+uint64(len(buf))]) {
+					t.Errorf("ErofsPread(@%d) read data other than written", off)
+				}
+			}
+
+			err := types.ErofsPread(vi, make([]byte, 2), size-1)
+			if !errors.Is(err, syscall.Errno(errs.EINVAL)) {
+				t.Errorf("ErofsPread() past the end = %v, want EINVAL", err)
+			}
+		})
+	}
+}
+
+func TestErofsPreadChunked(t *testing.T) {
+	const bsize = 1 << 12
+
+	// data, a 2-block hole, data and a trailing hole
+	want := make([]byte, 6*bsize)
+	copy(want, dataTestPattern(bsize, 3))
+	copy(want[3*bsize:], dataTestPattern(bsize+10, 4))
+	src := t.TempDir()
+	f, err := os.Create(filepath.Join(src, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt(want[:bsize], 0); err == nil {
+		_, err = f.WriteAt(want[3*bsize:4*bsize+10], 3*bsize)
+	}
+	if err == nil {
+		err = f.Truncate(int64(len(want)))
+	}
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		format  int
+		indexes bool
+	}{
+		{"block map", types.FORCE_INODE_BLOCK_MAP, false},
+		{"chunk indexes", types.FORCE_INODE_CHUNK_INDEX, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, nids := mkfsTestImage(t, src, func(sbi *types.SuperBlkInfo) {
+				types.GCfg.ChunkBits = 12
+				types.GCfg.ForceChunkFormat = tt.format
+			})
+
+			vi, data := dataTestRead(t, img, nids["sparse"])
+			if vi.DataLayout != types.EROFS_INODE_CHUNK_BASED {
+				t.Fatalf("data layout %d, want chunk-based", vi.DataLayout)
+			}
+			if indexes := uint32(vi.ChunkFormat)&types.EROFS_CHUNK_FORMAT_INDEXES != 0; indexes != tt.indexes {
+				t.Errorf("chunk indexes %v, want %v", indexes, tt.indexes)
+			}
+			if !bytes.Equal(data, want) {
+				t.Fatal("ErofsPread() read data other than written")
+			}
+
+			// holes don't take any space in the image
+			fi, err := os.Stat(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nblocks := (fi.Size() + bsize - 1) / bsize; nblocks > 4 {
+				t.Errorf("image of %d blocks, want no more than 4", nblocks)
+			}
+		})
+	}
+}
+
+func TestErofsPreadDevice(t *testing.T) {
+	want := dataTestPattern(3<<12+10, 5)
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dev := filepath.Join(t.TempDir(), "dev0")
+	img, nids := mkfsTestImage(t, src, func(sbi *types.SuperBlkInfo) {
+		types.GCfg.DevicePaths = []string{dev}
+	})
+
+	vi, data := dataTestRead(t, img, nids["file"], dev)
+	if !bytes.Equal(data, want) {
+		t.Fatal("ErofsPread() read data other than written")
+	}
+
+	// unknown bits of device ids are masked by the number of devices
+	buf, err := os.ReadFile(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := types.RoundUp(types.ErofsIloc(vi)+uint64(vi.InodeIsize)+uint64(vi.XattrIsize),
+		types.EROFS_CHUNK_INDEX_SIZE)
+	if id := binary.LittleEndian.Uint16(buf[pos+2:]); id != 1 {
+		t.Fatalf("device id %d, want 1", id)
+	}
+	binary.LittleEndian.PutUint16(buf[pos+2:], 0x101)
+	sbTestFixChecksum(buf[types.EROFS_SUPER_OFFSET:], vi.Sbi.BlkSzBits)
+	fn := filepath.Join(t.TempDir(), "test.img")
+	if err = os.WriteFile(fn, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, data = dataTestRead(t, fn, nids["file"], dev); !bytes.Equal(data, want) {
+		t.Fatal("ErofsPread() read data other than written with a masked device id")
+	}
+}
@@ -0,0 +1,279 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"syscall"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+)
+
+// symlinks followed at most by a lookup, as MAXSYMLINKS of the kernel
+const erofsMaxSymlinks = 40
+
+// ErofsDirent is an entry of a directory in an image
+type ErofsDirent struct {
+	Name string
+	Nid  uint64
+	Type uint8 // EROFS_FT_*
+}
+
+// ErofsDirentFunc is called for each entry of a directory, iteration stops
+// at the first error
+type ErofsDirentFunc func(name string, nid uint64, ftype uint8) error
+
+// erofsDirBlockCount returns the number of dirents in a directory block
+func erofsDirBlockCount(dir *ErofsInode, blk []byte) (uint32, error) {
+	if len(blk) < EROFS_DIRENT_SIZE {
+		Error("invalid dir block size %d @ nid %d", len(blk), dir.Nid)
+		return 0, syscall.Errno(errs.EFSCORRUPTED)
+	}
+	nameoff := uint32(binary.LittleEndian.Uint16(blk[8:]))
+	if nameoff < EROFS_DIRENT_SIZE || nameoff >= uint32(len(blk)) {
+		Error("invalid dirent nameoff %d @ nid %d", nameoff, dir.Nid)
+		return 0, syscall.Errno(errs.EFSCORRUPTED)
+	}
+	return nameoff / EROFS_DIRENT_SIZE, nil
+}
+
+// erofsDirentName returns the name of dirent i out of count in a directory
+// block, which is bounded by the name of the next dirent
+func erofsDirentName(dir *ErofsInode, blk []byte, i, count uint32) ([]byte, error) {
+	de := blk[i*EROFS_DIRENT_SIZE:]
+	start := uint32(binary.LittleEndian.Uint16(de[8:]))
+	end := uint32(len(blk))
+	if i+1 < count {
+		end = uint32(binary.LittleEndian.Uint16(de[EROFS_DIRENT_SIZE+8:]))
+	}
+	if start < count*EROFS_DIRENT_SIZE || end > uint32(len(blk)) || start >= end {
+		Error("invalid dirent %d @ nid %d", i, dir.Nid)
+		return nil, syscall.Errno(errs.EFSCORRUPTED)
+	}
+
+	// the last name is padded with NULs to the end of the block
+	name := blk[start:end]
+	if i+1 == count {
+		if n := bytes.IndexByte(name, 0); n >= 0 {
+			name = name[:n]
+		}
+	}
+	if len(name) == 0 || len(name) > EROFS_NAME_LEN {
+		Error("invalid dirent name length @ nid %d", dir.Nid)
+		return nil, syscall.Errno(errs.EFSCORRUPTED)
+	}
+	return name, nil
+}
+
+// erofsIterateDirBlock walks the dirents of a directory block, which are
+// followed by their names
+func erofsIterateDirBlock(dir *ErofsInode, blk []byte, fn ErofsDirentFunc) error {
+	count, err := erofsDirBlockCount(dir, blk)
+	if err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < count; i++ {
+		name, err := erofsDirentName(dir, blk, i, count)
+		if err != nil {
+			return err
+		}
+		de := blk[i*EROFS_DIRENT_SIZE:]
+		if err = fn(string(name), binary.LittleEndian.Uint64(de[0:]), de[10]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// erofsReadDirBlock reads directory block nr of dir into buf, the last one
+// may be a short inline tail
+func erofsReadDirBlock(dir *ErofsInode, buf []byte, nr uint64) ([]byte, error) {
+	pos := ErofsPos(dir.Sbi, nr)
+	blk := buf[:min(uint64(len(buf)), dir.ISize-pos)]
+
+	if err := ErofsPread(dir, blk, pos); err != nil {
+		return nil, err
+	}
+	return blk, nil
+}
+
+// ErofsIterateDir calls fn for each entry of dir, including "." and ".."
+func ErofsIterateDir(dir *ErofsInode, fn ErofsDirentFunc) error {
+	if !dir.IsDir() {
+		return syscall.Errno(errs.ENOTDIR)
+	}
+
+	buf := make([]byte, ErofsBlkSiz(dir.Sbi))
+	for nr := uint64(0); nr < BlkRoundUp(dir.Sbi, dir.ISize); nr++ {
+		blk, err := erofsReadDirBlock(dir, buf, nr)
+		if err != nil {
+			return err
+		}
+		if err = erofsIterateDirBlock(dir, blk, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErofsReadDir returns the entries of the directory nid, including "." and
+// ".." in on-disk order
+func ErofsReadDir(sbi *SuperBlkInfo, nid uint64) ([]ErofsDirent, error) {
+	var dirents []ErofsDirent
+
+	dir := &ErofsInode{Sbi: sbi, Nid: nid}
+	if err := ErofsReadInodeFromDisk(dir); err != nil {
+		return nil, err
+	}
+	err := ErofsIterateDir(dir, func(name string, nid uint64, ftype uint8) error {
+		dirents = append(dirents, ErofsDirent{Name: name, Nid: nid, Type: ftype})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dirents, nil
+}
+
+// erofsDirBlockFind binary-searches name in a sorted directory block. It
+// returns the index of the matching dirent, or -1 and the comparison
+// result against the first name of the block if there is none.
+func erofsDirBlockFind(dir *ErofsInode, blk []byte, name []byte) (int, int, error) {
+	count, err := erofsDirBlockCount(dir, blk)
+	if err != nil {
+		return -1, 0, err
+	}
+
+	dname, err := erofsDirentName(dir, blk, 0, count)
+	if err != nil {
+		return -1, 0, err
+	}
+	first := bytes.Compare(name, dname)
+	if first <= 0 {
+		if first == 0 {
+			return 0, 0, nil
+		}
+		return -1, first, nil
+	}
+
+	head, back := 1, int(count)-1
+	for head <= back {
+		mid := head + (back-head)/2
+		if dname, err = erofsDirentName(dir, blk, uint32(mid), count); err != nil {
+			return -1, 0, err
+		}
+
+		diff := bytes.Compare(name, dname)
+		switch {
+		case diff == 0:
+			return mid, 0, nil
+		case diff < 0:
+			back = mid - 1
+		default:
+			head = mid + 1
+		}
+	}
+	return -1, first, nil
+}
+
+// erofsNamei looks up name in dir. Directory blocks are sorted as a whole,
+// so the block which may hold name is binary-searched by the first names
+// of the blocks before searching in it.
+func erofsNamei(dir *ErofsInode, name string) (uint64, uint8, error) {
+	if !dir.IsDir() {
+		return 0, 0, syscall.Errno(errs.ENOTDIR)
+	}
+	if len(name) > EROFS_NAME_LEN {
+		return 0, 0, syscall.Errno(errs.ENAMETOOLONG)
+	}
+
+	buf := make([]byte, ErofsBlkSiz(dir.Sbi))
+	head, back := uint64(0), BlkRoundUp(dir.Sbi, dir.ISize)
+	for head < back {
+		mid := head + (back-head)/2
+		blk, err := erofsReadDirBlock(dir, buf, mid)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		i, diff, err := erofsDirBlockFind(dir, blk, []byte(name))
+		if err != nil {
+			return 0, 0, err
+		}
+		if i >= 0 {
+			de := blk[i*EROFS_DIRENT_SIZE:]
+			return binary.LittleEndian.Uint64(de[0:]), de[10], nil
+		}
+		if diff < 0 {
+			back = mid
+		} else {
+			// name sorts into this block or one of the later ones
+			head = mid + 1
+		}
+	}
+	return 0, 0, syscall.Errno(errs.ENOENT)
+}
+
+// erofsReadLink returns the target of the symlink vi
+func erofsReadLink(vi *ErofsInode) (string, error) {
+	if vi.ISize == 0 || vi.ISize > syscall.PathMax {
+		Error("invalid symlink size %d of nid %d", vi.ISize, vi.Nid)
+		return "", syscall.Errno(errs.EFSCORRUPTED)
+	}
+	link := make([]byte, vi.ISize)
+	if err := ErofsPread(vi, link, 0); err != nil {
+		return "", err
+	}
+	return string(link), nil
+}
+
+// ErofsLookup resolves path, relative to the root of the image, to its
+// inode. Symlinks in the middle of path are always followed, and the last
+// one is only followed if follow is set. Absolute symlinks are resolved
+// against the root of the image.
+func ErofsLookup(sbi *SuperBlkInfo, path string, follow bool) (*ErofsInode, error) {
+	var links int
+
+	root := &ErofsInode{Sbi: sbi, Nid: uint64(sbi.RootNid)}
+	if err := ErofsReadInodeFromDisk(root); err != nil {
+		return nil, err
+	}
+
+	dir := root
+	names := strings.Split(path, "/")
+	for len(names) != 0 {
+		name := names[0]
+		names = names[1:]
+		if name == "" || name == "." {
+			continue
+		}
+
+		nid, _, err := erofsNamei(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		vi := &ErofsInode{Sbi: sbi, Nid: nid}
+		if err = ErofsReadInodeFromDisk(vi); err != nil {
+			return nil, err
+		}
+
+		if !vi.IsLnk() || (len(names) == 0 && !follow) {
+			dir = vi
+			continue
+		}
+		if links++; links > erofsMaxSymlinks {
+			return nil, syscall.Errno(errs.ELOOP)
+		}
+		link, err := erofsReadLink(vi)
+		if err != nil {
+			return nil, err
+		}
+		// the target is looked up in place of the symlink
+		if strings.HasPrefix(link, "/") {
+			dir = root
+		}
+		names = append(strings.Split(link, "/"), names...)
+	}
+	return dir, nil
+}
@@ -0,0 +1,162 @@
+package types_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+// dirTestImage builds an image with a directory spanning several blocks
+// and a few symlinks, and returns it with the names in the directory
+func dirTestImage(t *testing.T) (string, map[string]uint64, []string) {
+	t.Helper()
+
+	src := t.TempDir()
+	files := map[string]string{"file": "data"}
+	var names []string
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("entry-with-a-rather-long-name-%03d", i)
+		files["dir/"+name] = name
+		names = append(names, name)
+	}
+	mkfsTestWrite(t, src, files)
+	for link, target := range map[string]string{
+		"abs":      "/dir/entry-with-a-rather-long-name-123",
+		"rel":      "dir",
+		"loop":     "loop",
+		"dangling": "missing",
+	} {
+		if err := os.Symlink(target, filepath.Join(src, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	img, nids := mkfsTestImage(t, src, nil)
+	nids["."] = uint64(types.GSbi.RootNid)
+	return img, nids, names
+}
+
+func TestErofsReadDir(t *testing.T) {
+	img, nids, names := dirTestImage(t)
+	sbi, err := mkfsTestOpen(t, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := &types.ErofsInode{Sbi: sbi, Nid: nids["dir"]}
+	if err = types.ErofsReadInodeFromDisk(dir); err != nil {
+		t.Fatal(err)
+	}
+	if nblocks := types.BlkRoundUp(sbi, dir.ISize); nblocks < 3 {
+		t.Fatalf("directory of %d blocks, want at least 3", nblocks)
+	}
+
+	dirents, err := types.ErofsReadDir(sbi, nids["dir"])
+	if err != nil {
+		t.Fatalf("ErofsReadDir() = %v", err)
+	}
+	want := append([]string{".", ".."}, names...)
+	sort.Strings(want)
+	if len(dirents) != len(want) {
+		t.Fatalf("ErofsReadDir() returned %d entries, want %d", len(dirents), len(want))
+	}
+	for i, de := range dirents {
+		if de.Name != want[i] {
+			t.Fatalf("entry %d is %q, want %q", i, de.Name, want[i])
+		}
+		ftype := uint8(types.EROFS_FT_REG_FILE)
+		switch de.Name {
+		case ".":
+			ftype = types.EROFS_FT_DIR
+			if de.Nid != nids["dir"] {
+				t.Errorf(".: nid %d, want %d", de.Nid, nids["dir"])
+			}
+		case "..":
+			ftype = types.EROFS_FT_DIR
+			if de.Nid != nids["."] {
+				t.Errorf("..: nid %d, want %d", de.Nid, nids["."])
+			}
+		}
+		if de.Type != ftype {
+			t.Errorf("%s: file type %d, want %d", de.Name, de.Type, ftype)
+		}
+	}
+
+	_, err = types.ErofsReadDir(sbi, nids["file"])
+	if !errors.Is(err, syscall.Errno(errs.ENOTDIR)) {
+		t.Errorf("ErofsReadDir() of a file = %v, want ENOTDIR", err)
+	}
+}
+
+func TestErofsLookup(t *testing.T) {
+	img, nids, names := dirTestImage(t)
+	sbi, err := mkfsTestOpen(t, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirents, err := types.ErofsReadDir(sbi, nids["dir"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, de := range dirents {
+		nids["dir/"+de.Name] = de.Nid
+	}
+
+	tests := []struct {
+		path   string
+		follow bool
+		want   string // key of nids
+		errno  syscall.Errno
+	}{
+		{path: "/", want: "."},
+		{path: "file", want: "file"},
+		{path: "//dir/./", want: "dir"},
+		{path: "dir/..", want: "."},
+		{path: "dir/" + names[0], want: "dir/" + names[0]},
+		{path: "dir/" + names[len(names)-1], want: "dir/" + names[len(names)-1]},
+		{path: "dir/missing", errno: syscall.Errno(errs.ENOENT)},
+		{path: "dir/entry-with-a-rather-long-name-1234", errno: syscall.Errno(errs.ENOENT)},
+		{path: "dir/0", errno: syscall.Errno(errs.ENOENT)},
+		{path: "dir/zzz", errno: syscall.Errno(errs.ENOENT)},
+		{path: "missing/file", errno: syscall.Errno(errs.ENOENT)},
+		{path: "file/file", errno: syscall.Errno(errs.ENOTDIR)},
+		{path: "abs", want: "abs"},
+		{path: "abs", follow: true, want: "dir/entry-with-a-rather-long-name-123"},
+		{path: "rel/" + names[7], want: "dir/" + names[7]},
+		{path: "rel", follow: true, want: "dir"},
+		{path: "dangling", want: "dangling"},
+		{path: "dangling", follow: true, errno: syscall.Errno(errs.ENOENT)},
+		{path: "loop", follow: true, errno: syscall.Errno(errs.ELOOP)},
+	}
+
+	for _, tt := range tests {
+		vi, err := types.ErofsLookup(sbi, tt.path, tt.follow)
+		if tt.errno != 0 {
+			if !errors.Is(err, tt.errno) {
+				t.Errorf("ErofsLookup(%q) = %v, want %v", tt.path, err, tt.errno)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ErofsLookup(%q) = %v", tt.path, err)
+			continue
+		}
+		if vi.Nid != nids[tt.want] {
+			t.Errorf("ErofsLookup(%q) = nid %d, want %d (%s)", tt.path, vi.Nid, nids[tt.want], tt.want)
+		}
+	}
+
+	// every entry can be found by binary search over the blocks
+	for _, name := range names {
+		if vi, err := types.ErofsLookup(sbi, "dir/"+name, false); err != nil || vi.Nid != nids["dir/"+name] {
+			t.Fatalf("ErofsLookup(dir/%s) = %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package types
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+)
+
+// cannedFsConfigEntry is one line of a canned fs_config file:
+// "path uid gid mode [capabilities=#]"
+type cannedFsConfigEntry struct {
+	path         string
+	uid          uint32
+	gid          uint32
+	mode         uint32
+	capabilities uint64
+}
+
+var cannedFsConfig []cannedFsConfigEntry
+
+// LoadCannedFsConfig loads a canned fs_config file as libcutils does
+func LoadCannedFsConfig(fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cannedFsConfig = cannedFsConfig[:0]
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			return fmt.Errorf("%s:%d: invalid line: %s", fn, lineno, line)
+		}
+
+		ent := cannedFsConfigEntry{path: strings.TrimPrefix(fields[0], "/")}
+		uid, err1 := strconv.ParseUint(fields[1], 10, 32)
+		gid, err2 := strconv.ParseUint(fields[2], 10, 32)
+		mode, err3 := strconv.ParseUint(fields[3], 8, 32)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return fmt.Errorf("%s:%d: invalid line: %s", fn, lineno, line)
+		}
+		ent.uid, ent.gid, ent.mode = uint32(uid), uint32(gid), uint32(mode)
+
+		for _, opt := range fields[4:] {
+			caps, ok := strings.CutPrefix(opt, "capabilities=")
+			if !ok {
+				return fmt.Errorf("%s:%d: unknown option %s", fn, lineno, opt)
+			}
+			ent.capabilities, err = strconv.ParseUint(caps, 0, 64)
+			if err != nil {
+				return fmt.Errorf("%s:%d: invalid capabilities %s", fn, lineno, caps)
+			}
+		}
+		cannedFsConfig = append(cannedFsConfig, ent)
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	sort.SliceStable(cannedFsConfig, func(i, j int) bool {
+		return cannedFsConfig[i].path < cannedFsConfig[j].path
+	})
+	return nil
+}
+
+// cannedFsConfigLookup returns the fs_config entry of path, the last one
+// wins if path is listed more than once
+func cannedFsConfigLookup(path string) (*cannedFsConfigEntry, error) {
+	path = strings.TrimPrefix(path, "/")
+
+	i := sort.Search(len(cannedFsConfig), func(i int) bool {
+		return cannedFsConfig[i].path > path
+	})
+	if i == 0 || cannedFsConfig[i-1].path != path {
+		Error("failed to find [%s] in canned fs_config", path)
+		return nil, syscall.Errno(errs.ENOENT)
+	}
+	return &cannedFsConfig[i-1], nil
+}
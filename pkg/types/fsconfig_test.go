@@ -0,0 +1,76 @@
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func fsConfigTestLoad(t *testing.T, config string) error {
+	t.Helper()
+
+	fn := filepath.Join(t.TempDir(), "fs_config")
+	if err := os.WriteFile(fn, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cannedFsConfig = nil })
+	return LoadCannedFsConfig(fn)
+}
+
+func TestLoadCannedFsConfig(t *testing.T) {
+	const config = `# path uid gid mode [capabilities=#]
+system/bin/ping 0 2000 0750 capabilities=0x2000
+/system/bin/su 0 2000 04750
+system 0 0 0755
+system/bin/su 0 0 0700 capabilities=0x10000000080
+`
+	GCfg.DebugLevel = EROFS_ERR
+	if err := fsConfigTestLoad(t, config); err != nil {
+		t.Fatalf("LoadCannedFsConfig() = %v", err)
+	}
+
+	tests := []struct {
+		path  string
+		want  cannedFsConfigEntry
+		fails bool
+	}{
+		{path: "system", want: cannedFsConfigEntry{"system", 0, 0, 0755, 0}},
+		{path: "/system/bin/ping", want: cannedFsConfigEntry{"system/bin/ping", 0, 2000, 0750, 1 << 13}},
+		// the last entry of a path wins
+		{path: "system/bin/su", want: cannedFsConfigEntry{"system/bin/su", 0, 0, 0700, 1<<40 | 1<<7}},
+		{path: "system/bin", fails: true},
+	}
+
+	for _, tt := range tests {
+		got, err := cannedFsConfigLookup(tt.path)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("cannedFsConfigLookup(%s) = %+v, want an error", tt.path, *got)
+			}
+			continue
+		}
+		if err != nil || *got != tt.want {
+			t.Errorf("cannedFsConfigLookup(%s) = %+v, %v, want %+v", tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestLoadCannedFsConfigMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"too few fields", "system 0 0\n"},
+		{"invalid mode", "system 0 0 0789\n"},
+		{"unknown option", "system 0 0 0755 selabel=u:r:system:s0\n"},
+		{"invalid capabilities", "system 0 0 0755 capabilities=cap_chown\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := fsConfigTestLoad(t, tt.config); err == nil {
+				t.Fatal("LoadCannedFsConfig() succeeded, want an error")
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"fmt"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"sync/atomic"
@@ -26,7 +27,7 @@ func BfindForAttach(bmgr *BufferManager, btype int, size uint64,
 	used0 = ((uint32(size) + requiredExt) & (blkSiz - 1)) + inlineExt
 	// inline data should be in the same fs block
 	if used0 > blkSiz {
-		return nil, fmt.Errorf("ENOSPC: %d", errs.ENOSPC)
+		return nil, syscall.Errno(errs.ENOSPC)
 	}
 
 	if used0 == 0 || alignsize == blkSiz {
@@ -49,14 +50,10 @@ func BfindForAttach(bmgr *BufferManager, btype int, size uint64,
 			continue
 		}
 
-		curEntry := bt.Next
-		curInterface := ContainerOf(curEntry, &BufferBlock{}, "MappedList")
-		cur, _ = curInterface.(*BufferBlock)
+		cur = BufferBlockFromMappedList(bt.Next)
 
 		// last mapped block can be expended, don't handle it here
-		nextEntry := cur.List.Next
-		nextInterface := ContainerOf(nextEntry, &BufferBlock{}, "List")
-		next, _ := nextInterface.(*BufferBlock)
+		next := ListNextEntryBB(cur)
 
 		if next.BlkAddr == NULL_ADDR {
 			if cur != bmgr.LastMappedBlock {
@@ -96,9 +93,7 @@ skipMapped:
 	// try to start from the last mapped one, which can be expended
 	cur = bmgr.LastMappedBlock
 	if cur == &bmgr.BlkH {
-		nextEntry := cur.List.Next
-		nextInterface := ContainerOf(nextEntry, &BufferBlock{}, "List")
-		cur, _ = nextInterface.(*BufferBlock)
+		cur = ListNextEntryBB(cur)
 	}
 
 	for cur != &bmgr.BlkH {
@@ -106,25 +101,19 @@ skipMapped:
 
 		// skip if buffer block is just full
 		if usedBefore == 0 {
-			nextEntry := cur.List.Next
-			nextInterface := ContainerOf(nextEntry, &BufferBlock{}, "List")
-			cur, _ = nextInterface.(*BufferBlock)
+			cur = ListNextEntryBB(cur)
 			continue
 		}
 
 		// skip if the entry which has different type
 		if cur.Type != btype {
-			nextEntry := cur.List.Next
-			nextInterface := ContainerOf(nextEntry, &BufferBlock{}, "List")
-			cur, _ = nextInterface.(*BufferBlock)
+			cur = ListNextEntryBB(cur)
 			continue
 		}
 
 		ret = BattachInternal(cur, nil, size, alignsize, requiredExt+inlineExt, true)
 		if ret < 0 {
-			nextEntry := cur.List.Next
-			nextInterface := ContainerOf(nextEntry, &BufferBlock{}, "List")
-			cur, _ = nextInterface.(*BufferBlock)
+			cur = ListNextEntryBB(cur)
 			continue
 		}
 
@@ -132,9 +121,7 @@ skipMapped:
 
 		// should contain inline data in current block
 		if used > blkSiz {
-			nextEntry := cur.List.Next
-			nextInterface := ContainerOf(nextEntry, &BufferBlock{}, "List")
-			cur, _ = nextInterface.(*BufferBlock)
+			cur = ListNextEntryBB(cur)
 			continue
 		}
 
@@ -143,9 +130,7 @@ skipMapped:
 		 * larger than allocating a new buffer block
 		 */
 		if used < usedBefore && used < used0 {
-			nextEntry := cur.List.Next
-			nextInterface := ContainerOf(nextEntry, &BufferBlock{}, "List")
-			cur, _ = nextInterface.(*BufferBlock)
+			cur = ListNextEntryBB(cur)
 			continue
 		}
 
@@ -154,9 +139,7 @@ skipMapped:
 			usedmax = used
 		}
 
-		nextEntry := cur.List.Next
-		nextInterface := ContainerOf(nextEntry, &BufferBlock{}, "List")
-		cur, _ = nextInterface.(*BufferBlock)
+		cur = ListNextEntryBB(cur)
 	}
 
 	return bb, nil
@@ -165,15 +148,13 @@ skipMapped:
 func ErofsBfree(bb *BufferBlock) {
 	bmgr := bb.Buffers.FsPrivate.(*BufferManager)
 
-	if IsListEmpty(&bb.Buffers.List) {
-		return
+	if !IsListEmpty(&bb.Buffers.List) {
+		panic("BUG: freeing a buffer block with attached buffers")
 	}
 
 	// If this is the last mapped block, update the pointer to the previous entry
 	if bb == bmgr.LastMappedBlock {
-		// Get the previous entry in the list
-		prev := ListEntry(bb.MappedList.Prev, &BufferBlock{}, "MappedList")
-		bmgr.LastMappedBlock = prev.(*BufferBlock)
+		bmgr.LastMappedBlock = BufferBlockFromList(bb.List.Prev)
 	}
 
 	// Remove from lists
@@ -384,6 +365,12 @@ func lseek(fd int, offset int64, whence int) int64 {
 	return int64(off)
 }
 
+// ErofsSetFsRoot records the source root so that ErofsFspath can turn
+// source paths into paths relative to the filesystem root
+func ErofsSetFsRoot(rootdir string) {
+	FullpathPrefix = len(filepath.Clean(rootdir))
+}
+
 func ErofsFspath(fullpath string) string {
 	// Skip prefix characters
 	if FullpathPrefix >= len(fullpath) {
@@ -420,11 +407,9 @@ func erofsParentInode(inode *ErofsInode) *ErofsInode {
 }
 
 func ErofsAtomicDecReturn(InodeICount *int32) uint {
-	fmt.Println("ErofsAtomicDecReturn")
 	return erofsAtomicSubReturn(InodeICount, 1)
 }
 
 func erofsAtomicSubReturn(ptr *int32, i int32) uint {
-	fmt.Println("ErofsAtomicDecReturn - Internal")
 	return uint(atomic.AddInt32(ptr, ^(i - 1)))
 }
@@ -1,12 +1,16 @@
 package types
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"syscall"
 	"time"
 	"unsafe"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
 )
 
 type ErofsDiskbuf struct {
@@ -191,6 +195,12 @@ func (i *ErofsInode) IsLnk() bool {
 	return (i.IMode & 0170000) == 0120000 // S_IFLNK
 }
 
+// IsWhiteout returns true if the inode is an overlayfs whiteout, i.e. a
+// character device with 0/0 device number
+func (i *ErofsInode) IsWhiteout() bool {
+	return (i.IMode&0170000) == 020000 && i.IRdev == 0 // S_IFCHR
+}
+
 // IsCompressed returns true if the inode data is compressed
 func (i *ErofsInode) IsCompressed() bool {
 	return i.DataLayout == EROFS_INODE_COMPRESSED_FULL ||
@@ -204,136 +214,88 @@ func (i *ErofsInode) SetRoot() {
 	i.IParent = i    // Root is its own parent
 }
 
-// ErofsReadInodeFromDisk reads an inode from disk and fills the in-memory inode structure
+// ErofsXattrIbodySize returns the size of the xattr ibody given by the
+// i_xattr_icount of an on-disk inode
+func ErofsXattrIbodySize(icount uint16) uint32 {
+	if icount == 0 {
+		return 0
+	}
+	return EROFS_XATTR_IBODY_HDR_SIZE + uint32(icount-1)*EROFS_XATTR_ENTRY_SIZE
+}
+
+// ErofsReadInodeFromDisk reads the on-disk inode of vi.Nid and fills the
+// in-memory inode structure
 func ErofsReadInodeFromDisk(vi *ErofsInode) error {
-	// var ret int64
-	// var ifmt uint16
-
-	// DBG_BUGON(vi.Sbi == nil)
-	// inodeLoc := erofsIloc(vi)
-
-	// // Create buffer for reading inode data
-	// buf := make([]byte, binary.Size(ErofsInodeExtended{}))
-
-	// // Read the compact inode first (which is always the first part)
-	// ret, _ = ErofsDevRead(vi.Sbi, 0, buf, inodeLoc, int64(binary.Size(ErofsInodeCompact{})))
-	// if ret < 0 {
-	// 	return fmt.Errorf("failed to read compact inode: %w", syscall.Errno(-ret))
-	// }
-
-	// // Parse compact inode format
-	// var dic *ErofsInodeCompact = (*ErofsInodeCompact)(unsafe.Pointer(&buf[0]))
-	// // In Go, we need to manually decode the binary data
-	// // This is a simplified version - in practice, you'd use binary.Read or a struct decoder
-	// ifmt = dic.IFormat
-
-	// Set DataLayout
-	// vi.DataLayout = ErofsInodeDatalayout(ifmt)
-	// if vi.DataLayout >= EROFS_INODE_DATALAYOUT_MAX {
-	// 	return fmt.Errorf("unsupported DataLayout %d of nid %d: %w",
-	// 		vi.DataLayout, vi.Nid, syscall.Errno(EOPNOTSUPP))
-	// }
-
-	// // Process based on inode version
-	// switch ErofsInodeVersion(ifmt) {
-	// case EROFS_INODE_LAYOUT_EXTENDED:
-	// 	vi.InodeIsize = uint8(binary.Size(ErofsInodeExtended{}))
-
-	// 	// Read the rest of the extended inode
-	// 	ret, _ = ErofsDevRead(vi.Sbi, 0, buf[binary.Size(ErofsInodeCompact{}):],
-	// 		inodeLoc+uint64(binary.Size(ErofsInodeCompact{})),
-	// 		int64(binary.Size(ErofsInodeExtended{})-binary.Size(ErofsInodeCompact{})))
-	// 	if ret < 0 {
-	// 		return fmt.Errorf("failed to read extended inode: %w", syscall.Errno(-ret))
-	// 	}
-
-	// 	// Parse extended inode data
-	// 	var die *ErofsInodeExtended = (*ErofsInodeExtended)(unsafe.Pointer(&buf[0]))
-	// 	// In practice, you'd use binary.Read for proper decoding
-	// 	// This is a simplified version that assumes the buffer contains valid data
-
-	// 	// Extract fields from extended inode (die)
-	// 	vi.XattrIsize = ErofsXattrIbodySize(binary.LittleEndian.Uint16(buf[2:4])) // i_xattr_icount
-	// 	vi.IMode = die.IMode                                                      // i_mode
-	// 	vi.IIno[0] = uint64(die.IIno)                                             // i_ino
-
-	// 	// Handle different file types
-	// 	switch vi.IMode & S_IFMT {
-	// 	case S_IFREG, S_IFDIR, S_IFLNK:
-	// 		vi.IBlkaddr = binary.LittleEndian.Uint32(buf[32:36]) // raw_blkaddr
-	// 	case S_IFCHR, S_IFBLK:
-	// 		vi.IRdev = ErofsNewDecodeDev(binary.LittleEndian.Uint32(buf[36:40])) // rdev
-	// 	case S_IFIFO, S_IFSOCK:
-	// 		vi.IRdev = 0
-	// 	default:
-	// 		return fmt.Errorf("bogus i_mode (%o) @ nid %d: %w", vi.IMode, vi.Nid, syscall.Errno(EFSCORRUPTED))
-	// 	}
-
-	// 	// Fill other fields from extended inode
-	// 	vi.IUid = die.IUid             // i_uid
-	// 	vi.IGid = die.IGid             // i_gid
-	// 	vi.INlink = die.INlink         // i_nlink
-	// 	vi.IMtime = die.IMTime         // i_mtime
-	// 	vi.IMtimeNsec = die.IMTimeNsec // i_mtime_nsec
-	// 	vi.ISize = die.ISize           // i_size
-
-	// 	// Fill chunk format for chunk-based inodes
-	// 	if vi.DataLayout == EROFS_INODE_CHUNK_BASED {
-	// 		vi.ChunkFormat = die.IU.ChunkInfo.Format // c.format
-	// 	}
-
-	// case EROFS_INODE_LAYOUT_COMPACT:
-	// 	vi.InodeIsize = uint8(binary.Size(ErofsInodeCompact{}))
-
-	// 	// Parse compact inode fields
-	// 	// In practice, you'd use binary.Read for proper decoding
-	// 	vi.XattrIsize = ErofsXattrIbodySize(dic.IXattrIcount) // i_xattr_icount
-	// 	vi.IMode = dic.IMode                                  // i_mode
-	// 	vi.IIno[0] = uint64(dic.IIno)                         // i_ino
-
-	// 	// Handle different file types
-	// 	switch vi.IMode & S_IFMT {
-	// 	case S_IFREG, S_IFDIR, S_IFLNK:
-	// 		vi.IBlkaddr = dic.IU.RawBlkAddr // raw_blkaddr
-	// 	case S_IFCHR, S_IFBLK:
-	// 		vi.IRdev = ErofsNewDecodeDev(dic.IU.Rdev) // rdev
-	// 	case S_IFIFO, S_IFSOCK:
-	// 		vi.IRdev = 0
-	// 	default:
-	// 		return fmt.Errorf("bogus i_mode (%o) @ nid %d: %w", vi.IMode, vi.Nid, syscall.Errno(EFSCORRUPTED))
-	// 	}
-
-	// 	// Fill other fields from compact inode
-	// 	vi.IUid = uint32(dic.IUid)     // i_uid
-	// 	vi.IGid = uint32(dic.IGid)     // i_gid
-	// 	vi.INlink = uint32(dic.INlink) // i_nlink
-
-	// 	// Use superblock build time for compact inodes
-	// 	vi.IMtime = vi.Sbi.BuildTime
-	// 	vi.IMtimeNsec = vi.Sbi.BuildTimeNsec
-
-	// 	vi.ISize = uint64(dic.ISize) // i_size
-
-	// 	// Fill chunk format for chunk-based inodes
-	// 	if vi.DataLayout == EROFS_INODE_CHUNK_BASED {
-	// 		vi.ChunkFormat = dic.IU.ChunkInfo.Format // c.format
-	// 	}
-
-	// default:
-	// 	return fmt.Errorf("unsupported on-disk inode version %d of nid %d: %w",
-	// 		ErofsInodeVersion(ifmt), vi.Nid, syscall.Errno(EOPNOTSUPP))
-	// }
-
-	// // Set flags and handle chunk-based inodes
-	// vi.Flags = 0
-	// if vi.DataLayout == EROFS_INODE_CHUNK_BASED {
-	// 	if uint32(vi.ChunkFormat)&^EROFS_CHUNK_FORMAT_ALL != 0 {
-	// 		return fmt.Errorf("unsupported chunk format %x of nid %d: %w",
-	// 			vi.ChunkFormat, vi.Nid, syscall.Errno(EOPNOTSUPP))
-	// 	}
-	// 	vi.ChunkBits = uint8(uint32(vi.Sbi.BlkSzBits) + (uint32(vi.ChunkFormat) & EROFS_CHUNK_FORMAT_BLKBITS_MASK))
-	// }
+	sbi := vi.Sbi
+	buf := make([]byte, EROFS_INODE_EXTENDED_SIZE)
+	iloc := ErofsIloc(vi)
 
+	if _, err := ErofsDevRead(sbi, 0, buf[:EROFS_INODE_COMPACT_SIZE], iloc, EROFS_INODE_COMPACT_SIZE); err != nil {
+		return err
+	}
+
+	ifmt := binary.LittleEndian.Uint16(buf[0:])
+	if ifmt&^(1<<EROFS_I_ALL_BIT-1) != 0 {
+		Error("unsupported i_format %x of nid %d", ifmt, vi.Nid)
+		return syscall.Errno(errs.EOPNOTSUPP)
+	}
+	vi.DataLayout = uint8(ifmt>>EROFS_I_DATALAYOUT_BIT) & EROFS_I_DATALAYOUT_MASK
+	if vi.DataLayout >= EROFS_INODE_DATALAYOUT_MAX {
+		Error("unsupported datalayout %d of nid %d", vi.DataLayout, vi.Nid)
+		return syscall.Errno(errs.EOPNOTSUPP)
+	}
+	vi.XattrIsize = ErofsXattrIbodySize(binary.LittleEndian.Uint16(buf[2:]))
+	vi.IMode = binary.LittleEndian.Uint16(buf[4:])
+	iu := binary.LittleEndian.Uint32(buf[16:])
+	vi.IIno[0] = uint64(binary.LittleEndian.Uint32(buf[20:]))
+
+	switch (ifmt >> EROFS_I_VERSION_BIT) & EROFS_I_VERSION_MASK {
+	case EROFS_INODE_LAYOUT_EXTENDED:
+		vi.InodeIsize = EROFS_INODE_EXTENDED_SIZE
+		_, err := ErofsDevRead(sbi, 0, buf[EROFS_INODE_COMPACT_SIZE:], iloc+EROFS_INODE_COMPACT_SIZE,
+			EROFS_INODE_EXTENDED_SIZE-EROFS_INODE_COMPACT_SIZE)
+		if err != nil {
+			return err
+		}
+		vi.ISize = binary.LittleEndian.Uint64(buf[8:])
+		vi.IUid = binary.LittleEndian.Uint32(buf[24:])
+		vi.IGid = binary.LittleEndian.Uint32(buf[28:])
+		vi.IMtime = binary.LittleEndian.Uint64(buf[32:])
+		vi.IMtimeNsec = binary.LittleEndian.Uint32(buf[40:])
+		vi.INlink = binary.LittleEndian.Uint32(buf[44:])
+	default:
+		vi.InodeIsize = EROFS_INODE_COMPACT_SIZE
+		vi.INlink = uint32(binary.LittleEndian.Uint16(buf[6:]))
+		vi.ISize = uint64(binary.LittleEndian.Uint32(buf[8:]))
+		vi.IUid = uint32(binary.LittleEndian.Uint16(buf[24:]))
+		vi.IGid = uint32(binary.LittleEndian.Uint16(buf[26:]))
+
+		// compact inodes take the build time of the filesystem
+		vi.IMtime = sbi.BuildTime
+		vi.IMtimeNsec = sbi.BuildTimeNsec
+	}
+
+	switch vi.IMode & S_IFMT {
+	case S_IFREG, S_IFDIR, S_IFLNK:
+		vi.IBlkaddr = iu
+	case S_IFCHR, S_IFBLK:
+		vi.IRdev = iu
+	case S_IFIFO, S_IFSOCK:
+		vi.IRdev = 0
+	default:
+		Error("bogus i_mode (%o) of nid %d", vi.IMode, vi.Nid)
+		return syscall.Errno(errs.EFSCORRUPTED)
+	}
+
+	vi.Flags = 0
+	if vi.DataLayout == EROFS_INODE_CHUNK_BASED {
+		if iu&^EROFS_CHUNK_FORMAT_ALL != 0 {
+			Error("unsupported chunk format %x of nid %d", iu, vi.Nid)
+			return syscall.Errno(errs.EOPNOTSUPP)
+		}
+		vi.ChunkFormat = uint16(iu)
+		vi.ChunkBits = sbi.BlkSzBits + uint8(uint32(vi.ChunkFormat)&EROFS_CHUNK_FORMAT_BLKBITS_MASK)
+	}
 	return nil
 }
 
@@ -370,38 +332,25 @@ func InitPackedFile(sbi *SuperBlkInfo, fragmentsMkfs bool) error {
 	}
 	epi.Fd = tmpFile
 
-	// // Handle existing fragments if needed
-	// if HasFeature(sbi, "fragments") && sbi.PackedNid > 0 {
-	// 	// Create a temporary inode to read from disk
-	// 	ei := &ErofsInode{
-	// 		Sbi: sbi,
-	// 		Nid: sbi.PackedNid,
-	// 	}
-
-	// 	// Read the inode from disk
-	// 	err = ReadInodeFromDisk(ei)
-	// 	if err != nil {
-	// 		Debug(EROFS_ERR, "failed to read packed inode from disk: %v", err)
-	// 		// ExitPackedFile(sbi)
-	// 		return err
-	// 	}
-
-	// 	// Seek to the end of existing data
-	// 	offset, err := epi.Fd.Seek(ei.Size, os.SEEK_SET)
-	// 	if err != nil {
-	// 		// ExitPackedFile(sbi)
-	// 		return fmt.Errorf("failed to seek in packed file: %v", err)
-	// 	}
-
-	// 	if offset < 0 {
-	// 		// ExitPackedFile(sbi)
-	// 		return fmt.Errorf("invalid offset in packed file")
-	// 	}
-
-	// 	// Calculate uptodate bitmap size and allocate
-	// 	epi.UptodateSize = BlockRoundUp(sbi, ei.Size) / 8
-	// 	epi.UptoDate = make([]byte, epi.UptoDateSize)
-	// }
+	// new fragments are appended to the existing ones
+	if ErofsSbHasFragments(sbi) && sbi.PackedNid > 0 {
+		ei := &ErofsInode{Sbi: sbi, Nid: sbi.PackedNid}
+
+		if err = ErofsReadInodeFromDisk(ei); err != nil {
+			Error("failed to read packed inode from disk: %s", err)
+			return err
+		}
+		if _, err = syscall.Seek(epi.Fd, int64(ei.ISize), io.SeekStart); err != nil {
+			return err
+		}
+
+		// one bit per block of the packed inode
+		uptodate := make([]uint64, (BlkRoundUp(sbi, ei.ISize)+63)/64)
+		if len(uptodate) != 0 {
+			epi.UptoDate = &uptodate[0]
+		}
+		epi.UptodateSize = uint32(len(uptodate) * 8)
+	}
 
 	return nil
 }
@@ -465,8 +414,8 @@ func erofsPos(sbi *SuperBlkInfo, nr uint64) uint64 {
 	return nr << uint64(sbi.BlkSzBits)
 }
 
-// Equivalent to `static inline erofs_off_t erofs_iloc(struct erofs_inode *inode)`
-func erofsIloc(inode *ErofsInode) uint64 {
+// ErofsIloc returns the on-disk offset of the inode
+func ErofsIloc(inode *ErofsInode) uint64 {
 	sbi := inode.Sbi
 	return erofsPos(sbi, uint64(sbi.MetaBlkAddr)) + (inode.Nid << uint64(sbi.ISlotBits))
 }
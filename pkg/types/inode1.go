@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"io"
 	"math"
-	"os"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
@@ -35,6 +35,39 @@ func ErofsInodeManagerInit() {
 	}
 }
 
+// ErofsIgrab takes an extra reference of the inode
+func ErofsIgrab(inode *ErofsInode) *ErofsInode {
+	atomic.AddInt32(&inode.ICount, 1)
+	return inode
+}
+
+// ErofsIget looks up an inode in the inode cache by its source (dev, ino)
+func ErofsIget(dev uint32, ino uint64) *ErofsInode {
+	head := &inodeHashtable[(ino^uint64(dev))%NR_INODE_HASHTABLE]
+
+	for pos := head.Next; pos != head; pos = pos.Next {
+		inode := ErofsInodeFromIHash(pos)
+		if inode.IIno[1] == ino && inode.Dev == dev {
+			return ErofsIgrab(inode)
+		}
+	}
+	return nil
+}
+
+// ErofsDAlloc allocates a new dentry and appends it to the parent
+func ErofsDAlloc(parent *ErofsInode, name string) *ErofsDentry {
+	if len(name) > EROFS_NAME_LEN {
+		name = name[:EROFS_NAME_LEN]
+	}
+	d := &ErofsDentry{
+		Namelen: uint8(len(name)),
+		Type:    EROFS_FT_UNKNOWN,
+		Name:    name,
+	}
+	ListAddTail(&d.DChild, &parent.ISubdirs)
+	return d
+}
+
 func ErofsFlushPackedInode(sbi *SuperBlkInfo) int {
 	var epi *ErofsPackedInode
 	var inode *ErofsInode
@@ -422,8 +455,7 @@ func WriteUncompressedFileFromFd(inode *ErofsInode, fd int) error {
 		buffer := make([]byte, inode.IdataSize)
 
 		// Read the tail data from the file descriptor
-		file := os.NewFile(uintptr(fd), "")
-		n, err := io.ReadFull(file, buffer)
+		n, err := syscall.Read(fd, buffer)
 		if err != nil || uint16(n) < inode.IdataSize {
 			inode.Idata = nil
 			return syscall.EIO
@@ -517,7 +549,7 @@ func ErofsAllocateInodeBhData(inode *ErofsInode, nblocks uint32) error {
 		return nil
 	}
 
-	if os.FileMode(inode.IMode).IsDir() {
+	if inode.IMode&S_IFMT == S_IFDIR {
 		typ = DIRA
 	} else {
 		typ = DATA
@@ -538,7 +570,7 @@ func ErofsAllocateInodeBhData(inode *ErofsInode, nblocks uint32) error {
 	}
 
 	inode.IBlkaddr = bh.Block.BlkAddr
-	return nil
+	return ErofsDevCheckSize(inode.Sbi, ret)
 }
 
 func ErofsFillInode(inode *ErofsInode, st *syscall.Stat_t, path string) error {
@@ -551,32 +583,21 @@ func ErofsFillInode(inode *ErofsInode, st *syscall.Stat_t, path string) error {
 	inode.INlink = 1
 
 	switch inode.IMode & syscall.S_IFMT {
-	case syscall.S_IFCHR:
-	case syscall.S_IFBLK:
-	case syscall.S_IFIFO:
-	case syscall.S_IFSOCK:
+	case syscall.S_IFCHR, syscall.S_IFBLK, syscall.S_IFIFO, syscall.S_IFSOCK:
 		inode.IRdev = erofsNewEncodeDev(st.Rdev)
+		inode.ISize = 0
 	case syscall.S_IFDIR:
 		inode.ISize = 0
-		break
-	case syscall.S_IFREG:
-	case syscall.S_IFLNK:
+	case syscall.S_IFREG, syscall.S_IFLNK:
 		inode.ISize = uint64(st.Size)
-		break
 	default:
 		return syscall.Errno(errs.EINVAL)
 	}
 
 	inode.ISrcpath = path
 
-	if ErofsShouldUseInodeExtended(inode) {
-		if GCfg.ForceInodeVersion == FORCE_INODE_COMPACT {
-			fmt.Errorf("file %s cannot be in compact form", inode.ISrcpath)
-			return syscall.Errno(errs.EINVAL)
-		}
-		inode.InodeIsize = uint8(unsafe.Sizeof(ErofsInodeExtended{}))
-	} else {
-		inode.InodeIsize = uint8(unsafe.Sizeof(ErofsInodeCompact{}))
+	if err = ErofsSetInodeIsize(inode); err != nil {
+		return err
 	}
 
 	inode.Dev = uint32(st.Dev)
@@ -586,8 +607,23 @@ func ErofsFillInode(inode *ErofsInode, st *syscall.Stat_t, path string) error {
 	return nil
 }
 
+// ErofsSetInodeIsize picks the on-disk inode version which can hold
+// the attributes of inode
+func ErofsSetInodeIsize(inode *ErofsInode) error {
+	if ErofsShouldUseInodeExtended(inode) {
+		if GCfg.ForceInodeVersion == FORCE_INODE_COMPACT {
+			Error("file %s cannot be in compact form", inode.ISrcpath)
+			return syscall.Errno(errs.EINVAL)
+		}
+		inode.InodeIsize = EROFS_INODE_EXTENDED_SIZE
+	} else {
+		inode.InodeIsize = EROFS_INODE_COMPACT_SIZE
+	}
+	return nil
+}
+
 func ErofsNewInode(sbi *SuperBlkInfo) *ErofsInode {
-	var inode *ErofsInode
+	inode := new(ErofsInode)
 
 	inode.Sbi = sbi
 	inode.ICount = 1
@@ -604,12 +640,12 @@ func ErofsLookupNid(inode *ErofsInode) uint64 {
 	bh := inode.Bh
 	sbi := inode.Sbi
 
-	if bh != nil && inode.Nid <= 0 {
+	if bh != nil && (inode.Nid == 0 || inode.Nid == EROFS_PACKED_NID_UNALLOCATED) {
 		MapBh(nil, bh.Block)
 		off = BhTell(bh, false)
 
 		metaOffset = ErofsPos(sbi, uint64(sbi.MetaBlkAddr))
-		if !(off < metaOffset) { // DBG_BUGON equivalent
+		if off < metaOffset { // DBG_BUGON equivalent
 			panic("Bug: off < metaOffset")
 		}
 
@@ -678,7 +714,7 @@ func erofsFillInode(inode *ErofsInode, st *syscall.Stat_t, path string) error {
 
 	inode.IGid = func() uint32 {
 		if GCfg.Gid == -1 {
-			return st.Uid
+			return st.Gid
 		}
 		return uint32(GCfg.Gid)
 	}()
@@ -716,6 +752,13 @@ func erofsNewEncodeDev(dev uint64) uint32 {
 	return (min & 0xff) | (maj << 8) | ((min &^ 0xff) << 12)
 }
 
+// ErofsNewDecodeDev turns the on-disk device number back into a dev_t
+func ErofsNewDecodeDev(dev uint32) uint64 {
+	maj := (dev & 0xfff00) >> 8
+	min := (dev & 0xff) | ((dev >> 12) & 0xfff00)
+	return unix.Mkdev(maj, min)
+}
+
 func ErofsShouldUseInodeExtended(inode *ErofsInode) bool {
 	if GCfg.ForceInodeVersion == FORCE_INODE_EXTENDED {
 		return true
@@ -834,6 +877,31 @@ static int erofs_droid_inode_fsconfig(struct erofs_inode *inode,
 
 #endif
 */
-func erofsDroidInodeFsconfig(inode *ErofsInode, st syscall.Stat_t, path string) error {
+func erofsDroidInodeFsconfig(inode *ErofsInode, st *syscall.Stat_t, path string) error {
+	var fspath string
+
+	inode.Capabilities = 0
+	if GCfg.FsConfigFile == "" {
+		return nil
+	}
+
+	if GCfg.MountPoint == "" || ErofsFspath(path) == "" {
+		fspath = ErofsFspath(path)
+	} else {
+		fspath = GCfg.MountPoint + "/" + ErofsFspath(path)
+	}
+
+	ent, err := cannedFsConfigLookup(fspath)
+	if err != nil {
+		return err
+	}
+	inode.Capabilities = ent.capabilities
+
+	Debug(EROFS_DBG, "/%s -> mode = 0x%x, uid = 0x%x, gid = 0x%x, capabilities = 0x%x",
+		fspath, ent.mode, ent.uid, ent.gid, inode.Capabilities)
+
+	st.Uid = ent.uid
+	st.Gid = ent.gid
+	st.Mode = ent.mode | st.Mode&syscall.S_IFMT
 	return nil
 }
@@ -0,0 +1,147 @@
+package types_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+// inodeTestRead reads the inode nid of img
+func inodeTestRead(t *testing.T, img string, nid uint64) (*types.ErofsInode, error) {
+	t.Helper()
+
+	sbi, err := mkfsTestOpen(t, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vi := &types.ErofsInode{Sbi: sbi, Nid: nid}
+	return vi, types.ErofsReadInodeFromDisk(vi)
+}
+
+func TestErofsReadInodeFromDisk(t *testing.T) {
+	mtime := time.Unix(1700000000, 123456789)
+	src := t.TempDir()
+	mkfsTestWrite(t, src, map[string]string{"file": "data", "dir/file": "data"})
+	for _, name := range []string{"file", "dir", "."} {
+		if err := os.Chmod(filepath.Join(src, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(src, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		setup func(sbi *types.SuperBlkInfo)
+		isize uint8
+		mtime time.Time
+	}{
+		{"compact", func(sbi *types.SuperBlkInfo) {
+			types.GCfg.IgnoreMtime = true
+			sbi.BuildTime, sbi.BuildTimeNsec = 1600000000, 0
+		}, types.EROFS_INODE_COMPACT_SIZE, time.Unix(1600000000, 0)},
+		{"extended", func(sbi *types.SuperBlkInfo) {
+			types.GCfg.ForceInodeVersion = types.FORCE_INODE_EXTENDED
+		}, types.EROFS_INODE_EXTENDED_SIZE, mtime},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, nids := mkfsTestImage(t, src, tt.setup)
+
+			for _, want := range []struct {
+				nid        uint64
+				mode       uint16
+				nlink      uint32
+				size       uint64
+				datalayout uint8
+			}{
+				{uint64(types.GSbi.RootNid), types.S_IFDIR | 0755, 3, 0, types.EROFS_INODE_FLAT_INLINE},
+				{nids["dir"], types.S_IFDIR | 0755, 2, 0, types.EROFS_INODE_FLAT_INLINE},
+				{nids["file"], types.S_IFREG | 0755, 1, 4, types.EROFS_INODE_FLAT_INLINE},
+			} {
+				vi, err := inodeTestRead(t, img, want.nid)
+				if err != nil {
+					t.Fatalf("nid %d: ErofsReadInodeFromDisk() = %v", want.nid, err)
+				}
+				if vi.InodeIsize != tt.isize {
+					t.Errorf("nid %d: inode size %d, want %d", want.nid, vi.InodeIsize, tt.isize)
+				}
+				if vi.IMode != want.mode || vi.INlink != want.nlink || vi.DataLayout != want.datalayout {
+					t.Errorf("nid %d: mode %#o nlink %d datalayout %d, want %#o %d %d", want.nid,
+						vi.IMode, vi.INlink, vi.DataLayout, want.mode, want.nlink, want.datalayout)
+				}
+				// directory sizes depend on the dirents
+				if want.size != 0 && vi.ISize != want.size {
+					t.Errorf("nid %d: size %d, want %d", want.nid, vi.ISize, want.size)
+				}
+				if vi.IUid != uint32(os.Getuid()) || vi.IGid != uint32(os.Getgid()) {
+					t.Errorf("nid %d: owner %d:%d, want %d:%d", want.nid, vi.IUid, vi.IGid, os.Getuid(), os.Getgid())
+				}
+				if vi.IMtime != uint64(tt.mtime.Unix()) || vi.IMtimeNsec != uint32(tt.mtime.Nanosecond()) {
+					t.Errorf("nid %d: mtime %d.%09d, want %d.%09d", want.nid, vi.IMtime, vi.IMtimeNsec,
+						tt.mtime.Unix(), tt.mtime.Nanosecond())
+				}
+			}
+		})
+	}
+}
+
+func TestErofsReadInodeFromDiskMalformed(t *testing.T) {
+	src := t.TempDir()
+	mkfsTestWrite(t, src, map[string]string{"file": "data"})
+	img, _ := mkfsTestImage(t, src, nil)
+
+	orig, err := os.ReadFile(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vi, err := inodeTestRead(t, img, uint64(types.GSbi.RootNid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iloc := types.ErofsIloc(vi)
+
+	// i_format, i_mode and i_u of the on-disk inode
+	setFormat := func(ifmt uint16) func(di []byte) {
+		return func(di []byte) { binary.LittleEndian.PutUint16(di, ifmt) }
+	}
+	tests := []struct {
+		name    string
+		corrupt func(di []byte)
+		errno   syscall.Errno
+	}{
+		{"unknown i_format bits", setFormat(1 << 15), syscall.Errno(errs.EOPNOTSUPP)},
+		{"unknown data layout", setFormat(5 << types.EROFS_I_DATALAYOUT_BIT), syscall.Errno(errs.EOPNOTSUPP)},
+		{"bogus mode", func(di []byte) { binary.LittleEndian.PutUint16(di[4:], 0755) }, syscall.Errno(errs.EFSCORRUPTED)},
+		{"unknown chunk format", func(di []byte) {
+			binary.LittleEndian.PutUint16(di, types.EROFS_INODE_CHUNK_BASED<<types.EROFS_I_DATALAYOUT_BIT)
+			binary.LittleEndian.PutUint32(di[16:], 0x80)
+		}, syscall.Errno(errs.EOPNOTSUPP)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := append([]byte(nil), orig...)
+			tt.corrupt(buf[iloc:])
+			// the root inode may share the block of the superblock
+			sbTestFixChecksum(buf[types.EROFS_SUPER_OFFSET:], vi.Sbi.BlkSzBits)
+			fn := filepath.Join(t.TempDir(), "test.img")
+			if err := os.WriteFile(fn, buf, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := inodeTestRead(t, fn, vi.Nid); !errors.Is(err, tt.errno) {
+				t.Fatalf("ErofsReadInodeFromDisk() = %v, want %v", err, tt.errno)
+			}
+		})
+	}
+}
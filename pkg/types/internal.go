@@ -178,55 +178,10 @@ func Balloc(bmgr *BufferManager, bufType int, size uint64, requiredExt, inlineEx
 		// }
 	}
 
-	// Total required extensions
-	totalRequiredExt := requiredExt + inlineExt
-
-	// Look for an existing buffer block with enough space
-	current := bmgr.BlkH.List.Next
-	for current != &bmgr.BlkH.List {
-		blockInterface := ContainerOf1(current, &BufferBlock{}, "List")
-		block, ok := blockInterface.(*BufferBlock)
-		if !ok {
-			current = current.Next
-			continue
-		}
-
-		// Skip if type doesn't match
-		if block.Type != bufType {
-			current = current.Next
-			continue
-		}
-
-		if block.Buffers.Off >= size+uint64(totalRequiredExt)*uint64(alignSize) {
-			bb = block
-			break
-		}
-		current = current.Next
-	}
-
-	// No available buffer, so allocate a new one
-	if bb == nil {
-		var err error
-		bb, err = BlkAllocBuf(bmgr, bufType)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	if size > bb.Buffers.Off {
-		return nil, fmt.Errorf("empty buffer block, there should exist at least one buffer head in a buffer block")
-	}
-
-	// Create a new buffer head
-	bh = &BufferHead{
-		Op:        nil,
-		Block:     bb,
-		Off:       size,
-		FsPrivate: nil,
+	ret = BattachInternal(bb, bh, size, alignSize, requiredExt+inlineExt, false)
+	if ret < 0 {
+		return nil, fmt.Errorf("failed to attach buffer head: %d", ret)
 	}
-
-	// Add to buffer list
-	ListAddTail(&bh.List, &bb.Buffers.List)
 	return bh, nil
 }
 
@@ -264,7 +219,7 @@ func BhBalloon(bh *BufferHead, incr uint64) int {
 	if bh.List.Next != &block.Buffers.List {
 		return -errs.EINVAL
 	}
-	return BattachInternal(block, bh, incr, 1, 0, false)
+	return BattachInternal(block, nil, incr, 1, 0, false)
 }
 
 // MapBh maps a buffer block
@@ -333,11 +288,9 @@ func BhTell(bh *BufferHead, end bool) uint64 {
 	}
 
 	if end {
-		// Get the next buffer head in the list
-		nextEntry := bh.List.Next
-		nextInterface := ContainerOf(nextEntry, &BufferHead{}, "List")
-		nextBh, _ := nextInterface.(*BufferHead)
-		offset = nextBh.Off
+		// The next entry of the tail bh is the block's own Buffers,
+		// whose Off marks the end of the block
+		offset = BufferHeadFromList(bh.List.Next).Off
 	} else {
 		offset = bh.Off
 	}
@@ -7,6 +7,7 @@ import (
 	"syscall"
 
 	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
 // ErofsBlkRead reads blocks from the device
@@ -24,6 +25,16 @@ func ErofsDevResize(sbi *SuperBlkInfo, blocks uint32) int {
 	return ErofsIoFtruncate(sbi.BDev, uint64(blocks)*uint64(ErofsBlkSiz(sbi)))
 }
 
+// ErofsDevCheckSize fails once the primary device needs more than the
+// per-device size cap for blocks
+func ErofsDevCheckSize(sbi *SuperBlkInfo, blocks uint32) error {
+	if GCfg.MaxDeviceSize != 0 && ErofsPos(sbi, uint64(blocks)) > GCfg.MaxDeviceSize {
+		Error("primary device needs %d blocks, exceeding the device size %d", blocks, GCfg.MaxDeviceSize)
+		return syscall.Errno(errs.ENOSPC)
+	}
+	return nil
+}
+
 // ErofsDevWrite writes data to an EROFS device
 func ErofsDevWrite(sbi *SuperBlkInfo, buf []byte, offset uint64, length int) int {
 	written, _ := ErofsIoPwrite(sbi.BDev, buf, offset, length)
@@ -163,11 +174,10 @@ func ErofsIoFallocate(vf *ErofsVFile, offset uint64, length uint64, zeroout bool
 		return int64(vf.Ops.Fallocate(vf, offset, length, zeroout))
 	}
 
-	// // Equivalent to the C preprocessor conditional
-	// if !zeroout && syscall.Fallocate(vf.Fd, syscall.FALLOC_FL_PUNCH_HOLE|syscall.FALLOC_FL_KEEP_SIZE,
-	// 	int64(offset+vf.Offset), int64(length)) >= 0 {
-	// 	return 0
-	// }
+	if !zeroout && unix.Fallocate(vf.Fd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE,
+		int64(offset+vf.Offset), int64(length)) == nil {
+		return 0
+	}
 
 	for length > uint64(EROFS_MAX_BLOCK_SIZE) {
 		ret, _ = ErofsIoPwrite(vf, zero[:], offset, int(EROFS_MAX_BLOCK_SIZE))
@@ -217,7 +227,6 @@ func ErofsIoPwrite(vf *ErofsVFile, buf []byte, pos uint64, length int) (int, err
 			}
 			n = 0
 		}
-		buf = buf[n:]
 		pos += uint64(n)
 		written += n
 	}
@@ -133,6 +133,16 @@ func BufferBlockFromList(list *ListHead) *BufferBlock {
 	return (*BufferBlock)(unsafe.Pointer(containerAddr))
 }
 
+// BufferBlockFromMappedList converts a MappedList entry to its BufferBlock
+func BufferBlockFromMappedList(list *ListHead) *BufferBlock {
+	if list == nil {
+		return nil
+	}
+	offset := unsafe.Offsetof(BufferBlock{}.MappedList)
+	containerAddr := uintptr(unsafe.Pointer(list)) - offset
+	return (*BufferBlock)(unsafe.Pointer(containerAddr))
+}
+
 // Helper functions for clean type conversions
 // func BufferHeadFromList(list *ListHead) *BufferHead {
 // 	if list == nil {
@@ -168,6 +178,16 @@ func ErofsDentryFromList(list *ListHead) *ErofsDentry {
 	return (*ErofsDentry)(unsafe.Pointer(containerAddr))
 }
 
+// ErofsInodeFromIHash converts an IHash entry to its ErofsInode
+func ErofsInodeFromIHash(list *ListHead) *ErofsInode {
+	if list == nil {
+		return nil
+	}
+	offset := unsafe.Offsetof(ErofsInode{}.IHash)
+	containerAddr := uintptr(unsafe.Pointer(list)) - offset
+	return (*ErofsInode)(unsafe.Pointer(containerAddr))
+}
+
 // ListPrevEntry gets the previous entry in the list
 func ListPrevEntry(pos interface{}, member string) interface{} {
 	// Reflection to get the member field (ListHead) from pos
@@ -78,6 +78,7 @@ type SuperBlkInfo struct {
 	// Blob information
 	NBlobs uint32
 	BlobFd [256]uint32
+	BhDevt *BufferHead // reserved device table
 
 	// Buffer manager
 	Bmgr        *BufferManager
@@ -113,11 +114,6 @@ func SuperBlockFromInfo(info *SuperBlkInfo) *SuperBlock {
 		PackedNid:        info.PackedNid,
 	}
 
-	// Set checksum if enabled
-	if info.FeatureCompat&EROFS_FEATURE_COMPAT_SB_CHKSUM != 0 {
-		sb.SetChecksum()
-	}
-
 	return sb
 }
 
@@ -343,7 +339,6 @@ func (sbi *SuperBlkInfo) WriteSuperblock() ([]byte, error) {
 func ErofsEnableSbChksum(sbi *SuperBlkInfo, crc *uint32) int {
 	var ret int
 	var buf [EROFS_MAX_BLOCK_SIZE]byte
-	var length uint32
 	var sb *SuperBlock
 
 	ret = ErofsBlkRead(sbi, 0, buf[:], 0, uint32(ErofsBlknr(sbi, uint(EROFS_SUPER_END))+1))
@@ -368,12 +363,7 @@ func ErofsEnableSbChksum(sbi *SuperBlkInfo, crc *uint32) int {
 	/* turn on checksum feature */
 	sb.FeatureCompat = CpuToLe32(Le32ToCpu(sb.FeatureCompat) |
 		EROFS_FEATURE_COMPAT_SB_CHKSUM)
-	if ErofsBlkSiz(sbi) > EROFS_SUPER_OFFSET {
-		length = ErofsBlkSiz(sbi) - EROFS_SUPER_OFFSET
-	} else {
-		length = ErofsBlkSiz(sbi)
-	}
-	*crc = Crc32c(^uint32(0), (*[1<<31 - 1]byte)(unsafe.Pointer(sb))[:length])
+	*crc = ErofsSbChecksum(buf[:], sbi.BlkSzBits)
 
 	/* set up checksum field to erofs_super_block */
 	sb.Checksum = CpuToLe32(*crc)
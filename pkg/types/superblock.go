@@ -3,7 +3,9 @@ package types
 import (
 	"bytes"
 	"encoding/binary"
-	"hash/crc32"
+	"syscall"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
 )
 
 // SuperBlock represents the on-disk EROFS superblock structure
@@ -171,35 +173,6 @@ func (sb *SuperBlock) HasFeatureIncompat(feature uint32) bool {
 	return (sb.FeatureIncompat & feature) != 0
 }
 
-// CalculateChecksum calculates the CRC32C checksum for the superblock
-func (sb *SuperBlock) CalculateChecksum() uint32 {
-	// Save the current checksum and set it to 0 for calculation
-	oldChecksum := sb.Checksum
-	sb.Checksum = 0
-
-	// Serialize the superblock
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, sb)
-
-	// Calculate the checksum
-	checksum := crc32.ChecksumIEEE(buf.Bytes())
-
-	// Restore the original checksum
-	sb.Checksum = oldChecksum
-
-	return checksum
-}
-
-// SetChecksum sets the checksum in the superblock
-func (sb *SuperBlock) SetChecksum() {
-	sb.Checksum = sb.CalculateChecksum()
-}
-
-// ValidateChecksum validates the checksum in the superblock
-func (sb *SuperBlock) ValidateChecksum() bool {
-	return sb.Checksum == sb.CalculateChecksum()
-}
-
 // DeviceInfo represents information about a device in a multi-device setup
 type DeviceInfo struct {
 	Tag           [64]byte
@@ -215,5 +188,185 @@ type XattrPrefixItem struct {
 
 // XattrLongPrefix represents a long extended attribute prefix <PPS:: See in C>
 type XattrLongPrefix struct {
-	// Add fields as needed for your implementation
+	BaseIndex uint8  // short xattr name prefix index
+	Infix     []byte // infix apart from short prefix
+}
+
+// ErofsSbError is returned when a superblock is rejected, it wraps the
+// errno of its failure class
+type ErofsSbError struct {
+	msg   string
+	errno syscall.Errno
+}
+
+func (e *ErofsSbError) Error() string { return e.msg }
+func (e *ErofsSbError) Unwrap() error { return e.errno }
+
+// failure classes of ErofsReadSuperblock, to be matched by errors.Is
+var (
+	ErrSbBadMagic       = &ErofsSbError{"bad superblock magic", syscall.Errno(errs.EINVAL)}
+	ErrSbBadChecksum    = &ErofsSbError{"superblock checksum mismatch", syscall.Errno(errs.EBADMSG)}
+	ErrSbBadBlockSize   = &ErofsSbError{"unsupported block size", syscall.Errno(errs.EINVAL)}
+	ErrSbBadDirBlkBits  = &ErofsSbError{"unsupported directory block size", syscall.Errno(errs.EINVAL)}
+	ErrSbUnknownFeature = &ErofsSbError{"unknown incompatible features", syscall.Errno(errs.EOPNOTSUPP)}
+)
+
+// ErofsSbChecksum returns the crc32c of the superblock in the first block
+// buf, which covers the rest of the block from the superblock on with the
+// checksum field taken as zero
+func ErofsSbChecksum(buf []byte, blkszbits uint8) uint32 {
+	var zero [4]byte
+
+	length := uint32(1) << blkszbits
+	if length > EROFS_SUPER_OFFSET {
+		length -= EROFS_SUPER_OFFSET
+	}
+	dsb := buf[EROFS_SUPER_OFFSET : EROFS_SUPER_OFFSET+length]
+	crc := Crc32c(^uint32(0), dsb[:4])
+	crc = Crc32c(crc, zero[:])
+	return Crc32c(crc, dsb[8:])
+}
+
+// ErofsReadSuperblock loads the superblock of the image opened at sbi.BDev
+// together with its device table and long xattr name prefixes
+func ErofsReadSuperblock(sbi *SuperBlkInfo) error {
+	var dsb SuperBlockOnDisk
+
+	buf := make([]byte, EROFS_MAX_BLOCK_SIZE)
+	if _, err := ErofsDevRead(sbi, 0, buf, 0, int64(len(buf))); err != nil {
+		return err
+	}
+	err := binary.Read(bytes.NewReader(buf[EROFS_SUPER_OFFSET:]), binary.LittleEndian, &dsb)
+	if err != nil {
+		return err
+	}
+	sb := FromDisk(&dsb)
+	if sb.Magic != EROFS_SUPER_MAGIC_V1 {
+		Error("cannot find valid erofs superblock in %s", sbi.DevName)
+		return ErrSbBadMagic
+	}
+	if sb.BlkSzBits < 9 || uint32(1)<<sb.BlkSzBits > EROFS_MAX_BLOCK_SIZE {
+		Error("unsupported block size %d of %s", 1<<sb.BlkSzBits, sbi.DevName)
+		return ErrSbBadBlockSize
+	}
+	if sb.FeatureCompat&EROFS_FEATURE_COMPAT_SB_CHKSUM != 0 &&
+		ErofsSbChecksum(buf, sb.BlkSzBits) != sb.Checksum {
+		Error("invalid superblock checksum 0x%08x of %s", sb.Checksum, sbi.DevName)
+		return ErrSbBadChecksum
+	}
+	// only directory blocks of the block size are supported
+	if sb.DirBlkBits != 0 {
+		Error("unsupported dirblkbits %d of %s", sb.DirBlkBits, sbi.DevName)
+		return ErrSbBadDirBlkBits
+	}
+	if unknown := sb.FeatureIncompat &^ EROFS_ALL_FEATURE_INCOMPAT; unknown != 0 {
+		Error("unidentified incompatible feature %x of %s", unknown, sbi.DevName)
+		return ErrSbUnknownFeature
+	}
+
+	sbi.BlkSzBits = sb.BlkSzBits
+	sbi.ISlotBits = EROFSISLOTBITS
+	sbi.FeatureCompat = sb.FeatureCompat
+	sbi.FeatureIncompat = sb.FeatureIncompat
+	sbi.SbSize = 128 + uint32(sb.SbExtSlots)*EROFS_SB_EXTSLOT_SIZE
+	sbi.RootNid = uint32(sb.RootNid)
+	sbi.Inos = sb.Inos
+	sbi.BuildTime = sb.BuildTime
+	sbi.BuildTimeNsec = sb.BuildTimeNsec
+	sbi.TotalBlocks = uint64(sb.Blocks)
+	sbi.PrimaryDeviceBlocks = uint64(sb.Blocks)
+	sbi.MetaBlkAddr = sb.MetaBlkAddr
+	sbi.XattrBlkAddr = sb.XattrBlkAddr
+	sbi.UUID = sb.UUID
+	sbi.VolumeName = sb.VolumeName
+	sbi.Checksum = sb.Checksum
+	sbi.AvailableComprAlgs = sb.CompressInfo
+	sbi.PackedNid = sb.PackedNid
+	sbi.XattrPrefixStart = sb.XattrPrefixStart
+	sbi.XattrPrefixCount = sb.XattrPrefixCount
+
+	if err = erofsReadDeviceTable(sbi, sb); err != nil {
+		return err
+	}
+	return erofsReadXattrPrefixes(sbi)
+}
+
+// erofsReadDeviceTable loads the slots of the extra devices of sbi
+func erofsReadDeviceTable(sbi *SuperBlkInfo, sb *SuperBlock) error {
+	sbi.Devs = nil
+	sbi.ExtraDevices = 0
+	if sb.FeatureIncompat&EROFS_FEATURE_INCOMPAT_DEVICE_TABLE == 0 {
+		return nil
+	}
+
+	sbi.ExtraDevices = sb.ExtraDevices
+	sbi.DevtSlotOff = sb.DevtSlotOff
+	sbi.Devs = make([]DeviceInfo, sb.ExtraDevices)
+	pos := uint64(sb.DevtSlotOff) * EROFS_DEVT_SLOT_SIZE
+	for i := range sbi.Devs {
+		dis := make([]byte, EROFS_DEVT_SLOT_SIZE)
+
+		if _, err := ErofsDevRead(sbi, 0, dis, pos, int64(len(dis))); err != nil {
+			return err
+		}
+		copy(sbi.Devs[i].Tag[:], dis)
+		sbi.Devs[i].Blocks = binary.LittleEndian.Uint32(dis[64:])
+		sbi.Devs[i].MappedBlkAddr = binary.LittleEndian.Uint32(dis[68:])
+		sbi.TotalBlocks += uint64(sbi.Devs[i].Blocks)
+		pos += EROFS_DEVT_SLOT_SIZE
+	}
+	return nil
+}
+
+// erofsReadXattrPrefixes loads the long xattr name prefixes, which are
+// kept in the packed inode if there is one
+func erofsReadXattrPrefixes(sbi *SuperBlkInfo) error {
+	var packed *ErofsInode
+
+	sbi.XattrPrefixes = nil
+	if sbi.XattrPrefixCount == 0 {
+		return nil
+	}
+	if sbi.PackedNid != 0 {
+		packed = &ErofsInode{Sbi: sbi, Nid: sbi.PackedNid}
+		if err := ErofsReadInodeFromDisk(packed); err != nil {
+			return err
+		}
+	}
+
+	pos := uint64(sbi.XattrPrefixStart) << 2
+	read := func(buf []byte) error {
+		var err error
+
+		if packed != nil {
+			err = ErofsPread(packed, buf, pos)
+		} else {
+			_, err = ErofsDevRead(sbi, 0, buf, pos, int64(len(buf)))
+		}
+		pos += uint64(len(buf))
+		return err
+	}
+
+	for i := 0; i < int(sbi.XattrPrefixCount); i++ {
+		var hdr [2]byte
+
+		if err := read(hdr[:]); err != nil {
+			return err
+		}
+		size := binary.LittleEndian.Uint16(hdr[:])
+		if size == 0 {
+			return syscall.Errno(errs.EFSCORRUPTED)
+		}
+		buf := make([]byte, size)
+		if err := read(buf); err != nil {
+			return err
+		}
+		sbi.XattrPrefixes = append(sbi.XattrPrefixes, XattrPrefixItem{
+			Prefix:   &XattrLongPrefix{BaseIndex: buf[0], Infix: buf[1:]},
+			InfixLen: uint8(size - 1),
+		})
+		// entries are aligned to 4 bytes
+		pos = RoundUp(pos, 4)
+	}
+	return nil
 }
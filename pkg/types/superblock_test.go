@@ -0,0 +1,220 @@
+package types_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/util"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/writer"
+)
+
+// mkfsTestImage builds an image of the src directory as mkfs does and
+// returns its path with the nids of the root entries by name. setup
+// adjusts the configuration beforehand.
+func mkfsTestImage(t *testing.T, src string, setup func(sbi *types.SuperBlkInfo)) (string, map[string]uint64) {
+	t.Helper()
+
+	img := filepath.Join(t.TempDir(), "test.img")
+	sbi := &types.GSbi
+	*types.GCfg = *types.InitConfigure()
+	*sbi = types.SuperBlkInfo{BDev: &types.ErofsVFile{}}
+	types.MkfsDefaultOptions(sbi)
+	types.GCfg.DebugLevel = types.EROFS_ERR
+	sbi.BlkSzBits = 12
+	sbi.SetTimestamp()
+	if setup != nil {
+		setup(sbi)
+	}
+	types.GCfg.SourcePath = src
+	types.ErofsSetFsRoot(src)
+
+	if err := util.DevOpen(sbi, img, os.O_RDWR|os.O_TRUNC); err != nil {
+		t.Fatal(err)
+	}
+	sbi.Bmgr = types.ErofsBufferInit(sbi, 0)
+	sbBh, err := types.ReserveSuperblock(sbi.Bmgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types.UUIDGenerate(sbi.UUID[:])
+
+	if err = writer.ErofsMkfsInitDevices(sbi, types.GCfg.DevicePaths); err != nil {
+		t.Fatal(err)
+	}
+	if sbi.ExtraDevices != 0 || types.GCfg.ChunkBits != 0 {
+		if types.GCfg.ChunkBits == 0 {
+			types.GCfg.ChunkBits = sbi.BlkSzBits
+		}
+		if err = writer.ErofsBlobInit(sbi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer writer.ErofsBlobExit()
+
+	if err = writer.ErofsBuildSharedXattrsFromPath(sbi, src); err != nil {
+		t.Fatal(err)
+	}
+	if types.GCfg.XattrNameFilter && types.GCfg.InlineXattrTolerance >= 0 {
+		types.ErofsSbSetXattrFilter(sbi)
+	}
+
+	types.ErofsInodeManagerInit()
+	root, err := writer.ErofsMkfsBuildTreeFromPath(sbi, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sbi.RootNid = uint32(types.ErofsLookupNid(root))
+	if err = writer.ErofsMkfsDumpBlobs(sbi); err != nil {
+		t.Fatal(err)
+	}
+	if ret := types.ErofsBflush(sbi.Bmgr, nil); ret != 0 {
+		t.Fatalf("ErofsBflush() = %d", ret)
+	}
+	nids := make(map[string]uint64)
+	for pos := root.ISubdirs.Next; pos != &root.ISubdirs; pos = pos.Next {
+		d := types.ErofsDentryFromList(pos)
+		nids[d.Name] = d.Entry.(uint64)
+	}
+	types.ErofsIput(root)
+
+	var nblocks, crc uint32
+	if ret := types.WriteSuperBlock(sbi, sbBh, &nblocks); ret != 0 {
+		t.Fatalf("WriteSuperBlock() = %d", ret)
+	}
+	if ret := types.ErofsBflush(sbi.Bmgr, nil); ret != 0 {
+		t.Fatalf("ErofsBflush() = %d", ret)
+	}
+	if ret := types.ErofsDevResize(sbi, nblocks); ret != 0 {
+		t.Fatalf("ErofsDevResize() = %d", ret)
+	}
+	if types.ErofsSbHasSbChksum(sbi) {
+		if ret := types.ErofsEnableSbChksum(sbi, &crc); ret != 0 {
+			t.Fatalf("ErofsEnableSbChksum() = %d", ret)
+		}
+	}
+	return img, nids
+}
+
+// mkfsTestOpen opens img read-only and loads its superblock
+func mkfsTestOpen(t *testing.T, img string) (*types.SuperBlkInfo, error) {
+	t.Helper()
+
+	sbi := &types.SuperBlkInfo{BDev: &types.ErofsVFile{}}
+	if err := util.DevOpen(sbi, img, os.O_RDONLY); err != nil {
+		t.Fatal(err)
+	}
+	return sbi, types.ErofsReadSuperblock(sbi)
+}
+
+// mkfsTestWrite creates the regular files of a source tree
+func mkfsTestWrite(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, data := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// sbTestFixChecksum recomputes the crc32c of the superblock sb, which is
+// at EROFS_SUPER_OFFSET of a block of 1 << blkszbits bytes
+func sbTestFixChecksum(sb []byte, blkszbits uint8) {
+	dsb := append([]byte(nil), sb[:(1<<blkszbits)-types.EROFS_SUPER_OFFSET]...)
+	binary.LittleEndian.PutUint32(dsb[4:], 0)
+	binary.LittleEndian.PutUint32(sb[4:], types.Crc32c(^uint32(0), dsb))
+}
+
+func TestErofsReadSuperblock(t *testing.T) {
+	src := t.TempDir()
+	mkfsTestWrite(t, src, map[string]string{"file": "data", "dir/file": "more data"})
+	img, _ := mkfsTestImage(t, src, nil)
+	built := types.GSbi
+
+	orig, err := os.ReadFile(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// offsets in the on-disk superblock
+	const (
+		sbMagic           = 0
+		sbChecksum        = 4
+		sbFeatureCompat   = 8
+		sbBlkSzBits       = 12
+		sbVolumeName      = 64
+		sbFeatureIncompat = 80
+		sbDirBlkBits      = 90
+	)
+
+	tests := []struct {
+		name    string
+		corrupt func(sb []byte)
+		fixCsum bool
+		want    error
+		errno   syscall.Errno
+	}{
+		{name: "valid"},
+		{name: "bad magic", corrupt: func(sb []byte) { sb[sbMagic] ^= 1 },
+			want: types.ErrSbBadMagic, errno: syscall.Errno(errs.EINVAL)},
+		{name: "bad checksum", corrupt: func(sb []byte) { sb[sbVolumeName] ^= 1 },
+			want: types.ErrSbBadChecksum, errno: syscall.Errno(errs.EBADMSG)},
+		{name: "bad checksum field", corrupt: func(sb []byte) { sb[sbChecksum] ^= 1 },
+			want: types.ErrSbBadChecksum, errno: syscall.Errno(errs.EBADMSG)},
+		{name: "checksum disabled", corrupt: func(sb []byte) {
+			sb[sbFeatureCompat] &^= byte(types.EROFS_FEATURE_COMPAT_SB_CHKSUM)
+			sb[sbVolumeName] ^= 1
+		}},
+		{name: "block size too small", corrupt: func(sb []byte) { sb[sbBlkSzBits] = 8 }, fixCsum: true,
+			want: types.ErrSbBadBlockSize, errno: syscall.Errno(errs.EINVAL)},
+		{name: "block size too large", corrupt: func(sb []byte) { sb[sbBlkSzBits] = 17 },
+			want: types.ErrSbBadBlockSize, errno: syscall.Errno(errs.EINVAL)},
+		{name: "bad dirblkbits", corrupt: func(sb []byte) { sb[sbDirBlkBits] = 1 }, fixCsum: true,
+			want: types.ErrSbBadDirBlkBits, errno: syscall.Errno(errs.EINVAL)},
+		{name: "unknown incompat feature", corrupt: func(sb []byte) { sb[sbFeatureIncompat+3] |= 0x80 }, fixCsum: true,
+			want: types.ErrSbUnknownFeature, errno: syscall.Errno(errs.EOPNOTSUPP)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := append([]byte(nil), orig...)
+			sb := buf[types.EROFS_SUPER_OFFSET:]
+			if tt.corrupt != nil {
+				tt.corrupt(sb)
+			}
+			if tt.fixCsum {
+				sbTestFixChecksum(sb, built.BlkSzBits)
+			}
+			fn := filepath.Join(t.TempDir(), "test.img")
+			if err := os.WriteFile(fn, buf, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			sbi, err := mkfsTestOpen(t, fn)
+			if tt.want != nil {
+				if !errors.Is(err, tt.want) || !errors.Is(err, tt.errno) {
+					t.Fatalf("ErofsReadSuperblock() = %v, want %v (%v)", err, tt.want, tt.errno)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ErofsReadSuperblock() = %v", err)
+			}
+			if sbi.BlkSzBits != built.BlkSzBits || sbi.RootNid != built.RootNid ||
+				sbi.Inos != built.Inos || sbi.BuildTime != built.BuildTime ||
+				sbi.UUID != built.UUID || sbi.ExtraDevices != 0 {
+				t.Fatalf("ErofsReadSuperblock() loaded %+v, want the one built", sbi)
+			}
+		})
+	}
+}
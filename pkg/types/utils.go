@@ -56,6 +56,11 @@ func ErofsBlknr(sbi *SuperBlkInfo, addr uint) uint {
 	return addr >> sbi.BlkSzBits
 }
 
+// ErofsBlkoff returns the offset of addr inside of its block
+func ErofsBlkoff(sbi *SuperBlkInfo, addr uint64) uint64 {
+	return addr & uint64(ErofsBlkSiz(sbi)-1)
+}
+
 // Le32ToCpu converts a little-endian uint32 to the CPU's native endianness
 // This is the Go equivalent of the C macro le32_to_cpu
 func Le32ToCpu(value uint32) uint32 {
@@ -121,8 +121,12 @@ func BlkWrite(sbi *types.SuperBlkInfo, buf []byte, blkAddr uint32, nblocks uint3
 	return DevWrite(sbi, buf, offset, length)
 }
 
+// openedDevs holds the files whose descriptors are handed out by DevOpen
+var openedDevs []*os.File
+
 // DevOpen opens a device and sets up the SuperBlkInfo structure accordingly
 // This function is equivalent to erofs_dev_open in the C implementation
+
 func DevOpen(sbi *types.SuperBlkInfo, dev string, flags int) error {
 	var (
 		mode     os.FileMode
@@ -236,8 +240,8 @@ out:
 	// Store device name
 	sbi.DevName = dev
 
-	// In Go, we'll use the file object instead of just the fd
-	// We'll need to add a field to SuperBlkInfo to store this
+	// Keep the *os.File reachable, otherwise its finalizer closes fd
+	openedDevs = append(openedDevs, file)
 	sbi.BDev.Fd = fd
 
 	types.Info("successfully opened %s", dev)
@@ -0,0 +1,64 @@
+package util
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	xxhPrime32_1 = 2654435761
+	xxhPrime32_2 = 2246822519
+	xxhPrime32_3 = 3266489917
+	xxhPrime32_4 = 668265263
+	xxhPrime32_5 = 374761393
+)
+
+func xxh32Round(seed, input uint32) uint32 {
+	seed += input * xxhPrime32_2
+	seed = bits.RotateLeft32(seed, 13)
+	return seed * xxhPrime32_1
+}
+
+// Xxh32 calculates the 32-bit xxHash of input with the given seed
+func Xxh32(input []byte, seed uint32) uint32 {
+	p := 0
+	length := len(input)
+	var h32 uint32
+
+	if length >= 16 {
+		v1 := seed + xxhPrime32_1 + xxhPrime32_2
+		v2 := seed + xxhPrime32_2
+		v3 := seed
+		v4 := seed - xxhPrime32_1
+
+		for ; p+16 <= length; p += 16 {
+			v1 = xxh32Round(v1, binary.LittleEndian.Uint32(input[p:]))
+			v2 = xxh32Round(v2, binary.LittleEndian.Uint32(input[p+4:]))
+			v3 = xxh32Round(v3, binary.LittleEndian.Uint32(input[p+8:]))
+			v4 = xxh32Round(v4, binary.LittleEndian.Uint32(input[p+12:]))
+		}
+		h32 = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) +
+			bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h32 = seed + xxhPrime32_5
+	}
+
+	h32 += uint32(length)
+
+	for ; p+4 <= length; p += 4 {
+		h32 += binary.LittleEndian.Uint32(input[p:]) * xxhPrime32_3
+		h32 = bits.RotateLeft32(h32, 17) * xxhPrime32_4
+	}
+
+	for ; p < length; p++ {
+		h32 += uint32(input[p]) * xxhPrime32_5
+		h32 = bits.RotateLeft32(h32, 11) * xxhPrime32_1
+	}
+
+	h32 ^= h32 >> 15
+	h32 *= xxhPrime32_2
+	h32 ^= h32 >> 13
+	h32 *= xxhPrime32_3
+	h32 ^= h32 >> 16
+	return h32
+}
@@ -0,0 +1,50 @@
+package util
+
+import "testing"
+
+// xxhTestBuffer returns the sanity buffer of the reference xxhsum, whose
+// bytes are the top bytes of successive multiples of PRIME64
+func xxhTestBuffer(n int) []byte {
+	const prime64 = 11400714785074694797
+	gen := uint64(xxhPrime32_1)
+
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = byte(gen >> 56)
+		gen *= prime64
+	}
+	return buf
+}
+
+func TestXxh32(t *testing.T) {
+	sanity := xxhTestBuffer(222)
+
+	tests := []struct {
+		name  string
+		input []byte
+		seed  uint32
+		want  uint32
+	}{
+		{"empty", nil, 0, 0x02CC5D05},
+		{"empty seed 1", nil, 1, 0x0B2CB792},
+		{"empty seed prime", nil, xxhPrime32_1, 0x36B78AE7},
+		{"a", []byte("a"), 0, 0x550D7456},
+		{"abc", []byte("abc"), 0, 0x32D153FF},
+		{"16 bytes", []byte("0123456789abcdef"), 0, 0xC2C45B69},
+		{"16 bytes seed 42", []byte("0123456789abcdef"), 42, 0x599C0EB6},
+		{"sentence", []byte("Nobody inspects the spammish repetition"), 0, 0xE2293B2F},
+		{"sentence seed prime", []byte("Nobody inspects the spammish repetition"), xxhPrime32_1, 0xC9E89E68},
+		{"sanity 1", sanity[:1], 0, 0xCF65B03E},
+		{"sanity 1 seed prime", sanity[:1], xxhPrime32_1, 0xB4545AA4},
+		{"sanity 14", sanity[:14], 0, 0x1208E7E2},
+		{"sanity 14 seed prime", sanity[:14], xxhPrime32_1, 0x6AF1D1FE},
+		{"sanity 222", sanity, 0, 0x5BD11DBD},
+		{"sanity 222 seed prime", sanity, xxhPrime32_1, 0x58803C5F},
+	}
+
+	for _, tt := range tests {
+		if got := Xxh32(tt.input, tt.seed); got != tt.want {
+			t.Errorf("%s: Xxh32() = %#08x, want %#08x", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package writer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+// POSIX ACLs are stored in the same binary format as the VFS
+// system.posix_acl_* xattrs, see include/uapi/linux/posix_acl_xattr.h
+const (
+	posixAclXattrVersion    = 0x0002
+	posixAclXattrHeaderSize = 4
+	posixAclXattrEntrySize  = 8
+
+	aclUndefinedID = ^uint32(0)
+
+	// e_tag
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+
+	// e_perm
+	aclRead    = 0x04
+	aclWrite   = 0x02
+	aclExecute = 0x01
+)
+
+type posixAclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+func erofsAclDecode(value []byte) ([]posixAclEntry, error) {
+	if len(value) < posixAclXattrHeaderSize ||
+		binary.LittleEndian.Uint32(value) != posixAclXattrVersion {
+		return nil, syscall.Errno(errs.EOPNOTSUPP)
+	}
+	value = value[posixAclXattrHeaderSize:]
+	if len(value)%posixAclXattrEntrySize != 0 {
+		return nil, syscall.Errno(errs.EINVAL)
+	}
+
+	entries := make([]posixAclEntry, 0, len(value)/posixAclXattrEntrySize)
+	for ; len(value) != 0; value = value[posixAclXattrEntrySize:] {
+		entries = append(entries, posixAclEntry{
+			tag:  binary.LittleEndian.Uint16(value[0:]),
+			perm: binary.LittleEndian.Uint16(value[2:]),
+			id:   binary.LittleEndian.Uint32(value[4:]),
+		})
+	}
+	return entries, nil
+}
+
+func erofsAclEncode(entries []posixAclEntry) []byte {
+	buf := make([]byte, posixAclXattrHeaderSize+len(entries)*posixAclXattrEntrySize)
+
+	binary.LittleEndian.PutUint32(buf, posixAclXattrVersion)
+	p := buf[posixAclXattrHeaderSize:]
+	for _, pa := range entries {
+		id := pa.id
+		if pa.tag != aclUser && pa.tag != aclGroup {
+			id = aclUndefinedID
+		}
+		binary.LittleEndian.PutUint16(p[0:], pa.tag)
+		binary.LittleEndian.PutUint16(p[2:], pa.perm)
+		binary.LittleEndian.PutUint32(p[4:], id)
+		p = p[posixAclXattrEntrySize:]
+	}
+	return buf
+}
+
+// erofsAclValid checks the entries as posix_acl_valid() does: they must
+// be in order with named entries sorted by id, and a mask is needed if
+// there is any named entry
+func erofsAclValid(entries []posixAclEntry) error {
+	const stateDone = 0
+	state := aclUserObj
+	needsMask := false
+	var prevID uint32
+
+	if len(entries) == 0 {
+		return syscall.Errno(errs.EINVAL)
+	}
+
+	for i, pa := range entries {
+		if pa.perm&^(aclRead|aclWrite|aclExecute) != 0 {
+			return syscall.Errno(errs.EINVAL)
+		}
+		switch pa.tag {
+		case aclUserObj:
+			if state != aclUserObj {
+				return syscall.Errno(errs.EINVAL)
+			}
+			state = aclUser
+		case aclUser:
+			if state != aclUser || (i > 0 && entries[i-1].tag == aclUser && prevID >= pa.id) {
+				return syscall.Errno(errs.EINVAL)
+			}
+			prevID = pa.id
+			needsMask = true
+		case aclGroupObj:
+			if state != aclUser {
+				return syscall.Errno(errs.EINVAL)
+			}
+			state = aclGroup
+		case aclGroup:
+			if state != aclGroup || (entries[i-1].tag == aclGroup && prevID >= pa.id) {
+				return syscall.Errno(errs.EINVAL)
+			}
+			prevID = pa.id
+			needsMask = true
+		case aclMask:
+			if state != aclGroup {
+				return syscall.Errno(errs.EINVAL)
+			}
+			state = aclOther
+		case aclOther:
+			if state != aclOther && (state != aclGroup || needsMask) {
+				return syscall.Errno(errs.EINVAL)
+			}
+			state = stateDone
+		default:
+			return syscall.Errno(errs.EINVAL)
+		}
+	}
+	if state != stateDone {
+		return syscall.Errno(errs.EINVAL)
+	}
+	return nil
+}
+
+func aclParseID(tag uint16, qualifier string) (uint32, error) {
+	if id, err := strconv.ParseUint(qualifier, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+
+	var id string
+	if tag == aclUser {
+		u, err := user.Lookup(qualifier)
+		if err != nil {
+			return 0, err
+		}
+		id = u.Uid
+	} else {
+		g, err := user.LookupGroup(qualifier)
+		if err != nil {
+			return 0, err
+		}
+		id = g.Gid
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+	return uint32(n), err
+}
+
+// erofsAclFromText parses the long or short text form of an ACL, e.g.
+// "user::rwx,user:1000:r-x,group::r-x,mask::r-x,other::r--" as used by
+// getfacl and the SCHILY.acl.* PAX records. An optional fourth field
+// carries the numeric id of a named entry.
+func erofsAclFromText(text string) ([]posixAclEntry, error) {
+	var entries []posixAclEntry
+	hasMask := false
+
+	for _, ent := range strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}) {
+		if i := strings.IndexByte(ent, '#'); i >= 0 {
+			ent = ent[:i]
+		}
+		ent = strings.TrimSpace(ent)
+		if ent == "" {
+			continue
+		}
+
+		fields := strings.Split(ent, ":")
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("invalid ACL entry %q", ent)
+		}
+
+		var pa posixAclEntry
+		switch fields[0] {
+		case "user", "u":
+			pa.tag = aclUser
+		case "group", "g":
+			pa.tag = aclGroup
+		case "mask", "m":
+			pa.tag = aclMask
+			hasMask = true
+		case "other", "o":
+			pa.tag = aclOther
+		default:
+			return nil, fmt.Errorf("invalid ACL entry tag %q", ent)
+		}
+
+		if fields[1] == "" {
+			switch pa.tag {
+			case aclUser:
+				pa.tag = aclUserObj
+			case aclGroup:
+				pa.tag = aclGroupObj
+			}
+			pa.id = aclUndefinedID
+		} else if pa.tag == aclUser || pa.tag == aclGroup {
+			qualifier := fields[1]
+			if len(fields) == 4 {
+				qualifier = fields[3]
+			}
+			id, err := aclParseID(pa.tag, qualifier)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ACL entry qualifier %q: %w", ent, err)
+			}
+			pa.id = id
+		} else {
+			return nil, fmt.Errorf("invalid ACL entry qualifier %q", ent)
+		}
+
+		for _, c := range fields[2] {
+			switch c {
+			case 'r':
+				pa.perm |= aclRead
+			case 'w':
+				pa.perm |= aclWrite
+			case 'x':
+				pa.perm |= aclExecute
+			case '-':
+			default:
+				return nil, fmt.Errorf("invalid ACL entry permission %q", ent)
+			}
+		}
+		entries = append(entries, pa)
+	}
+
+	// calculate the mask as acl_calc_mask() if named entries exist
+	if !hasMask {
+		var perm uint16
+		named := false
+
+		for _, pa := range entries {
+			switch pa.tag {
+			case aclUser, aclGroup:
+				named = true
+				fallthrough
+			case aclGroupObj:
+				perm |= pa.perm
+			}
+		}
+		if named {
+			entries = append(entries, posixAclEntry{tag: aclMask, perm: perm, id: aclUndefinedID})
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].tag != entries[j].tag {
+			return entries[i].tag < entries[j].tag
+		}
+		return entries[i].id < entries[j].id
+	})
+	if err := erofsAclValid(entries); err != nil {
+		return nil, fmt.Errorf("invalid ACL %q: %w", text, err)
+	}
+	return entries, nil
+}
+
+// erofsAclEquivMode returns the permission bits equivalent to entries as
+// posix_acl_equiv_mode() does, ok is false if there are named entries
+func erofsAclEquivMode(entries []posixAclEntry) (mode uint16, ok bool) {
+	for _, pa := range entries {
+		switch pa.tag {
+		case aclUserObj:
+			mode |= pa.perm << 6
+		case aclGroupObj:
+			mode |= pa.perm << 3
+		case aclMask:
+			mode = mode&^0070 | pa.perm<<3
+		case aclOther:
+			mode |= pa.perm
+		default:
+			return 0, false
+		}
+	}
+	return mode, true
+}
+
+func erofsIsAclIndex(index uint8) bool {
+	return index == types.EROFSXattrIndexPosixACLAccess ||
+		index == types.EROFSXattrIndexPosixACLDefault
+}
+
+// erofsAclValidateXattr checks a system.posix_acl_* value of path
+func erofsAclValidateXattr(path string, value []byte) error {
+	entries, err := erofsAclDecode(value)
+	if err == nil {
+		err = erofsAclValid(entries)
+	}
+	if err != nil {
+		types.Error("invalid POSIX ACL of %s: %s", path, err)
+	}
+	return err
+}
+
+// erofsInodeSetAclFromText adds an access (or default) ACL in text form
+// to inode, replacing its existing one
+func erofsInodeSetAclFromText(inode *types.ErofsInode, index uint8, text string) error {
+	if index == types.EROFSXattrIndexPosixACLDefault && !inode.IsDir() {
+		// default ACLs only make sense for directories
+		return syscall.Errno(errs.EACCES)
+	}
+
+	entries, err := erofsAclFromText(text)
+	if err != nil {
+		return err
+	}
+	erofsInodeXattrDel(&inode.IXattrs, xattrTypes[index])
+
+	// access ACLs which only mirror the mode aren't stored
+	if index == types.EROFSXattrIndexPosixACLAccess {
+		if mode, ok := erofsAclEquivMode(entries); ok {
+			inode.IMode = inode.IMode&^0777 | mode
+			return nil
+		}
+	}
+
+	value := erofsAclEncode(entries)
+	inodeXattrAdd(&inode.IXattrs, getXattritem(index, value, [2]uint32{0, uint32(len(value))}))
+	return nil
+}
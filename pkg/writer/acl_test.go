@@ -0,0 +1,102 @@
+package writer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestErofsAclFromText(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		want  []posixAclEntry
+		fails bool
+	}{
+		{
+			name: "minimal",
+			text: "user::rwx,group::r-x,other::r--",
+			want: []posixAclEntry{
+				{aclUserObj, aclRead | aclWrite | aclExecute, aclUndefinedID},
+				{aclGroupObj, aclRead | aclExecute, aclUndefinedID},
+				{aclOther, aclRead, aclUndefinedID},
+			},
+		},
+		{
+			name: "short form with mask",
+			text: "u::rw-,u:1000:r--,g::r--,m::r--,o::---",
+			want: []posixAclEntry{
+				{aclUserObj, aclRead | aclWrite, aclUndefinedID},
+				{aclUser, aclRead, 1000},
+				{aclGroupObj, aclRead, aclUndefinedID},
+				{aclMask, aclRead, aclUndefinedID},
+				{aclOther, 0, aclUndefinedID},
+			},
+		},
+		{
+			// as written by getfacl, named entries are sorted by id
+			name: "long form with comments",
+			text: "# file: x\nuser::rwx\nuser:2000:rwx\nuser:1000:r-x\t# effective\n" +
+				"group::r--\ngroup:100:-w-\nmask::rwx\nother::---\n",
+			want: []posixAclEntry{
+				{aclUserObj, aclRead | aclWrite | aclExecute, aclUndefinedID},
+				{aclUser, aclRead | aclExecute, 1000},
+				{aclUser, aclRead | aclWrite | aclExecute, 2000},
+				{aclGroupObj, aclRead, aclUndefinedID},
+				{aclGroup, aclWrite, 100},
+				{aclMask, aclRead | aclWrite | aclExecute, aclUndefinedID},
+				{aclOther, 0, aclUndefinedID},
+			},
+		},
+		{
+			name: "mask calculated",
+			text: "user::rw-,user:1000:r--,group::--x,other::---",
+			want: []posixAclEntry{
+				{aclUserObj, aclRead | aclWrite, aclUndefinedID},
+				{aclUser, aclRead, 1000},
+				{aclGroupObj, aclExecute, aclUndefinedID},
+				{aclMask, aclRead | aclExecute, aclUndefinedID},
+				{aclOther, 0, aclUndefinedID},
+			},
+		},
+		{
+			// the numeric id of SCHILY.acl.* records wins over the name
+			name: "numeric id field",
+			text: "user::rwx,user:nosuchuser:r--:4242,group::r--,mask::r--,other::r--",
+			want: []posixAclEntry{
+				{aclUserObj, aclRead | aclWrite | aclExecute, aclUndefinedID},
+				{aclUser, aclRead, 4242},
+				{aclGroupObj, aclRead, aclUndefinedID},
+				{aclMask, aclRead, aclUndefinedID},
+				{aclOther, aclRead, aclUndefinedID},
+			},
+		},
+		{name: "empty", text: "", fails: true},
+		{name: "missing other", text: "user::rwx,group::r-x", fails: true},
+		{name: "duplicate entry", text: "user::rwx,user::r--,group::r-x,other::r--", fails: true},
+		{name: "duplicate named entry", text: "u::rwx,u:1:r--,u:1:r--,g::r--,o::r--", fails: true},
+		{name: "unknown tag", text: "user::rwx,group::r-x,other::r--,everyone::r--", fails: true},
+		{name: "invalid permission", text: "user::rwz,group::r-x,other::r--", fails: true},
+		{name: "too few fields", text: "user:rwx,group::r-x,other::r--", fails: true},
+		{name: "too many fields", text: "user:1:r--:1:1,user::rwx,group::r-x,other::r--", fails: true},
+		{name: "qualified other", text: "user::rwx,group::r-x,other:1:r--", fails: true},
+		{name: "unknown user", text: "user::rwx,user:nosuchuser:r--,group::r-x,other::r--", fails: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := erofsAclFromText(tt.text)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("erofsAclFromText(%q) = %v, want an error", tt.text, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("erofsAclFromText(%q) = %v", tt.text, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("erofsAclFromText(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,473 @@
+package writer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+// ErofsBlobChunk is a deduplicated chunk of file data
+type ErofsBlobChunk struct {
+	ChunkSize uint64
+	Sha256    [sha256.Size]byte
+	DeviceID  uint16 // 0: blob appended to the primary device
+	BlkAddr   uint32 // relative to the blob or to its own device
+}
+
+var (
+	blobHashmap  = make(map[[sha256.Size]byte]*ErofsBlobChunk)
+	blobFile     *os.File   // chunk data pending for the primary device
+	blobDevFiles []*os.File // extra devices, indexed by DeviceID - 1
+	blobCurDev   int        // extra device which is being filled
+	datablobSize uint64
+	remappedBase uint32
+
+	// holes in sparse files are mapped to this chunk
+	erofsHolechunk = ErofsBlobChunk{BlkAddr: types.NULL_ADDR}
+)
+
+// ErofsBlobInit prepares chunk-based output. Chunk data is spooled into a
+// temporary blob unless extra devices are set up to be filled.
+func ErofsBlobInit(sbi *types.SuperBlkInfo) error {
+	types.ErofsSbSetChunkedFile(sbi)
+
+	if len(blobDevFiles) != 0 || blobFile != nil {
+		return nil
+	}
+
+	f, err := os.CreateTemp(os.Getenv("TMPDIR"), "erofs-blob.*")
+	if err != nil {
+		return err
+	}
+	os.Remove(f.Name())
+	blobFile = f
+	return nil
+}
+
+// ErofsBlobExit releases the blob and the extra device files
+func ErofsBlobExit() {
+	if blobFile != nil {
+		blobFile.Close()
+		blobFile = nil
+	}
+	for _, f := range blobDevFiles {
+		f.Close()
+	}
+	blobDevFiles = nil
+	blobCurDev = 0
+	datablobSize = 0
+	remappedBase = 0
+	clear(blobHashmap)
+}
+
+// ErofsMkfsInitDevices opens the extra devices and reserves the on-disk
+// device table right after the superblock
+func ErofsMkfsInitDevices(sbi *types.SuperBlkInfo, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	if len(paths) > len(sbi.BlobFd) {
+		return fmt.Errorf("too many devices (%d), at most %d", len(paths), len(sbi.BlobFd))
+	}
+
+	sbi.Devs = make([]types.DeviceInfo, len(paths))
+	for i, path := range paths {
+		// devices are tagged by their file names, kept NUL-terminated
+		tag := sbi.Devs[i].Tag[:]
+		copy(tag[:len(tag)-1], filepath.Base(path))
+
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			if err = f.Truncate(0); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		sbi.BlobFd[len(blobDevFiles)] = uint32(f.Fd())
+		blobDevFiles = append(blobDevFiles, f)
+	}
+	sbi.NBlobs = uint32(len(paths))
+	return erofsReserveDeviceTable(sbi)
+}
+
+// erofsReserveDeviceTable reserves the on-disk slots of sbi.Devs
+func erofsReserveDeviceTable(sbi *types.SuperBlkInfo) error {
+	bh, err := types.Balloc(sbi.Bmgr, types.DEVT, uint64(types.EROFS_DEVT_SLOT_SIZE*len(sbi.Devs)), 0, 0)
+	if err != nil {
+		return err
+	}
+	types.MapBh(nil, bh.Block)
+	bh.Op = types.SkipWriteOps
+	sbi.BhDevt = bh
+	sbi.DevtSlotOff = uint16(types.BhTell(bh, false) / types.EROFS_DEVT_SLOT_SIZE)
+	sbi.ExtraDevices = uint16(len(sbi.Devs))
+	types.ErofsSbSetDeviceTable(sbi)
+	return nil
+}
+
+// erofsBlobDevAlloc finds room for nblocks on the extra devices, moving on
+// to the next device once the current one would exceed the size cap. Only
+// the devices given are filled, it fails once all of them are full.
+func erofsBlobDevAlloc(sbi *types.SuperBlkInfo, nblocks uint32) (uint16, uint32, error) {
+	capBlocks := uint64(types.GCfg.MaxDeviceSize >> sbi.BlkSzBits)
+
+	for ; blobCurDev < len(sbi.Devs); blobCurDev++ {
+		dev := &sbi.Devs[blobCurDev]
+
+		if capBlocks == 0 || uint64(dev.Blocks)+uint64(nblocks) <= capBlocks {
+			blkaddr := dev.Blocks
+			dev.Blocks += nblocks
+			return uint16(blobCurDev + 1), blkaddr, nil
+		}
+	}
+	// the device table is reserved upfront, so devices can't be added here
+	return 0, 0, fmt.Errorf("no space left on the %d devices for a %d-block chunk: %w",
+		len(sbi.Devs), nblocks, syscall.Errno(errs.ENOSPC))
+}
+
+func erofsBlobGetchunk(sbi *types.SuperBlkInfo, buf []byte) (*ErofsBlobChunk, error) {
+	sum := sha256.Sum256(buf)
+	if chunk, ok := blobHashmap[sum]; ok {
+		sbi.SavedByDeduplication += uint64(len(buf))
+		types.Debug(types.EROFS_DBG, "Found duplicated chunk at %d", chunk.BlkAddr)
+		return chunk, nil
+	}
+
+	nblocks := uint32(types.BlkRoundUp(sbi, uint64(len(buf))))
+	data := make([]byte, types.ErofsPos(sbi, uint64(nblocks)))
+	copy(data, buf)
+
+	chunk := &ErofsBlobChunk{
+		ChunkSize: uint64(len(buf)),
+		Sha256:    sum,
+	}
+
+	var vf types.ErofsVFile
+	var pos uint64
+	if len(blobDevFiles) != 0 {
+		devid, blkaddr, err := erofsBlobDevAlloc(sbi, nblocks)
+		if err != nil {
+			return nil, err
+		}
+		chunk.DeviceID = devid
+		chunk.BlkAddr = blkaddr
+		vf.Fd = int(sbi.BlobFd[devid-1])
+		pos = types.ErofsPos(sbi, uint64(blkaddr))
+	} else {
+		chunk.BlkAddr = uint32(datablobSize >> sbi.BlkSzBits)
+		vf.Fd = int(blobFile.Fd())
+		pos = datablobSize
+		datablobSize += uint64(len(data))
+	}
+
+	types.Debug(types.EROFS_DBG, "Writing chunk (%d bytes) to %d", len(buf), chunk.BlkAddr)
+	if n, err := types.ErofsIoPwrite(&vf, data, pos, len(data)); n != len(data) {
+		if err == nil {
+			err = syscall.Errno(errs.EIO)
+		}
+		return nil, err
+	}
+
+	blobHashmap[sum] = chunk
+	return chunk, nil
+}
+
+func erofsInodeChunks(inode *types.ErofsInode, count int) []*ErofsBlobChunk {
+	if inode.ChunkIndexes == nil {
+		return nil
+	}
+	return unsafe.Slice((**ErofsBlobChunk)(inode.ChunkIndexes), count)
+}
+
+// erofsFileIsSparse reports whether the size bytes at fpos of fd have
+// any hole in them
+func erofsFileIsSparse(fd int, fpos, size uint64) bool {
+	if size == 0 {
+		return false
+	}
+	off, err := syscall.Seek(fd, int64(fpos), types.SEEK_HOLE)
+	if err != nil {
+		// SEEK_HOLE unsupported, assume the file is dense
+		return false
+	}
+	return uint64(off) < fpos+size
+}
+
+// erofsSeekData returns the offset of the next data at or after pos.
+// The whole remaining range is treated as data if SEEK_DATA is unsupported.
+func erofsSeekData(fd int, pos, size uint64) uint64 {
+	off, err := syscall.Seek(fd, int64(pos), types.SEEK_DATA)
+	if err == syscall.ENXIO {
+		// no more data beyond pos
+		return size
+	}
+	if err != nil {
+		return pos
+	}
+	return uint64(off)
+}
+
+func erofsIsZeroed(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ErofsBlobWriteChunkedFile splits a regular file starting at startoff of
+// fd into deduplicated chunks. Chunks fully covered by holes are recorded
+// as null chunk addresses.
+func ErofsBlobWriteChunkedFile(inode *types.ErofsInode, fd int, startoff uint64) error {
+	sbi := inode.Sbi
+	chunkbits := uint32(inode.ChunkBits)
+	var unit uint32
+
+	if chunkbits-uint32(sbi.BlkSzBits) > types.EROFS_CHUNK_FORMAT_BLKBITS_MASK {
+		chunkbits = types.EROFS_CHUNK_FORMAT_BLKBITS_MASK + uint32(sbi.BlkSzBits)
+	}
+	chunksize := uint64(1) << chunkbits
+	count := (inode.ISize + chunksize - 1) >> chunkbits
+
+	// chunks on extra devices are referenced by device id
+	if sbi.ExtraDevices != 0 {
+		inode.ChunkFormat |= uint16(types.EROFS_CHUNK_FORMAT_INDEXES)
+	}
+	if uint32(inode.ChunkFormat)&types.EROFS_CHUNK_FORMAT_INDEXES != 0 {
+		unit = types.EROFS_CHUNK_INDEX_SIZE
+	} else {
+		unit = types.EROFS_BLOCK_MAP_ENTRY_SIZE
+	}
+
+	chunkdata := make([]byte, chunksize)
+	chunks := make([]*ErofsBlobChunk, 0, count)
+	vf := &types.ErofsVFile{Fd: fd, Offset: startoff}
+
+	for pos := uint64(0); pos < inode.ISize; {
+		// skip the chunks which only consist of holes
+		off := pos
+		if types.GCfg.DataImportMode != types.EROFS_MKFS_DATA_IMPORT_FULLDATA {
+			off = (erofsSeekData(fd, startoff+pos, startoff+inode.ISize) - startoff) &^ (chunksize - 1)
+		}
+		if off > pos {
+			for ; pos < off; pos += chunksize {
+				chunks = append(chunks, &erofsHolechunk)
+			}
+			continue
+		}
+
+		length := min(inode.ISize-pos, chunksize)
+		n, err := types.ErofsIoPread(vf, chunkdata, pos, int64(length))
+		if err != nil {
+			return err
+		}
+		if uint64(n) < length {
+			return syscall.Errno(errs.EIO)
+		}
+
+		if types.GCfg.DataImportMode == types.EROFS_MKFS_DATA_IMPORT_SPARSE &&
+			erofsIsZeroed(chunkdata[:length]) {
+			chunks = append(chunks, &erofsHolechunk)
+			pos += chunksize
+			continue
+		}
+
+		chunk, err := erofsBlobGetchunk(sbi, chunkdata[:length])
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, chunk)
+		pos += chunksize
+	}
+
+	inode.ExtentIsize = uint32(count) * unit
+	if len(chunks) != 0 {
+		inode.ChunkIndexes = unsafe.Pointer(&chunks[0])
+	}
+	inode.DataLayout = types.EROFS_INODE_CHUNK_BASED
+	inode.ChunkFormat |= uint16(chunkbits - uint32(sbi.BlkSzBits))
+	return nil
+}
+
+// erofsBlobMapChunks maps the data of a regular file to the extra device
+// deviceID (e.g. a tar archive) at dataOffset. The data has to be
+// block-aligned and the whole file is covered by as few chunks as possible.
+func erofsBlobMapChunks(inode *types.ErofsInode, deviceID uint16, dataOffset uint64) error {
+	sbi := inode.Sbi
+	chunkbits := max(uint32(bits.Len64(inode.ISize-1)), uint32(sbi.BlkSzBits))
+
+	if types.ErofsBlkoff(sbi, dataOffset) != 0 {
+		types.Error("data of %s @ %d isn't aligned to the block size", inode.ISrcpath, dataOffset)
+		return syscall.Errno(errs.EINVAL)
+	}
+	if chunkbits-uint32(sbi.BlkSzBits) > types.EROFS_CHUNK_FORMAT_BLKBITS_MASK {
+		chunkbits = types.EROFS_CHUNK_FORMAT_BLKBITS_MASK + uint32(sbi.BlkSzBits)
+	}
+	chunksize := uint64(1) << chunkbits
+	count := (inode.ISize + chunksize - 1) >> chunkbits
+
+	chunks := make([]*ErofsBlobChunk, 0, count)
+	for pos := uint64(0); pos < inode.ISize; pos += chunksize {
+		chunks = append(chunks, &ErofsBlobChunk{
+			ChunkSize: min(inode.ISize-pos, chunksize),
+			DeviceID:  deviceID,
+			BlkAddr:   uint32(types.ErofsBlknr(sbi, uint(dataOffset+pos))),
+		})
+	}
+
+	inode.ChunkBits = uint8(chunkbits)
+	inode.ChunkFormat = uint16(types.EROFS_CHUNK_FORMAT_INDEXES) |
+		uint16(chunkbits-uint32(sbi.BlkSzBits))
+	inode.ExtentIsize = uint32(count) * types.EROFS_CHUNK_INDEX_SIZE
+	inode.ChunkIndexes = unsafe.Pointer(&chunks[0])
+	inode.DataLayout = types.EROFS_INODE_CHUNK_BASED
+	return nil
+}
+
+// ErofsBlobWriteChunkIndexes writes the chunk indexes (or the block map)
+// of a chunk-based inode at off
+func ErofsBlobWriteChunkIndexes(inode *types.ErofsInode, off uint64) int {
+	var unit uint32
+
+	if uint32(inode.ChunkFormat)&types.EROFS_CHUNK_FORMAT_INDEXES != 0 {
+		unit = types.EROFS_CHUNK_INDEX_SIZE
+	} else {
+		unit = types.EROFS_BLOCK_MAP_ENTRY_SIZE
+	}
+
+	buf := make([]byte, inode.ExtentIsize)
+	chunks := erofsInodeChunks(inode, int(inode.ExtentIsize/unit))
+	for i, chunk := range chunks {
+		var blkaddr uint32
+
+		if chunk.BlkAddr == types.NULL_ADDR {
+			blkaddr = types.NULL_ADDR
+		} else if chunk.DeviceID != 0 {
+			blkaddr = chunk.BlkAddr
+		} else {
+			blkaddr = remappedBase + chunk.BlkAddr
+		}
+
+		dst := buf[uint32(i)*unit:]
+		if unit == types.EROFS_BLOCK_MAP_ENTRY_SIZE {
+			binary.LittleEndian.PutUint32(dst, blkaddr)
+		} else {
+			binary.LittleEndian.PutUint16(dst[2:], chunk.DeviceID)
+			binary.LittleEndian.PutUint32(dst[4:], blkaddr)
+		}
+	}
+	inode.ChunkIndexes = nil
+
+	off = types.RoundUp(off, uint64(unit))
+	return types.ErofsDevWrite(inode.Sbi, buf, off, len(buf))
+}
+
+func erofsWriteDeviceTable(sbi *types.SuperBlkInfo) error {
+	bh := sbi.BhDevt
+	if bh == nil {
+		return syscall.Errno(errs.EINVAL)
+	}
+
+	// extra devices are mapped one after another behind the primary
+	// device so that the image can also be accessed as a flat one
+	nblocks := types.MapBh(sbi.Bmgr, nil)
+	sbi.PrimaryDeviceBlocks = uint64(nblocks)
+	pos := types.BhTell(bh, false)
+
+	for i := range sbi.Devs {
+		dev := &sbi.Devs[i]
+		dis := make([]byte, types.EROFS_DEVT_SLOT_SIZE)
+
+		dev.MappedBlkAddr = nblocks
+		copy(dis, dev.Tag[:])
+		binary.LittleEndian.PutUint32(dis[64:], dev.Blocks)
+		binary.LittleEndian.PutUint32(dis[68:], dev.MappedBlkAddr)
+		if ret := types.ErofsDevWrite(sbi, dis, pos, len(dis)); ret != 0 {
+			return syscall.Errno(-ret)
+		}
+		pos += types.EROFS_DEVT_SLOT_SIZE
+		nblocks += dev.Blocks
+
+		// devices which aren't filled by mkfs (e.g. tar archives) are kept
+		if i >= len(blobDevFiles) {
+			continue
+		}
+		if fi, err := blobDevFiles[i].Stat(); err == nil && fi.Mode().IsRegular() {
+			if err = blobDevFiles[i].Truncate(int64(types.ErofsPos(sbi, uint64(dev.Blocks)))); err != nil {
+				return err
+			}
+		}
+	}
+	sbi.TotalBlocks = uint64(nblocks)
+
+	bh.Op = &types.DropDirectlyBhops
+	types.BDrop(bh, false)
+	sbi.BhDevt = nil
+	return nil
+}
+
+// ErofsMkfsDumpBlobs appends the spooled chunk data to the primary device
+// and writes the device table if there are extra devices
+func ErofsMkfsDumpBlobs(sbi *types.SuperBlkInfo) error {
+	if datablobSize == 0 {
+		if sbi.ExtraDevices != 0 {
+			return erofsWriteDeviceTable(sbi)
+		}
+		return nil
+	}
+
+	bh, err := types.Balloc(sbi.Bmgr, types.DATA, datablobSize, 0, 0)
+	if err != nil {
+		return err
+	}
+	if err = types.ErofsDevCheckSize(sbi, types.MapBh(nil, bh.Block)); err != nil {
+		return err
+	}
+
+	posOut := types.BhTell(bh, false)
+	remappedBase = uint32(posOut >> sbi.BlkSzBits)
+
+	vin := &types.ErofsVFile{Fd: int(blobFile.Fd())}
+	if _, err = blobFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err = types.ErofsIoXcopy(sbi.BDev, int64(posOut), vin, uint(datablobSize), false); err != nil {
+		return err
+	}
+
+	bh.Op = &types.DropDirectlyBhops
+	types.BDrop(bh, false)
+
+	if sbi.ExtraDevices != 0 {
+		return erofsWriteDeviceTable(sbi)
+	}
+	return nil
+}
+
+// erofsChunkbitsValid checks a user-specified chunk size
+func erofsChunkbitsValid(sbi *types.SuperBlkInfo, chunksize uint64) bool {
+	return chunksize != 0 && chunksize&(chunksize-1) == 0 &&
+		bits.TrailingZeros64(chunksize) >= int(sbi.BlkSzBits)
+}
+
+// ErofsSetChunksize validates chunksize and enables chunk-based files
+func ErofsSetChunksize(sbi *types.SuperBlkInfo, chunksize uint64) error {
+	if !erofsChunkbitsValid(sbi, chunksize) {
+		return fmt.Errorf("invalid chunksize %d: must be a power of 2 no less than the block size", chunksize)
+	}
+	types.GCfg.ChunkBits = uint8(bits.TrailingZeros64(chunksize))
+	return nil
+}
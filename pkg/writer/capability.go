@@ -0,0 +1,128 @@
+package writer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+// VFS file capabilities, see include/uapi/linux/capability.h
+const (
+	vfsCapRevision2      = 0x02000000
+	vfsCapRevision3      = 0x03000000
+	vfsCapFlagsEffective = 0x000001
+
+	xattrCapsSuffix = "capability"
+)
+
+// capNames are the capability names indexed by their bit numbers
+var capNames = [...]string{
+	"chown", "dac_override", "dac_read_search", "fowner", "fsetid",
+	"kill", "setgid", "setuid", "setpcap", "linux_immutable",
+	"net_bind_service", "net_broadcast", "net_admin", "net_raw",
+	"ipc_lock", "ipc_owner", "sys_module", "sys_rawio", "sys_chroot",
+	"sys_ptrace", "sys_pacct", "sys_admin", "sys_boot", "sys_nice",
+	"sys_resource", "sys_time", "sys_tty_config", "mknod", "lease",
+	"audit_write", "audit_control", "setfcap", "mac_override",
+	"mac_admin", "syslog", "wake_alarm", "block_suspend", "audit_read",
+	"perfmon", "bpf", "checkpoint_restore",
+}
+
+// erofsFileCaps is a per-path capability override
+type erofsFileCaps struct {
+	capabilities uint64
+	rootid       uint32 // namespace root uid, written as v3 if non-zero
+}
+
+// fileCapsOverrides are keyed by paths relative to the filesystem root
+var fileCapsOverrides = make(map[string]erofsFileCaps)
+
+// erofsParseCaps parses a capability set, which is either a number or a
+// comma-separated list of names such as "cap_net_raw,cap_net_admin"
+func erofsParseCaps(s string) (uint64, error) {
+	if caps, err := strconv.ParseUint(s, 0, 64); err == nil {
+		return caps, nil
+	}
+
+	var caps uint64
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "cap_")
+
+		bit := -1
+		for i, n := range capNames {
+			if n == name {
+				bit = i
+				break
+			}
+		}
+		if bit < 0 {
+			return 0, fmt.Errorf("unknown capability %q", name)
+		}
+		caps |= 1 << bit
+	}
+	return caps, nil
+}
+
+// ErofsAddFileCaps registers a capability override given as
+// "path=caps[@rootid]"
+func ErofsAddFileCaps(arg string) error {
+	path, spec, ok := strings.Cut(arg, "=")
+	if !ok || path == "" {
+		return fmt.Errorf("invalid file capabilities %q", arg)
+	}
+
+	var fc erofsFileCaps
+	if caps, rootid, ok := strings.Cut(spec, "@"); ok {
+		id, err := strconv.ParseUint(rootid, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid rootid in %q: %w", arg, err)
+		}
+		fc.rootid = uint32(id)
+		spec = caps
+	}
+
+	caps, err := erofsParseCaps(spec)
+	if err != nil {
+		return err
+	}
+	fc.capabilities = caps
+	fileCapsOverrides[strings.Trim(path, "/")] = fc
+	return nil
+}
+
+// erofsDroidXattrSetCaps turns the capabilities of inode into a
+// security.capability xattr
+func erofsDroidXattrSetCaps(inode *types.ErofsInode) error {
+	fc := erofsFileCaps{capabilities: inode.Capabilities}
+	if ov, ok := fileCapsOverrides[types.ErofsFspath(inode.ISrcpath)]; ok {
+		fc = ov
+	}
+
+	if fc.capabilities == 0 {
+		return nil
+	}
+
+	var caps []byte
+	if fc.rootid != 0 {
+		caps = make([]byte, 24)
+		binary.LittleEndian.PutUint32(caps[0:], vfsCapRevision3|vfsCapFlagsEffective)
+		binary.LittleEndian.PutUint32(caps[20:], fc.rootid)
+	} else {
+		caps = make([]byte, 20)
+		binary.LittleEndian.PutUint32(caps[0:], vfsCapRevision2|vfsCapFlagsEffective)
+	}
+	// data[0].permitted, data[0].inheritable, data[1].permitted, ...
+	binary.LittleEndian.PutUint32(caps[4:], uint32(fc.capabilities))
+	binary.LittleEndian.PutUint32(caps[12:], uint32(fc.capabilities>>32))
+
+	kvbuf := append([]byte(xattrCapsSuffix), caps...)
+	item := getXattritem(types.EROFSXattrIndexSecurity, kvbuf,
+		[2]uint32{uint32(len(xattrCapsSuffix)), uint32(len(caps))})
+
+	erofsInodeXattrDel(&inode.IXattrs, xattrTypes[types.EROFSXattrIndexSecurity]+xattrCapsSuffix)
+	inodeXattrAdd(&inode.IXattrs, item)
+	return nil
+}
@@ -0,0 +1,98 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+func TestErofsParseCaps(t *testing.T) {
+	tests := []struct {
+		spec  string
+		want  uint64
+		fails bool
+	}{
+		{spec: "0x3000", want: 0x3000},
+		{spec: "8192", want: 1 << 13},
+		{spec: "cap_net_raw", want: 1 << 13},
+		{spec: "CAP_NET_RAW, cap_net_admin", want: 1<<13 | 1<<12},
+		{spec: "checkpoint_restore,chown", want: 1<<40 | 1},
+		{spec: "cap_nosuchcap", fails: true},
+		{spec: "", fails: true},
+	}
+
+	for _, tt := range tests {
+		got, err := erofsParseCaps(tt.spec)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("erofsParseCaps(%q) = %#x, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("erofsParseCaps(%q) = %#x, %v, want %#x", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+// capTestXattr returns the security.capability value of inode, nil if
+// there is none
+func capTestXattr(inode *types.ErofsInode) []byte {
+	for pos := inode.IXattrs.Next; pos != &inode.IXattrs; pos = pos.Next {
+		item := inodeXattrNodeFromList(pos).item
+
+		if item.prefix == types.EROFSXattrIndexSecurity &&
+			string(item.kvbuf[:item.len[0]]) == xattrCapsSuffix {
+			return item.kvbuf[item.len[0]:]
+		}
+	}
+	return nil
+}
+
+func TestErofsDroidXattrSetCaps(t *testing.T) {
+	types.ErofsSetFsRoot("/")
+	t.Cleanup(func() { clear(fileCapsOverrides) })
+
+	for _, arg := range []string{"/bin/ping=cap_net_raw", "bin/newuidmap=cap_setuid,cap_setgid@1000"} {
+		if err := ErofsAddFileCaps(arg); err != nil {
+			t.Fatalf("ErofsAddFileCaps(%q) = %v", arg, err)
+		}
+	}
+
+	// vfs_cap_data: magic_etc, then permitted and inheritable of each
+	// 32-bit half, then the rootid of revision 3
+	vfsCap := func(magic uint32, caps uint64, rootid ...uint32) []byte {
+		words := []uint32{magic, uint32(caps), 0, uint32(caps >> 32), 0}
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, append(words, rootid...))
+		return b.Bytes()
+	}
+
+	tests := []struct {
+		name string
+		path string
+		caps uint64 // as set by a canned fs_config
+		want []byte
+	}{
+		{"fs_config v2", "/bin/su", 1<<40 | 1<<7, vfsCap(vfsCapRevision2|vfsCapFlagsEffective, 1<<40|1<<7)},
+		{"override v2", "/bin/ping", 1 << 21, vfsCap(vfsCapRevision2|vfsCapFlagsEffective, 1<<13)},
+		{"override v3", "/bin/newuidmap", 0, vfsCap(vfsCapRevision3|vfsCapFlagsEffective, 1<<7|1<<6, 1000)},
+		{"no capabilities", "/bin/ls", 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inode := &types.ErofsInode{ISrcpath: tt.path, Capabilities: tt.caps}
+			types.InitListHead(&inode.IXattrs)
+
+			if err := erofsDroidXattrSetCaps(inode); err != nil {
+				t.Fatalf("erofsDroidXattrSetCaps() = %v", err)
+			}
+			if got := capTestXattr(inode); !bytes.Equal(got, tt.want) {
+				t.Fatalf("security.capability = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
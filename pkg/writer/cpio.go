@@ -0,0 +1,265 @@
+package writer
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"syscall"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+// cpio headers are in the SVR4 portable format ("newc") or its variant
+// with checksums ("crc"), as used by initramfs
+const (
+	cpioHeaderSize = 110
+	cpioAlign      = 4
+	cpioTrailer    = "TRAILER!!!"
+)
+
+var (
+	cpioMagicNewc = []byte("070701")
+	cpioMagicCrc  = []byte("070702")
+)
+
+// fields of a newc header after the magic, 8 hex digits each
+const (
+	cpioIno = iota
+	cpioMode
+	cpioUid
+	cpioGid
+	cpioNlink
+	cpioMtime
+	cpioFilesize
+	cpioDevmajor
+	cpioDevminor
+	cpioRdevmajor
+	cpioRdevminor
+	cpioNamesize
+	cpioCheck
+	cpioNrFields
+)
+
+// cpioLinkKey identifies the files of a hardlink group
+type cpioLinkKey struct {
+	major, minor uint32
+	ino          uint32
+}
+
+// ErofsCpiofile is a cpio archive used as the source of the tree
+type ErofsCpiofile struct {
+	ios erofsIostream
+
+	// hardlinks seen so far, which share their inode numbers within
+	// an archive
+	links map[cpioLinkKey]*types.ErofsInode
+
+	// file data is referenced right in seekable archives, otherwise it's
+	// spooled into diskbuf stream 0
+	strm *types.ErofsDiskBufStrm
+}
+
+// ErofsCpioOpen opens the cpio archive at path ("-" for stdin), which may
+// be compressed by gzip or bzip2
+func ErofsCpioOpen(path string) (*ErofsCpiofile, error) {
+	cpio := &ErofsCpiofile{}
+
+	if err := erofsIostreamOpenFile(&cpio.ios, path); err != nil {
+		types.Error("failed to open cpio source %s: %v", path, err)
+		return nil, err
+	}
+
+	if cpio.ios.seekable {
+		cpio.strm = &types.ErofsDiskBufStrm{Fd: int(cpio.ios.f.Fd()), AlignSize: 1}
+	}
+	return cpio, nil
+}
+
+// ErofsCpioClose closes the archive
+func ErofsCpioClose(cpio *ErofsCpiofile) {
+	cpio.ios.close()
+}
+
+// cpioPadding returns the number of bytes to align pos
+func cpioPadding(pos uint64) uint64 {
+	return types.RoundUp(pos, cpioAlign) - pos
+}
+
+// erofsCpioReadHeader reads the next header, skipping the zeroes between
+// concatenated archives. io.EOF is returned at the end of the archive.
+func erofsCpioReadHeader(cpio *ErofsCpiofile, hdr []byte) error {
+	for {
+		err := cpio.ios.read(hdr[:cpioAlign])
+		if err == io.EOF {
+			return io.EOF
+		}
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if !bytes.Equal(hdr[:cpioAlign], make([]byte, cpioAlign)) {
+			break
+		}
+	}
+
+	if err := cpio.ios.read(hdr[cpioAlign:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// erofsCpioSetData reads the data of the regular file inode, which is
+// verified against check for crc archives
+func erofsCpioSetData(cpio *ErofsCpiofile, inode *types.ErofsInode, size uint64,
+	crc bool, check uint32) error {
+	inode.ISize = size
+	inode.DataSource = types.EROFS_INODE_DATA_SOURCE_NONE
+	inode.IDiskbuf = nil
+	if size == 0 {
+		return nil
+	}
+
+	cpio.ios.chksum, cpio.ios.sum = crc, 0
+	err := erofsIostreamFileData(&cpio.ios, cpio.strm, inode)
+	cpio.ios.chksum = false
+	if err != nil {
+		return err
+	}
+	if crc && cpio.ios.sum != check {
+		types.Error("checksum mismatch of %s", inode.ISrcpath)
+		return syscall.Errno(errs.EBADMSG)
+	}
+	return nil
+}
+
+// ErofsCpioParse parses the next entry of the archive into the tree at
+// root. io.EOF is returned at the end of the archive.
+func ErofsCpioParse(root *types.ErofsInode, cpio *ErofsCpiofile) error {
+	var fields [cpioNrFields]uint32
+
+	hdr := make([]byte, cpioHeaderSize)
+	offset := cpio.ios.pos
+	if err := erofsCpioReadHeader(cpio, hdr); err != nil {
+		return err
+	}
+
+	crc := bytes.HasPrefix(hdr, cpioMagicCrc)
+	if !crc && !bytes.HasPrefix(hdr, cpioMagicNewc) {
+		types.Error("invalid cpio header @ %d", offset)
+		return syscall.Errno(errs.EBADMSG)
+	}
+	for i := range fields {
+		off := len(cpioMagicNewc) + 8*i
+		v, err := strconv.ParseUint(string(hdr[off:off+8]), 16, 32)
+		if err != nil {
+			types.Error("invalid cpio header @ %d", offset)
+			return syscall.Errno(errs.EBADMSG)
+		}
+		fields[i] = uint32(v)
+	}
+
+	if fields[cpioNamesize] == 0 {
+		return syscall.Errno(errs.EBADMSG)
+	}
+	name := make([]byte, fields[cpioNamesize])
+	if err := cpio.ios.read(name); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if name[len(name)-1] != 0 {
+		types.Error("invalid cpio name @ %d", offset)
+		return syscall.Errno(errs.EBADMSG)
+	}
+	name = name[:len(name)-1]
+	if err := cpio.ios.lskip(cpioPadding(cpio.ios.pos)); err != nil {
+		return err
+	}
+
+	size := uint64(fields[cpioFilesize])
+	if string(name) == cpioTrailer {
+		// another archive may follow, inode numbers start over
+		cpio.links = nil
+		return cpio.ios.lskip(size + cpioPadding(cpio.ios.pos+size))
+	}
+
+	st := syscall.Stat_t{
+		Mode: fields[cpioMode],
+		Uid:  fields[cpioUid],
+		Gid:  fields[cpioGid],
+		Mtim: syscall.Timespec{Sec: int64(fields[cpioMtime])},
+	}
+	relpath := erofsRebuildPath(string(name))
+	if err := erofsCpioAddEntry(root, cpio, relpath, &st, &fields, crc); err != nil {
+		types.Error("failed to add %s @ %d: %s", name, offset, err)
+		return err
+	}
+	return cpio.ios.lskip(cpioPadding(cpio.ios.pos))
+}
+
+// erofsCpioAddEntry adds an entry to the tree, consuming its data
+func erofsCpioAddEntry(root *types.ErofsInode, cpio *ErofsCpiofile, relpath string,
+	st *syscall.Stat_t, fields *[cpioNrFields]uint32, crc bool) error {
+	var link []byte
+
+	size := uint64(fields[cpioFilesize])
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+	case syscall.S_IFLNK:
+		if size == 0 || size > syscall.PathMax {
+			return syscall.Errno(errs.EBADMSG)
+		}
+		link = make([]byte, size)
+		if err := cpio.ios.read(link); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		st.Size = int64(size)
+		size = 0
+	case syscall.S_IFCHR, syscall.S_IFBLK:
+		st.Rdev = unix.Mkdev(fields[cpioRdevmajor], fields[cpioRdevminor])
+	case syscall.S_IFDIR, syscall.S_IFIFO, syscall.S_IFSOCK:
+	default:
+		types.Error("unknown file type %o", st.Mode&syscall.S_IFMT)
+		return syscall.Errno(errs.EBADMSG)
+	}
+
+	key := cpioLinkKey{major: fields[cpioDevmajor], minor: fields[cpioDevminor], ino: fields[cpioIno]}
+	hardlink := fields[cpioNlink] > 1 && st.Mode&syscall.S_IFMT != syscall.S_IFDIR
+	if hardlink {
+		// the data of a hardlink group comes with one of its entries,
+		// usually the last one
+		if target := cpio.links[key]; target != nil && target.ICount > 0 {
+			if err := erofsRebuildLink(root, relpath, target); err != nil {
+				return err
+			}
+			if target.IsReg() && size != 0 {
+				return erofsCpioSetData(cpio, target, size, crc, fields[cpioCheck])
+			}
+			return cpio.ios.lskip(size)
+		}
+	}
+
+	inode, err := erofsRebuildSetInode(root, relpath, st)
+	if err != nil {
+		return err
+	}
+	if err = erofsRebuildApplyXattrs(inode); err != nil {
+		return err
+	}
+	if hardlink {
+		if cpio.links == nil {
+			cpio.links = make(map[cpioLinkKey]*types.ErofsInode)
+		}
+		cpio.links[key] = inode
+	}
+
+	switch {
+	case inode.IsLnk():
+		inode.ILink = string(link)
+	case inode.IsReg():
+		return erofsCpioSetData(cpio, inode, size, crc, fields[cpioCheck])
+	case size != 0:
+		// data of special files is meaningless
+		return cpio.ios.lskip(size)
+	}
+	return nil
+}
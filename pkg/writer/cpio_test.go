@@ -0,0 +1,143 @@
+package writer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+// cpioTestEntry returns an entry of a crc archive if crc is set, a newc one
+// otherwise. The checksum of crc archives is the sum of the data bytes.
+func cpioTestEntry(crc bool, name string, mode uint32, data string) []byte {
+	var check uint32
+
+	magic := cpioMagicNewc
+	if crc {
+		magic = cpioMagicCrc
+		for _, c := range []byte(data) {
+			check += uint32(c)
+		}
+	}
+	return cpioTestRaw(magic, name+"\x00", mode, data, check)
+}
+
+// cpioTestRaw returns an entry with the given magic, NUL-terminated name
+// and checksum field, padded as in archives
+func cpioTestRaw(magic []byte, name string, mode uint32, data string, check uint32) []byte {
+	var b bytes.Buffer
+
+	b.Write(magic)
+	fmt.Fprintf(&b, "%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		1, mode, 1000, 1000, 1, 1700000000, len(data), 0, 0, 0, 0, len(name), check)
+	b.WriteString(name)
+	b.Write(make([]byte, cpioPadding(uint64(b.Len()))))
+	b.WriteString(data)
+	b.Write(make([]byte, cpioPadding(uint64(b.Len()))))
+	return b.Bytes()
+}
+
+// cpioTestParse parses the archive of entries into a new tree
+func cpioTestParse(t *testing.T, entries ...[]byte) (*types.ErofsInode, error) {
+	t.Helper()
+
+	fn := filepath.Join(t.TempDir(), "test.cpio")
+	archive := append(bytes.Join(entries, nil), cpioTestEntry(false, cpioTrailer, 0, "")...)
+	if err := os.WriteFile(fn, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root := erofsTestMakeRoot(t)
+	cpio, err := ErofsCpioOpen(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ErofsCpioClose(cpio) })
+
+	for {
+		if err = ErofsCpioParse(root, cpio); err == io.EOF {
+			return root, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func TestErofsCpioParse(t *testing.T) {
+	for _, crc := range []bool{false, true} {
+		t.Run(fmt.Sprintf("crc=%v", crc), func(t *testing.T) {
+			root, err := cpioTestParse(t,
+				cpioTestEntry(crc, "dir", syscall.S_IFDIR|0755, ""),
+				cpioTestEntry(crc, "dir/file", syscall.S_IFREG|0644, "hello, cpio"),
+				cpioTestEntry(crc, "dir/link", syscall.S_IFLNK|0777, "file"))
+			if err != nil {
+				t.Fatalf("ErofsCpioParse() = %v", err)
+			}
+
+			inode := erofsRebuildLookup(root, "dir/file")
+			if inode == nil || !inode.IsReg() {
+				t.Fatal("dir/file isn't a regular file")
+			}
+			if inode.IUid != 1000 || inode.IMtime != 1700000000 {
+				t.Errorf("dir/file: uid %d mtime %d, want 1000 1700000000", inode.IUid, inode.IMtime)
+			}
+			if data := erofsTestData(t, inode); data != "hello, cpio" {
+				t.Errorf("dir/file: data %q, want %q", data, "hello, cpio")
+			}
+			if inode = erofsRebuildLookup(root, "dir/link"); inode == nil || inode.ILink != "file" {
+				t.Error("dir/link isn't a symlink to file")
+			}
+		})
+	}
+}
+
+func TestErofsCpioParseMalformed(t *testing.T) {
+	badCheck := cpioTestRaw(cpioMagicCrc, "file\x00", syscall.S_IFREG|0644, "data", 0x1234)
+	badField := cpioTestEntry(false, "file", syscall.S_IFREG|0644, "")
+	copy(badField[len(cpioMagicNewc)+8*cpioMode:], "0000x1a4")
+
+	tests := []struct {
+		name  string
+		entry []byte
+		errno syscall.Errno // 0 if any error is fine
+	}{
+		{"checksum mismatch", badCheck, syscall.Errno(errs.EBADMSG)},
+		{"bad magic", cpioTestRaw([]byte("070707"), "file\x00", syscall.S_IFREG|0644, "", 0), syscall.Errno(errs.EBADMSG)},
+		{"invalid field", badField, syscall.Errno(errs.EBADMSG)},
+		{"empty name", cpioTestRaw(cpioMagicNewc, "", syscall.S_IFREG|0644, "", 0), syscall.Errno(errs.EBADMSG)},
+		{"unterminated name", cpioTestRaw(cpioMagicNewc, "file", syscall.S_IFREG|0644, "", 0), syscall.Errno(errs.EBADMSG)},
+		{"truncated header", cpioTestEntry(false, "file", syscall.S_IFREG|0644, "")[:60], 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "test.cpio")
+			if err := os.WriteFile(fn, tt.entry, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			root := erofsTestMakeRoot(t)
+			cpio, err := ErofsCpioOpen(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ErofsCpioClose(cpio)
+
+			err = ErofsCpioParse(root, cpio)
+			if err == nil || err == io.EOF {
+				t.Fatalf("ErofsCpioParse() = %v, want an error", err)
+			}
+			if tt.errno != 0 && !errors.Is(err, tt.errno) {
+				t.Fatalf("ErofsCpioParse() = %v, want %v", err, tt.errno)
+			}
+		})
+	}
+}
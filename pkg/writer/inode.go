@@ -1 +1,745 @@
 package writer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+var erofsWriteInodeBhops = types.BufferHeadOps{
+	Flush: erofsBhFlushWriteInode,
+}
+
+var erofsWriteInlineBhops = types.BufferHeadOps{
+	Flush: erofsBhFlushWriteInline,
+}
+
+// erofsBhFlushWriteInode writes the on-disk inode together with its
+// xattr ibody and chunk indexes
+func erofsBhFlushWriteInode(bh *types.BufferHead) int {
+	inode := bh.FsPrivate.(*types.ErofsInode)
+	sbi := inode.Sbi
+	icount := erofsInodeXattrIcount(inode.XattrIsize)
+	off := types.BhTell(bh, false)
+	buf := make([]byte, inode.InodeIsize)
+
+	var iu uint32
+	switch inode.IMode & types.S_IFMT {
+	case types.S_IFCHR, types.S_IFBLK, types.S_IFIFO, types.S_IFSOCK:
+		iu = inode.IRdev
+	default:
+		if inode.IsCompressed() {
+			iu = inode.IBlocks
+		} else if inode.DataLayout == types.EROFS_INODE_CHUNK_BASED {
+			iu = uint32(inode.ChunkFormat)
+		} else {
+			iu = inode.IBlkaddr
+		}
+	}
+
+	switch inode.InodeIsize {
+	case types.EROFS_INODE_COMPACT_SIZE:
+		binary.LittleEndian.PutUint16(buf[0:], uint16(inode.DataLayout)<<types.EROFS_I_DATALAYOUT_BIT)
+		binary.LittleEndian.PutUint16(buf[2:], icount)
+		binary.LittleEndian.PutUint16(buf[4:], inode.IMode)
+		binary.LittleEndian.PutUint16(buf[6:], uint16(inode.INlink))
+		binary.LittleEndian.PutUint32(buf[8:], uint32(inode.ISize))
+		binary.LittleEndian.PutUint32(buf[16:], iu)
+		binary.LittleEndian.PutUint32(buf[20:], uint32(inode.IIno[0]))
+		binary.LittleEndian.PutUint16(buf[24:], uint16(inode.IUid))
+		binary.LittleEndian.PutUint16(buf[26:], uint16(inode.IGid))
+	case types.EROFS_INODE_EXTENDED_SIZE:
+		binary.LittleEndian.PutUint16(buf[0:], 1|uint16(inode.DataLayout)<<types.EROFS_I_DATALAYOUT_BIT)
+		binary.LittleEndian.PutUint16(buf[2:], icount)
+		binary.LittleEndian.PutUint16(buf[4:], inode.IMode)
+		binary.LittleEndian.PutUint64(buf[8:], inode.ISize)
+		binary.LittleEndian.PutUint32(buf[16:], iu)
+		binary.LittleEndian.PutUint32(buf[20:], uint32(inode.IIno[0]))
+		binary.LittleEndian.PutUint32(buf[24:], inode.IUid)
+		binary.LittleEndian.PutUint32(buf[28:], inode.IGid)
+		binary.LittleEndian.PutUint64(buf[32:], inode.IMtime)
+		binary.LittleEndian.PutUint32(buf[40:], inode.IMtimeNsec)
+		binary.LittleEndian.PutUint32(buf[44:], inode.INlink)
+	default:
+		types.Error("unsupported on-disk inode version of nid %d", inode.Nid)
+		return -errs.EINVAL
+	}
+
+	if ret := types.ErofsDevWrite(sbi, buf, off, len(buf)); ret != 0 {
+		return ret
+	}
+	off += uint64(inode.InodeIsize)
+
+	if inode.XattrIsize != 0 {
+		xattrs := erofsExportXattrIbody(inode)
+		if ret := types.ErofsDevWrite(sbi, xattrs, off, len(xattrs)); ret != 0 {
+			return ret
+		}
+	}
+	off += uint64(inode.XattrIsize)
+
+	if inode.ExtentIsize != 0 && inode.DataLayout == types.EROFS_INODE_CHUNK_BASED {
+		if ret := ErofsBlobWriteChunkIndexes(inode, off); ret != 0 {
+			return ret
+		}
+	}
+
+	inode.Bh = nil
+	types.ErofsIput(inode)
+	return types.BhFlushGenericEnd(bh)
+}
+
+func erofsBhFlushWriteInline(bh *types.BufferHead) int {
+	inode := bh.FsPrivate.(*types.ErofsInode)
+	off := types.BhTell(bh, false)
+
+	idata := erofsIdata(inode)
+	if ret := types.ErofsDevWrite(inode.Sbi, idata, off, len(idata)); ret != 0 {
+		return ret
+	}
+	inode.Idata = nil
+
+	types.ErofsIput(inode)
+	return types.BhFlushGenericEnd(bh)
+}
+
+func erofsPrepareTailBlock(inode *types.ErofsInode) error {
+	sbi := inode.Sbi
+
+	if inode.IdataSize == 0 {
+		return nil
+	}
+
+	bh := inode.BhData
+	if bh != nil {
+		// expend a block as the tail block (should be successful)
+		if ret := types.BhBalloon(bh, uint64(types.ErofsBlkSiz(sbi))); ret != int(types.ErofsBlkSiz(sbi)) {
+			return syscall.Errno(errs.EIO)
+		}
+	} else {
+		inode.LazyTailblock = true
+	}
+	return nil
+}
+
+// ErofsPrepareInodeBuffer allocates the metadata buffer of an inode,
+// inlining its tail-end data right after the inode if it fits
+func ErofsPrepareInodeBuffer(inode *types.ErofsInode) error {
+	sbi := inode.Sbi
+	var bh *types.BufferHead
+	var err error
+
+	if inode.Bh != nil || inode.BhInline != nil {
+		return syscall.Errno(errs.EINVAL)
+	}
+
+	inodesize := uint64(inode.InodeIsize) + uint64(inode.XattrIsize)
+	if inode.ExtentIsize != 0 {
+		inodesize = types.RoundUp(inodesize, 8) + uint64(inode.ExtentIsize)
+	}
+
+	// TODO: tailpacking inline of chunk-based format isn't finalized
+	noinline := inode.DataLayout == types.EROFS_INODE_FLAT_PLAIN ||
+		inode.DataLayout == types.EROFS_INODE_CHUNK_BASED
+
+	if !noinline && !inode.IsCompressed() {
+		if !types.GCfg.InlineData && inode.IsReg() {
+			inode.DataLayout = types.EROFS_INODE_FLAT_PLAIN
+			noinline = true
+		} else if inode.IdataSize == 0 {
+			// block-aligned uncompressed files should use FLAT_PLAIN
+			inode.DataLayout = types.EROFS_INODE_FLAT_PLAIN
+		}
+	}
+
+	if !noinline {
+		bh, err = types.Balloc(sbi.Bmgr, types.INODE, inodesize, 0, uint32(inode.IdataSize))
+		if errors.Is(err, syscall.ENOSPC) {
+			inode.DataLayout = types.EROFS_INODE_FLAT_PLAIN
+			noinline = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if noinline {
+		// expend an extra block for tail-end data
+		if err = erofsPrepareTailBlock(inode); err != nil {
+			return err
+		}
+		bh, err = types.Balloc(sbi.Bmgr, types.INODE, inodesize, 0, 0)
+		if err != nil {
+			return err
+		}
+	} else if inode.IdataSize != 0 {
+		inode.DataLayout = types.EROFS_INODE_FLAT_INLINE
+
+		// allocate inline buffer
+		ibh, ret := types.Battach(bh, types.META, uint32(inode.IdataSize))
+		if ret < 0 {
+			return syscall.Errno(-ret)
+		}
+		ibh.Op = types.SkipWriteOps
+		inode.BhInline = ibh
+	}
+
+	bh.FsPrivate = types.ErofsIgrab(inode)
+	bh.Op = &erofsWriteInodeBhops
+	inode.Bh = bh
+	sbi.Inos++
+	inode.IIno[0] = sbi.Inos // inode serial number
+	return nil
+}
+
+// ErofsWriteTailEnd writes the tail-end data either inline or into an
+// extra data block, and drops the data buffer of the inode
+func ErofsWriteTailEnd(inode *types.ErofsInode) error {
+	sbi := inode.Sbi
+	blksiz := uint64(types.ErofsBlkSiz(sbi))
+	bh := inode.BhData
+
+	if inode.IdataSize != 0 {
+		if inode.BhInline != nil {
+			// have enough room to inline data
+			ibh := inode.BhInline
+			ibh.FsPrivate = types.ErofsIgrab(inode)
+			ibh.Op = &erofsWriteInlineBhops
+			types.MapBh(nil, ibh.Block)
+		} else {
+			if bh == nil {
+				var err error
+
+				bh, err = types.Balloc(sbi.Bmgr, types.DATA, blksiz, 0, 0)
+				if err != nil {
+					return err
+				}
+				bh.Op = types.SkipWriteOps
+
+				// get blkaddr of bh
+				types.MapBh(nil, bh.Block)
+				inode.IBlkaddr = bh.Block.BlkAddr
+				inode.BhData = bh
+			} else {
+				if inode.LazyTailblock {
+					// expend a tail block (should be successful)
+					if ret := types.BhBalloon(bh, blksiz); ret != int(blksiz) {
+						return syscall.Errno(errs.EIO)
+					}
+					inode.LazyTailblock = false
+				}
+				types.MapBh(nil, bh.Block)
+			}
+
+			pos := types.BhTell(bh, true) - blksiz
+			tail := make([]byte, blksiz)
+			copy(tail, erofsIdata(inode))
+			if ret := types.ErofsDevWrite(sbi, tail, pos, len(tail)); ret != 0 {
+				return syscall.Errno(-ret)
+			}
+			inode.IdataSize = 0
+			inode.Idata = nil
+		}
+	}
+
+	// now bh_data can drop directly
+	if bh != nil {
+		// Don't leave DATA buffers which were written in the global
+		// buffer list. It will make balloc() slowly.
+		types.BDrop(bh, false)
+		inode.BhData = nil
+	}
+	return nil
+}
+
+// ErofsWriteFileFromBuffer writes an in-memory file body, e.g. a symlink
+func ErofsWriteFileFromBuffer(inode *types.ErofsInode, buf []byte) error {
+	sbi := inode.Sbi
+	nblocks := uint32(inode.ISize >> sbi.BlkSzBits)
+
+	inode.DataLayout = types.EROFS_INODE_FLAT_INLINE
+
+	if err := types.ErofsAllocateInodeBhData(inode, nblocks); err != nil {
+		return err
+	}
+
+	if nblocks != 0 {
+		if ret := types.ErofsBlkWrite(sbi, buf, inode.IBlkaddr, nblocks); ret != 0 {
+			return syscall.Errno(-ret)
+		}
+	}
+	tail := buf[types.ErofsPos(sbi, uint64(nblocks)):inode.ISize]
+	erofsSetIdata(inode, append([]byte(nil), tail...))
+	return nil
+}
+
+func erofsWriteUnencodedFile(inode *types.ErofsInode, fd int, fpos uint64) error {
+	sbi := inode.Sbi
+	chunkbits := types.GCfg.ChunkBits
+
+	// holes can only be kept in chunk-based files, so sparse files are
+	// switched to block-sized chunks if chunks aren't enabled
+	if chunkbits == 0 && erofsKeepHoles(fd, fpos, inode.ISize) {
+		if !types.ErofsSbHasChunkedFile(sbi) {
+			if err := ErofsBlobInit(sbi); err != nil {
+				return err
+			}
+		}
+		chunkbits = sbi.BlkSzBits
+	}
+
+	if chunkbits != 0 {
+		inode.ChunkBits = chunkbits
+		// chunk indexes when explicitly specified
+		inode.ChunkFormat = 0
+		if types.GCfg.ForceChunkFormat == types.FORCE_INODE_CHUNK_INDEX {
+			inode.ChunkFormat = uint16(types.EROFS_CHUNK_FORMAT_INDEXES)
+		}
+		return ErofsBlobWriteChunkedFile(inode, fd, fpos)
+	}
+
+	// fallback to all data uncompressed
+	if _, err := syscall.Seek(fd, int64(fpos), types.SEEK_SET); err != nil {
+		return err
+	}
+	return types.WriteUncompressedFileFromFd(inode, fd)
+}
+
+// erofsKeepHoles tells if the file at fd should be written as a sparse one
+func erofsKeepHoles(fd int, fpos, size uint64) bool {
+	switch types.GCfg.DataImportMode {
+	case types.EROFS_MKFS_DATA_IMPORT_FULLDATA:
+		return false
+	case types.EROFS_MKFS_DATA_IMPORT_SPARSE:
+		// zeroed blocks are turned into holes as well
+		return size != 0
+	}
+	return erofsFileIsSparse(fd, fpos, size)
+}
+
+// ErofsWriteFile writes the data of a regular file read from fd at fpos.
+// Compressed layouts aren't wired up yet, so data is stored unencoded.
+// Holes are only kept by chunk-based layouts, which can't be compressed,
+// so sparse files are refused once compression is explicitly requested.
+func ErofsWriteFile(inode *types.ErofsInode, fd int, fpos uint64) error {
+	if inode.ISize == 0 {
+		return nil
+	}
+	if types.GCfg.CompressionRequested && types.ErofsFileIsCompressible(inode) &&
+		erofsKeepHoles(fd, fpos, inode.ISize) {
+		types.Error("compressing sparse file %s is unsupported, use --clean=data to fill in its holes",
+			inode.ISrcpath)
+		return syscall.Errno(errs.EOPNOTSUPP)
+	}
+	return erofsWriteUnencodedFile(inode, fd, fpos)
+}
+
+func erofsPrepareDirFile(dir *types.ErofsInode, nrSubdirs int) error {
+	sbi := dir.Sbi
+	blksiz := types.ErofsBlkSiz(sbi)
+
+	// dot is pointed to the current dir inode
+	d := types.ErofsDAlloc(dir, ".")
+	d.Entry = types.ErofsIgrab(dir)
+	d.Type = types.EROFS_FT_DIR
+
+	// dotdot is pointed to the parent dir
+	d = types.ErofsDAlloc(dir, "..")
+	d.Entry = types.ErofsIgrab(dir.IParent)
+	d.Type = types.EROFS_FT_DIR
+
+	// sort subdirs
+	sorted := make([]*types.ErofsDentry, 0, nrSubdirs+2)
+	for pos := dir.ISubdirs.Next; pos != &dir.ISubdirs; {
+		n := pos.Next
+		types.ListDel(pos)
+		sorted = append(sorted, types.ErofsDentryFromList(pos))
+		pos = n
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	for _, d := range sorted {
+		types.ListAddTail(&d.DChild, &dir.ISubdirs)
+	}
+
+	// let's calculate dir size
+	var dSize uint32
+	for _, d := range sorted {
+		l := uint32(len(d.Name)) + types.EROFS_DIRENT_SIZE
+
+		if dSize%blksiz+l > blksiz {
+			dSize = types.Round_Up(dSize, blksiz)
+		}
+		dSize += l
+	}
+	dir.ISize = uint64(dSize)
+
+	// no compression support for dirs for now
+	dir.DataLayout = types.EROFS_INODE_FLAT_INLINE
+
+	// it will be used in ErofsPrepareInodeBuffer
+	dir.IdataSize = uint16(dSize % blksiz)
+	return nil
+}
+
+func erofsDInvalidate(d *types.ErofsDentry) {
+	inode := d.Entry.(*types.ErofsInode)
+
+	d.Entry = types.ErofsLookupNid(inode)
+	d.ValidNid = true
+	types.ErofsIput(inode)
+}
+
+func fillDirblock(buf []byte, q uint32, dentries []*types.ErofsDentry) {
+	var p uint32
+
+	// write out all erofs_dirents + filenames
+	for _, d := range dentries {
+		binary.LittleEndian.PutUint64(buf[p:], d.Entry.(uint64))
+		binary.LittleEndian.PutUint16(buf[p+8:], uint16(q))
+		buf[p+10] = d.Type
+		buf[p+11] = 0
+		copy(buf[q:], d.Name)
+		p += types.EROFS_DIRENT_SIZE
+		q += uint32(len(d.Name))
+	}
+	clear(buf[q:])
+}
+
+func erofsWriteDirFile(dir *types.ErofsInode) error {
+	sbi := dir.Sbi
+	blksiz := types.ErofsBlkSiz(sbi)
+	var q, used, blkno uint32
+	var head []*types.ErofsDentry
+
+	// allocate dir main data
+	if err := types.ErofsAllocateInodeBhData(dir, uint32(dir.ISize>>sbi.BlkSzBits)); err != nil {
+		return err
+	}
+
+	for pos := dir.ISubdirs.Next; pos != &dir.ISubdirs; pos = pos.Next {
+		d := types.ErofsDentryFromList(pos)
+		l := uint32(len(d.Name)) + types.EROFS_DIRENT_SIZE
+
+		erofsDInvalidate(d)
+		if used+l > blksiz {
+			buf := make([]byte, blksiz)
+			fillDirblock(buf, q, head)
+			if ret := types.ErofsBlkWrite(sbi, buf, dir.IBlkaddr+blkno, 1); ret != 0 {
+				return syscall.Errno(-ret)
+			}
+			head = nil
+			q, used = 0, 0
+			blkno++
+		}
+		head = append(head, d)
+		used += l
+		q += types.EROFS_DIRENT_SIZE
+	}
+
+	if used == blksiz {
+		buf := make([]byte, blksiz)
+		fillDirblock(buf, q, head)
+		if ret := types.ErofsBlkWrite(sbi, buf, dir.IBlkaddr+blkno, 1); ret != 0 {
+			return syscall.Errno(-ret)
+		}
+		return nil
+	}
+
+	if used != 0 {
+		// fill tail-end dir block
+		buf := make([]byte, used)
+		fillDirblock(buf, q, head)
+		erofsSetIdata(dir, buf)
+	}
+	return nil
+}
+
+// erofsFixupMetaBlkaddr makes sure that the root nid fits in 16 bits
+func erofsFixupMetaBlkaddr(rootdir *types.ErofsInode) {
+	const rootnidMaxoffset = uint64(0xffff) << types.EROFSISLOTBITS
+	sbi := rootdir.Sbi
+	var metaOffset uint64
+
+	types.MapBh(nil, rootdir.Bh.Block)
+	off := types.BhTell(rootdir.Bh, false)
+
+	if off > rootnidMaxoffset {
+		metaOffset = types.RoundUp(off-rootnidMaxoffset, uint64(types.ErofsBlkSiz(sbi)))
+	}
+	sbi.MetaBlkAddr = uint32(metaOffset >> sbi.BlkSzBits)
+	rootdir.Nid = (off - metaOffset) >> types.EROFSISLOTBITS
+}
+
+// erofsIsWhiteoutPath tells if the file at path is an overlayfs whiteout
+func erofsIsWhiteoutPath(path string) bool {
+	var st syscall.Stat_t
+
+	return syscall.Lstat(path, &st) == nil &&
+		st.Mode&syscall.S_IFMT == syscall.S_IFCHR && st.Rdev == 0
+}
+
+func erofsIgetFromPath(sbi *types.SuperBlkInfo, path string) (*types.ErofsInode, error) {
+	var st syscall.Stat_t
+
+	if err := syscall.Lstat(path, &st); err != nil {
+		return nil, err
+	}
+
+	// lookup in hash table first, if it already exists we have a
+	// hard-link, just return it. Also don't lookup for directories
+	// since hard-link directory isn't allowed.
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR && !types.GCfg.HardDereference {
+		if inode := types.ErofsIget(uint32(st.Dev), st.Ino); inode != nil {
+			return inode, erofsManifestApply(inode, path)
+		}
+	}
+
+	// cannot find in the inode cache
+	inode := types.ErofsNewInode(sbi)
+	if err := types.ErofsFillInode(inode, &st, path); err != nil {
+		return nil, err
+	}
+	if err := erofsManifestApply(inode, path); err != nil {
+		return nil, err
+	}
+	return inode, nil
+}
+
+func erofsMkfsHandleNondirectory(inode *types.ErofsInode) error {
+	switch {
+	case inode.IsLnk():
+		link := inode.ILink
+		if link == "" {
+			var err error
+
+			if link, err = os.Readlink(inode.ISrcpath); err != nil {
+				return err
+			}
+		}
+		inode.ISize = uint64(len(link))
+		if err := ErofsWriteFileFromBuffer(inode, []byte(link)); err != nil {
+			return err
+		}
+	case inode.IsReg() && inode.DataLayout == types.EROFS_INODE_CHUNK_BASED:
+		// data is mapped in place already, e.g. into a tar archive
+	case inode.IsReg() && inode.ISize != 0:
+		if inode.DataSource == types.EROFS_INODE_DATA_SOURCE_DISKBUF {
+			fd, fpos := types.ErofsDiskbufGetfd(inode.IDiskbuf)
+			if fd < 0 {
+				return syscall.Errno(errs.EBADF)
+			}
+			if err := ErofsWriteFile(inode, fd, fpos); err != nil {
+				return err
+			}
+			break
+		}
+
+		fd, err := syscall.Open(inode.ISrcpath, syscall.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		err = ErofsWriteFile(inode, fd, 0)
+		syscall.Close(fd)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := ErofsPrepareInodeBuffer(inode); err != nil {
+		return err
+	}
+	return ErofsWriteTailEnd(inode)
+}
+
+// erofsMkfsBuildTree prepares the metadata of dir. Unless rebuilding an
+// in-memory tree, subdirs are read from the source directory.
+func erofsMkfsBuildTree(dir *types.ErofsInode, dirs *[]*types.ErofsInode, rebuild bool) error {
+	if !rebuild {
+		if err := ErofsScanFileXattrs(dir); err != nil {
+			return err
+		}
+	}
+	if dir.Opaque && !types.GCfg.OvlfsStrip {
+		if err := erofsSetOpaqueXattr(dir); err != nil {
+			return err
+		}
+	}
+	if err := ErofsPrepareXattrIbody(dir); err != nil {
+		return err
+	}
+
+	if !dir.IsDir() {
+		return erofsMkfsHandleNondirectory(dir)
+	}
+
+	var nrSubdirs int
+	if rebuild {
+		for pos := dir.ISubdirs.Next; pos != &dir.ISubdirs; {
+			next := pos.Next
+			inode := types.ErofsDentryFromList(pos).Entry.(*types.ErofsInode)
+
+			// whiteouts are dropped along with their dentries
+			if types.GCfg.OvlfsStrip && inode.IsWhiteout() {
+				types.ListDel(pos)
+				types.ErofsIput(inode)
+			} else {
+				nrSubdirs++
+			}
+			pos = next
+		}
+	} else {
+		f, err := os.Open(dir.ISrcpath)
+		if err != nil {
+			return fmt.Errorf("failed to opendir at %s: %w", dir.ISrcpath, err)
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if isDotDotdot(name) {
+				continue
+			}
+			if types.GCfg.OvlfsStrip && erofsIsWhiteoutPath(filepath.Join(dir.ISrcpath, name)) {
+				continue
+			}
+			types.ErofsDAlloc(dir, name)
+			nrSubdirs++
+		}
+	}
+
+	if err := erofsPrepareDirFile(dir, nrSubdirs); err != nil {
+		return err
+	}
+	if err := ErofsPrepareInodeBuffer(dir); err != nil {
+		return err
+	}
+	dir.Bh.Op = types.SkipWriteOps
+
+	if types.IS_ROOT(dir) {
+		erofsFixupMetaBlkaddr(dir)
+	}
+
+	var iNlink uint32
+	for pos := dir.ISubdirs.Next; pos != &dir.ISubdirs; pos = pos.Next {
+		d := types.ErofsDentryFromList(pos)
+
+		if isDotDotdot(d.Name) {
+			iNlink++
+			continue
+		}
+
+		var inode *types.ErofsInode
+		if rebuild {
+			inode = d.Entry.(*types.ErofsInode)
+		} else {
+			var err error
+
+			inode, err = erofsIgetFromPath(dir.Sbi, filepath.Join(dir.ISrcpath, d.Name))
+			if err != nil {
+				return err
+			}
+		}
+
+		// a hardlink to the existed inode
+		if inode.IParent != nil {
+			inode.INlink++
+		} else {
+			inode.IParent = dir
+			types.ErofsIgrab(inode)
+			*dirs = append(*dirs, inode)
+		}
+		d.Entry = inode
+		d.Type = ErofsModeToFtype(inode.IMode)
+		if d.Type == types.EROFS_FT_DIR {
+			iNlink++
+		}
+		types.Debug(types.EROFS_DBG, "file %s/%s dumped (type %d)", dir.ISrcpath, d.Name, d.Type)
+	}
+
+	// if there're too many subdirs as compact form, set nlink=1
+	// rather than upgrade to use extented form instead.
+	if iNlink > 0xffff && dir.InodeIsize == types.EROFS_INODE_COMPACT_SIZE {
+		dir.INlink = 1
+	} else {
+		dir.INlink = iNlink
+	}
+	return nil
+}
+
+func erofsMkfsDumpdir(dir *types.ErofsInode) error {
+	for dir != nil {
+		next := dir.NextDirWrite
+
+		if err := erofsWriteDirFile(dir); err != nil {
+			return err
+		}
+		if err := ErofsWriteTailEnd(dir); err != nil {
+			return err
+		}
+		dir.Bh.Op = &erofsWriteInodeBhops
+		types.ErofsIput(dir)
+		dir = next
+	}
+	return nil
+}
+
+func erofsMkfsDumpTree(root *types.ErofsInode, rebuild bool) error {
+	var dirs []*types.ErofsInode
+
+	root.IParent = root // rootdir mark
+	root.NextDirWrite = nil
+	types.ErofsIgrab(root)
+	dumpdir := root
+
+	if err := erofsMkfsBuildTree(root, &dirs, rebuild); err != nil {
+		return err
+	}
+
+	for len(dirs) != 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+
+		if err := erofsMkfsBuildTree(dir, &dirs, rebuild); err != nil {
+			return err
+		}
+
+		if dir.IsDir() {
+			dir.NextDirWrite = dumpdir
+			dumpdir = dir
+		} else {
+			types.ErofsIput(dir)
+		}
+	}
+	return erofsMkfsDumpdir(dumpdir)
+}
+
+// ErofsMkfsBuildTreeFromPath builds the whole filesystem tree from the
+// source directory and returns its root inode
+func ErofsMkfsBuildTreeFromPath(sbi *types.SuperBlkInfo, path string) (*types.ErofsInode, error) {
+	root, err := erofsIgetFromPath(sbi, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = erofsMkfsDumpTree(root, false); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// ErofsRebuildDumpTree writes out an in-memory tree built from archives
+// or other images, see ErofsRebuildMakeRoot
+func ErofsRebuildDumpTree(root *types.ErofsInode) error {
+	return erofsMkfsDumpTree(root, true)
+}
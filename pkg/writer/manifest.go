@@ -0,0 +1,266 @@
+package writer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+// attributes overridden by a manifest entry
+const (
+	manifestUid = 1 << iota
+	manifestGid
+	manifestMode
+	manifestMtime
+)
+
+// erofsManifestEntry overrides the metadata of one path of the tree
+type erofsManifestEntry struct {
+	lineno    int
+	set       uint
+	uid       uint32
+	gid       uint32
+	mode      uint16
+	mtime     uint64
+	mtimeNsec uint32
+	xattrs    []xattrPair
+	used      bool
+}
+
+var (
+	manifestFile    string
+	manifestEntries = make(map[string]*erofsManifestEntry)
+)
+
+// manifestKey turns a path of the manifest or the tree into a map key
+func manifestKey(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// manifestDecodeValue decodes an xattr value in the getfattr encodings:
+// "0x" for hex, "0s" for base64, a quoted string or plain text
+func manifestDecodeValue(v string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X"):
+		return hex.DecodeString(v[2:])
+	case strings.HasPrefix(v, "0s") || strings.HasPrefix(v, "0S"):
+		return base64.StdEncoding.DecodeString(v[2:])
+	case strings.HasPrefix(v, `"`):
+		s, err := strconv.Unquote(v)
+		return []byte(s), err
+	}
+	return []byte(v), nil
+}
+
+// manifestFields splits line into blank separated fields, keeping quoted
+// strings which may contain blanks as a part of their fields
+func manifestFields(line string) ([]string, error) {
+	var fields []string
+
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return fields, nil
+		}
+
+		i := 0
+		for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			if line[i] != '"' {
+				i++
+				continue
+			}
+			q, err := strconv.QuotedPrefix(line[i:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted string %q", line[i:])
+			}
+			i += len(q)
+		}
+		fields = append(fields, line[:i])
+		line = line[i:]
+	}
+}
+
+func manifestParseLine(line string) (string, *erofsManifestEntry, error) {
+	fields, err := manifestFields(line)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// the path may be quoted if it contains blanks
+	p := fields[0]
+	if strings.HasPrefix(p, `"`) {
+		if p, err = strconv.Unquote(p); err != nil {
+			return "", nil, fmt.Errorf("invalid path %q", fields[0])
+		}
+	}
+
+	ent := &erofsManifestEntry{}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return "", nil, fmt.Errorf("invalid attribute %q", field)
+		}
+
+		switch {
+		case key == "uid" || key == "gid":
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid %s %q", key, value)
+			}
+			if key == "uid" {
+				ent.uid = uint32(id)
+				ent.set |= manifestUid
+			} else {
+				ent.gid = uint32(id)
+				ent.set |= manifestGid
+			}
+		case key == "mode":
+			mode, err := strconv.ParseUint(value, 8, 16)
+			if err != nil || mode&^07777 != 0 {
+				return "", nil, fmt.Errorf("invalid mode %q", value)
+			}
+			ent.mode = uint16(mode)
+			ent.set |= manifestMode
+		case key == "mtime":
+			sec, nsec, _ := strings.Cut(value, ".")
+			s, err := strconv.ParseUint(sec, 10, 64)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid mtime %q", value)
+			}
+			ent.mtime = s
+			if nsec != "" {
+				ns, err := strconv.ParseUint((nsec + "000000000")[:9], 10, 32)
+				if err != nil {
+					return "", nil, fmt.Errorf("invalid mtime %q", value)
+				}
+				ent.mtimeNsec = uint32(ns)
+			}
+			ent.set |= manifestMtime
+		case strings.HasPrefix(key, "xattr."):
+			name := key[len("xattr."):]
+			if _, _, ok := matchPrefix(name); !ok {
+				return "", nil, fmt.Errorf("unsupported xattr %q", name)
+			}
+			v, err := manifestDecodeValue(value)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid value of xattr %q: %w", name, err)
+			}
+			ent.xattrs = append(ent.xattrs, xattrPair{key: name, value: v})
+		default:
+			return "", nil, fmt.Errorf("unknown attribute %q", key)
+		}
+	}
+	return p, ent, nil
+}
+
+// ErofsLoadManifest loads a metadata override manifest. Each line is a
+// path relative to the image root followed by the attributes to set:
+//
+//	/usr/bin/ping uid=0 gid=0 mode=4755 mtime=1700000000 xattr.security.capability=0x...
+func ErofsLoadManifest(fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		p, ent, err := manifestParseLine(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", fn, lineno, err)
+		}
+		ent.lineno = lineno
+
+		key := manifestKey(p)
+		if old, ok := manifestEntries[key]; ok {
+			return fmt.Errorf("%s:%d: %s is already listed at line %d", fn, lineno, p, old.lineno)
+		}
+		manifestEntries[key] = ent
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	manifestFile = fn
+	return nil
+}
+
+// erofsManifestApply overrides the attributes of inode found at srcpath
+// once it has been filled from the source file
+func erofsManifestApply(inode *types.ErofsInode, srcpath string) error {
+	ent, ok := manifestEntries[manifestKey(types.ErofsFspath(srcpath))]
+	if !ok {
+		return nil
+	}
+	ent.used = true
+
+	// xattrs are collected per inode, which are only scanned once
+	if len(ent.xattrs) != 0 && inode.ISrcpath != srcpath {
+		return fmt.Errorf("%s:%d: xattrs of hardlink %s should be set on %s",
+			manifestFile, ent.lineno, types.ErofsFspath(srcpath), types.ErofsFspath(inode.ISrcpath))
+	}
+
+	if ent.set&manifestUid != 0 {
+		inode.IUid = ent.uid
+	}
+	if ent.set&manifestGid != 0 {
+		inode.IGid = ent.gid
+	}
+	if ent.set&manifestMode != 0 {
+		inode.IMode = inode.IMode&types.S_IFMT | ent.mode
+	}
+	if ent.set&manifestMtime != 0 {
+		inode.IMtime = ent.mtime
+		inode.IMtimeNsec = ent.mtimeNsec
+	}
+	return types.ErofsSetInodeIsize(inode)
+}
+
+// erofsManifestApplyXattrs sets the manifest xattrs of inode, replacing
+// those of the source file with the same names
+func erofsManifestApplyXattrs(inode *types.ErofsInode) error {
+	ent, ok := manifestEntries[manifestKey(types.ErofsFspath(inode.ISrcpath))]
+	if !ok {
+		return nil
+	}
+
+	for _, x := range ent.xattrs {
+		if err := erofsSetxattr(inode, x.key, x.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErofsManifestCheckUnused reports manifest entries which match nothing
+// in the source tree
+func ErofsManifestCheckUnused() error {
+	var unused []string
+
+	for key, ent := range manifestEntries {
+		if !ent.used {
+			unused = append(unused, fmt.Sprintf("%s:%d: /%s", manifestFile, ent.lineno, key))
+		}
+	}
+	if len(unused) == 0 {
+		return nil
+	}
+	sort.Strings(unused)
+	for _, s := range unused {
+		types.Error("%s not found in the source tree", s)
+	}
+	return fmt.Errorf("%d manifest entries not found in the source tree", len(unused))
+}
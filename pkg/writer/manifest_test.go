@@ -0,0 +1,126 @@
+package writer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+// manifestTestLoad loads the manifest text, dropping it once the test ends
+func manifestTestLoad(t *testing.T, manifest string) error {
+	t.Helper()
+
+	fn := filepath.Join(t.TempDir(), "manifest")
+	if err := os.WriteFile(fn, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		manifestEntries = make(map[string]*erofsManifestEntry)
+		manifestFile = ""
+	})
+	return ErofsLoadManifest(fn)
+}
+
+// manifestTestInode returns a regular file inode as filled from srcpath
+func manifestTestInode(srcpath string) *types.ErofsInode {
+	inode := types.ErofsNewInode(&types.GSbi)
+	inode.ISrcpath = srcpath
+	inode.IMode = types.S_IFREG | 0644
+	inode.IUid, inode.IGid = 1000, 1000
+	inode.IMtime = 1700000000
+	return inode
+}
+
+func TestErofsManifestApply(t *testing.T) {
+	const manifest = `# path attributes...
+/usr/bin/ping uid=0 gid=0 mode=4755 mtime=1600000000.5 xattr.security.capability=0x0100000200200000
+usr/lib/libc.so mode=0600 xattr.user.comment="a b"
+"/etc/space file" uid=42 xattr.trusted.data=0sAAEC
+/usr/share/missing mode=0644
+`
+	types.ErofsSetFsRoot("/")
+	types.GCfg.DebugLevel = types.EROFS_ERR
+	if err := manifestTestLoad(t, manifest); err != nil {
+		t.Fatalf("ErofsLoadManifest() = %v", err)
+	}
+
+	tests := []struct {
+		path      string
+		uid, gid  uint32
+		mode      uint16
+		mtime     uint64
+		mtimeNsec uint32
+		xattr     string
+		value     []byte
+	}{
+		{"/usr/bin/ping", 0, 0, types.S_IFREG | 04755, 1600000000, 500000000,
+			"capability", []byte{1, 0, 0, 2, 0, 0x20, 0, 0}},
+		{"/usr/lib/libc.so", 1000, 1000, types.S_IFREG | 0600, 1700000000, 0,
+			"comment", []byte("a b")},
+		{"/etc/space file", 42, 1000, types.S_IFREG | 0644, 1700000000, 0,
+			"data", []byte{0, 1, 2}},
+		{"/usr/bin/ls", 1000, 1000, types.S_IFREG | 0644, 1700000000, 0, "", nil},
+	}
+
+	for _, tt := range tests {
+		inode := manifestTestInode(tt.path)
+		if err := erofsManifestApply(inode, tt.path); err != nil {
+			t.Fatalf("%s: erofsManifestApply() = %v", tt.path, err)
+		}
+		if err := erofsManifestApplyXattrs(inode); err != nil {
+			t.Fatalf("%s: erofsManifestApplyXattrs() = %v", tt.path, err)
+		}
+		if inode.IUid != tt.uid || inode.IGid != tt.gid || inode.IMode != tt.mode ||
+			inode.IMtime != tt.mtime || inode.IMtimeNsec != tt.mtimeNsec {
+			t.Errorf("%s: uid %d gid %d mode %#o mtime %d.%09d, want %d %d %#o %d.%09d",
+				tt.path, inode.IUid, inode.IGid, inode.IMode, inode.IMtime, inode.IMtimeNsec,
+				tt.uid, tt.gid, tt.mode, tt.mtime, tt.mtimeNsec)
+		}
+
+		var value []byte
+		for pos := inode.IXattrs.Next; pos != &inode.IXattrs; pos = pos.Next {
+			item := inodeXattrNodeFromList(pos).item
+			if string(item.kvbuf[:item.len[0]]) == tt.xattr {
+				value = item.kvbuf[item.len[0]:]
+			}
+		}
+		if !bytes.Equal(value, tt.value) {
+			t.Errorf("%s: xattr %q = %x, want %x", tt.path, tt.xattr, value, tt.value)
+		}
+	}
+
+	// the entry naming a path missing from the tree fails the build
+	err := ErofsManifestCheckUnused()
+	if err == nil || !strings.HasPrefix(err.Error(), "1 manifest entries") {
+		t.Fatalf("ErofsManifestCheckUnused() = %v, want 1 unused entry", err)
+	}
+}
+
+func TestErofsLoadManifestMalformed(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+	}{
+		{"unknown attribute", "/bin/sh owner=root\n"},
+		{"missing value", "/bin/sh uid\n"},
+		{"invalid uid", "/bin/sh uid=-1\n"},
+		{"file type in mode", "/bin/sh mode=100755\n"},
+		{"invalid mtime", "/bin/sh mtime=yesterday\n"},
+		{"unsupported xattr", "/bin/sh xattr.system.foo=1\n"},
+		{"invalid hex value", "/bin/sh xattr.user.foo=0xzz\n"},
+		{"unterminated quote", "\"/bin/sh uid=0\n"},
+		{"duplicate path", "/bin/sh uid=0\nbin//sh gid=0\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := manifestTestLoad(t, tt.manifest); err == nil {
+				t.Fatal("ErofsLoadManifest() succeeded, want an error")
+			}
+		})
+	}
+}
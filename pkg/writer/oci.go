@@ -0,0 +1,220 @@
+package writer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+// media types of OCI image layouts, docker ones are accepted as well
+const (
+	ociMediaTypeIndex          = "application/vnd.oci.image.index.v1+json"
+	ociMediaTypeManifest       = "application/vnd.oci.image.manifest.v1+json"
+	dockerMediaTypeManifestLst = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerMediaTypeManifest    = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+type ociPlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type ociDescriptor struct {
+	MediaType string       `json:"mediaType"`
+	Digest    string       `json:"digest"`
+	Size      int64        `json:"size"`
+	Platform  *ociPlatform `json:"platform,omitempty"`
+}
+
+// ociIndex is index.json or a nested image index
+type ociIndex struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// erofsOciBlobPath returns the path of the blob with digest in layout
+func erofsOciBlobPath(layout, digest string) (string, error) {
+	alg, encoded, ok := strings.Cut(digest, ":")
+	if !ok || alg != "sha256" || len(encoded) != 2*sha256.Size {
+		types.Error("unsupported digest %s", digest)
+		return "", syscall.Errno(errs.EOPNOTSUPP)
+	}
+	if _, err := hex.DecodeString(encoded); err != nil {
+		types.Error("invalid digest %s", digest)
+		return "", syscall.Errno(errs.EINVAL)
+	}
+	return filepath.Join(layout, "blobs", alg, encoded), nil
+}
+
+// erofsOciReadJSON decodes the JSON blob of desc after verifying it
+func erofsOciReadJSON(layout string, desc *ociDescriptor, v interface{}) error {
+	fn, err := erofsOciBlobPath(layout, desc.Digest)
+	if err != nil {
+		return err
+	}
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(buf)
+	if err = erofsOciCheckBlob(desc, int64(len(buf)), sum[:]); err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// erofsOciCheckBlob compares the size and sha256 of a blob with desc
+func erofsOciCheckBlob(desc *ociDescriptor, size int64, sum []byte) error {
+	if size != desc.Size || "sha256:"+hex.EncodeToString(sum) != desc.Digest {
+		types.Error("blob %s is corrupted", desc.Digest)
+		return syscall.Errno(errs.EBADMSG)
+	}
+	return nil
+}
+
+// erofsOciVerifyBlob hashes the blob of desc at fn, which may be too large
+// to be read at once
+func erofsOciVerifyBlob(fn string, desc *ociDescriptor) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	return erofsOciCheckBlob(desc, size, h.Sum(nil))
+}
+
+// erofsOciParsePlatform parses "os/arch[/variant]", the platform of the
+// host is used by default
+func erofsOciParsePlatform(s string) (*ociPlatform, error) {
+	if s == "" {
+		return &ociPlatform{OS: "linux", Architecture: runtime.GOARCH}, nil
+	}
+
+	fields := strings.Split(s, "/")
+	if len(fields) < 2 || len(fields) > 3 || fields[0] == "" || fields[1] == "" {
+		types.Error("invalid platform %s", s)
+		return nil, syscall.Errno(errs.EINVAL)
+	}
+	p := &ociPlatform{OS: fields[0], Architecture: fields[1]}
+	if len(fields) == 3 {
+		p.Variant = fields[2]
+	}
+	return p, nil
+}
+
+// erofsOciMatchPlatform tells if the manifest of desc is for p, manifests
+// without a platform are taken as matched
+func erofsOciMatchPlatform(desc *ociDescriptor, p *ociPlatform) bool {
+	if desc.Platform == nil {
+		return true
+	}
+	return desc.Platform.OS == p.OS && desc.Platform.Architecture == p.Architecture &&
+		(p.Variant == "" || desc.Platform.Variant == p.Variant)
+}
+
+// erofsOciResolve finds the image manifest for p in idx, nested indexes
+// are walked as well
+func erofsOciResolve(layout string, idx *ociIndex, p *ociPlatform) (*ociManifest, error) {
+	for i := range idx.Manifests {
+		desc := &idx.Manifests[i]
+
+		if !erofsOciMatchPlatform(desc, p) {
+			continue
+		}
+		switch desc.MediaType {
+		case ociMediaTypeIndex, dockerMediaTypeManifestLst:
+			var nested ociIndex
+
+			if err := erofsOciReadJSON(layout, desc, &nested); err != nil {
+				return nil, err
+			}
+			if m, err := erofsOciResolve(layout, &nested, p); err == nil {
+				return m, nil
+			} else if err != syscall.Errno(errs.ENOENT) {
+				return nil, err
+			}
+		case ociMediaTypeManifest, dockerMediaTypeManifest:
+			var m ociManifest
+
+			if err := erofsOciReadJSON(layout, desc, &m); err != nil {
+				return nil, err
+			}
+			return &m, nil
+		default:
+			types.Debug(types.EROFS_DBG, "skipped %s of media type %s", desc.Digest, desc.MediaType)
+		}
+	}
+	return nil, syscall.Errno(errs.ENOENT)
+}
+
+// ErofsOciLayers resolves the image for platform ("os/arch[/variant]") in
+// the OCI image layout at layout and returns the paths of its layer blobs
+// from the bottom one
+func ErofsOciLayers(layout, platform string) ([]string, error) {
+	p, err := erofsOciParsePlatform(platform)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(filepath.Join(layout, "oci-layout")); err != nil {
+		types.Error("%s isn't an OCI image layout", layout)
+		return nil, err
+	}
+
+	buf, err := os.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var idx ociIndex
+	if err = json.Unmarshal(buf, &idx); err != nil {
+		types.Error("failed to parse index.json of %s: %s", layout, err)
+		return nil, syscall.Errno(errs.EBADMSG)
+	}
+
+	m, err := erofsOciResolve(layout, &idx, p)
+	if err != nil {
+		if err == syscall.Errno(errs.ENOENT) {
+			types.Error("no image for %s/%s in %s", p.OS, p.Architecture, layout)
+		}
+		return nil, err
+	}
+
+	layers := make([]string, 0, len(m.Layers))
+	for _, l := range m.Layers {
+		// layers are decompressed by the tar reader, except for zstd
+		if strings.HasSuffix(l.MediaType, "zstd") {
+			types.Error("zstd-compressed layer %s isn't supported", l.Digest)
+			return nil, syscall.Errno(errs.EOPNOTSUPP)
+		}
+		fn, err := erofsOciBlobPath(layout, l.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if err = erofsOciVerifyBlob(fn, &l); err != nil {
+			return nil, err
+		}
+		layers = append(layers, fn)
+	}
+	return layers, nil
+}
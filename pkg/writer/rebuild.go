@@ -0,0 +1,484 @@
+package writer
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/util"
+)
+
+// erofsRebuildNewInode allocates an inode of an in-memory tree with the
+// attributes in st. srcpath is the absolute path in the new filesystem.
+func erofsRebuildNewInode(sbi *types.SuperBlkInfo, st *syscall.Stat_t, srcpath string) (*types.ErofsInode, error) {
+	inode := types.ErofsNewInode(sbi)
+
+	if err := types.ErofsFillInode(inode, st, srcpath); err != nil {
+		return nil, err
+	}
+	if err := erofsManifestApply(inode, srcpath); err != nil {
+		return nil, err
+	}
+	return inode, nil
+}
+
+// erofsRebuildMkdir creates a directory which is implied by the path of
+// another entry, owned by the current user
+func erofsRebuildMkdir(sbi *types.SuperBlkInfo, srcpath string) (*types.ErofsInode, error) {
+	st := syscall.Stat_t{
+		Mode: syscall.S_IFDIR | 0755,
+		Uid:  uint32(syscall.Getuid()),
+		Gid:  uint32(syscall.Getgid()),
+		Mtim: syscall.Timespec{Sec: int64(sbi.BuildTime), Nsec: int64(sbi.BuildTimeNsec)},
+	}
+	return erofsRebuildNewInode(sbi, &st, srcpath)
+}
+
+// ErofsRebuildMakeRoot creates an empty root directory for trees which
+// are built in memory, e.g. from tar archives
+func ErofsRebuildMakeRoot(sbi *types.SuperBlkInfo) (*types.ErofsInode, error) {
+	st := syscall.Stat_t{
+		Mode: syscall.S_IFDIR | 0777,
+		Mtim: syscall.Timespec{Sec: int64(sbi.BuildTime), Nsec: int64(sbi.BuildTimeNsec)},
+	}
+	root, err := erofsRebuildNewInode(sbi, &st, "/")
+	if err != nil {
+		return nil, err
+	}
+	root.IParent = root
+	return root, nil
+}
+
+// erofsRebuildApplyXattrs sets the xattrs given by selinux labels,
+// capabilities and the manifest, which are kept on top of the ones of the
+// archive member
+func erofsRebuildApplyXattrs(inode *types.ErofsInode) error {
+	if types.GCfg.InlineXattrTolerance < 0 {
+		return nil
+	}
+
+	item, err := erofsGetSelabelXattr(inode.ISrcpath, inode.IMode)
+	if err != nil {
+		return err
+	}
+	if item != nil {
+		erofsInodeXattrDel(&inode.IXattrs, "security.selinux")
+		inodeXattrAdd(&inode.IXattrs, item)
+	}
+	if err = erofsDroidXattrSetCaps(inode); err != nil {
+		return err
+	}
+	return erofsManifestApplyXattrs(inode)
+}
+
+// erofsDLookup finds the dentry called name in dir
+func erofsDLookup(dir *types.ErofsInode, name string) *types.ErofsDentry {
+	for pos := dir.ISubdirs.Next; pos != &dir.ISubdirs; pos = pos.Next {
+		if d := types.ErofsDentryFromList(pos); d.Name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// erofsRebuildPath turns an archive member name into a path relative to
+// the root, "" stands for the root itself
+func erofsRebuildPath(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// erofsRebuildLookup returns the inode at relpath of the tree, or nil
+func erofsRebuildLookup(root *types.ErofsInode, relpath string) *types.ErofsInode {
+	inode := root
+
+	for _, name := range strings.Split(relpath, "/") {
+		if name == "" {
+			continue
+		}
+		if !inode.IsDir() {
+			return nil
+		}
+		d := erofsDLookup(inode, name)
+		if d == nil || d.Entry == nil {
+			return nil
+		}
+		inode = d.Entry.(*types.ErofsInode)
+	}
+	return inode
+}
+
+// erofsRebuildDelDentry unlinks d from its directory and releases the
+// subtree under it
+func erofsRebuildDelDentry(d *types.ErofsDentry) {
+	types.ListDel(&d.DChild)
+	if d.Entry == nil {
+		return
+	}
+
+	erofsRebuildPutEntry(d.Entry.(*types.ErofsInode))
+}
+
+// erofsRebuildPutEntry releases the inode of a dentry being replaced or
+// removed, together with the subtree under it if it's a directory
+func erofsRebuildPutEntry(inode *types.ErofsInode) {
+	if inode.IsDir() {
+		for pos := inode.ISubdirs.Next; pos != &inode.ISubdirs; {
+			next := pos.Next
+			erofsRebuildDelDentry(types.ErofsDentryFromList(pos))
+			pos = next
+		}
+	}
+	types.ErofsIput(inode)
+}
+
+// erofsRebuildGetDir returns the directory at relpath, which is created
+// with its missing parents if it doesn't exist
+func erofsRebuildGetDir(root *types.ErofsInode, relpath string) (*types.ErofsInode, error) {
+	relpath = erofsRebuildPath(relpath)
+	if relpath == "" {
+		return root, nil
+	}
+
+	d, err := erofsRebuildGetDentry(root, relpath)
+	if err != nil {
+		return nil, err
+	}
+	if d.Entry == nil {
+		dir, err := erofsRebuildMkdir(root.Sbi, "/"+relpath)
+		if err != nil {
+			return nil, err
+		}
+		d.Entry = dir
+	}
+
+	dir := d.Entry.(*types.ErofsInode)
+	if !dir.IsDir() {
+		types.Error("%s is not a directory", relpath)
+		return nil, syscall.Errno(errs.ENOTDIR)
+	}
+	return dir, nil
+}
+
+// erofsRebuildSetInode places a file with the attributes in st at relpath,
+// replacing the existing one. Directories listed more than once are
+// updated in place to keep their children.
+func erofsRebuildSetInode(root *types.ErofsInode, relpath string, st *syscall.Stat_t) (*types.ErofsInode, error) {
+	var d *types.ErofsDentry
+	var inode *types.ErofsInode
+	var err error
+
+	srcpath := "/" + relpath
+	if relpath == "" {
+		// attributes of the root directory
+		if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			return nil, syscall.Errno(errs.ENOTDIR)
+		}
+		inode = root
+	} else {
+		if d, err = erofsRebuildGetDentry(root, relpath); err != nil {
+			return nil, err
+		}
+		if d.Entry != nil {
+			old := d.Entry.(*types.ErofsInode)
+
+			if old.IsDir() && st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+				inode = old
+			} else {
+				erofsRebuildPutEntry(old)
+				d.Entry = nil
+			}
+		}
+	}
+
+	if inode == nil {
+		if inode, err = erofsRebuildNewInode(root.Sbi, st, srcpath); err != nil {
+			return nil, err
+		}
+		d.Entry = inode
+		return inode, nil
+	}
+
+	types.ListDel(&inode.IHash)
+	types.InitListHead(&inode.IXattrs)
+	if err = types.ErofsFillInode(inode, st, srcpath); err != nil {
+		return nil, err
+	}
+	if err = erofsManifestApply(inode, srcpath); err != nil {
+		return nil, err
+	}
+	return inode, nil
+}
+
+// erofsRebuildLink makes relpath a hardlink to target
+func erofsRebuildLink(root *types.ErofsInode, relpath string, target *types.ErofsInode) error {
+	d, err := erofsRebuildGetDentry(root, relpath)
+	if err != nil {
+		return err
+	}
+	// target may be under the subtree being replaced
+	entry := types.ErofsIgrab(target)
+	if d.Entry != nil {
+		erofsRebuildPutEntry(d.Entry.(*types.ErofsInode))
+	}
+	d.Entry = entry
+	return erofsManifestApply(target, "/"+relpath)
+}
+
+// erofsRebuildGetDentry walks relpath from pwd and returns the dentry of
+// its last component, which is allocated with a nil entry if it doesn't
+// exist. Missing intermediate directories are created on the way.
+func erofsRebuildGetDentry(pwd *types.ErofsInode, relpath string) (*types.ErofsDentry, error) {
+	var d *types.ErofsDentry
+
+	names := strings.Split(relpath, "/")
+	for i, name := range names {
+		if len(name) > types.EROFS_NAME_LEN {
+			types.Error("filename %s is too long in %s", name, relpath)
+			return nil, syscall.Errno(errs.ENAMETOOLONG)
+		}
+
+		if d = erofsDLookup(pwd, name); d == nil {
+			d = types.ErofsDAlloc(pwd, name)
+		}
+		if i == len(names)-1 {
+			break
+		}
+
+		if d.Entry == nil {
+			dir, err := erofsRebuildMkdir(pwd.Sbi, "/"+strings.Join(names[:i+1], "/"))
+			if err != nil {
+				return nil, err
+			}
+			d.Entry = dir
+		}
+		pwd = d.Entry.(*types.ErofsInode)
+		if !pwd.IsDir() {
+			types.Error("%s is not a directory in %s", name, relpath)
+			return nil, syscall.Errno(errs.ENOTDIR)
+		}
+	}
+	return d, nil
+}
+
+// erofsRebuildSrc is an image being merged into the tree
+type erofsRebuildSrc struct {
+	sbi *types.SuperBlkInfo
+
+	// file data is mapped to the image as this extra device if non-zero,
+	// otherwise it's imported
+	deviceID uint16
+
+	// inodes with more than one link loaded so far, keyed by their nids
+	links map[uint64]*types.ErofsInode
+
+	// flat file data is referenced right in the image when imported
+	strm *types.ErofsDiskBufStrm
+}
+
+// erofsInodeReader reads the data of an inode in an image sequentially
+type erofsInodeReader struct {
+	inode *types.ErofsInode
+	pos   uint64
+}
+
+func (r *erofsInodeReader) Read(p []byte) (int, error) {
+	if r.pos >= r.inode.ISize {
+		return 0, io.EOF
+	}
+	n := min(uint64(len(p)), r.inode.ISize-r.pos)
+	if err := types.ErofsPread(r.inode, p[:n], r.pos); err != nil {
+		return 0, err
+	}
+	r.pos += n
+	return int(n), nil
+}
+
+// ErofsRebuildOpen opens the image at path as a source of the tree
+func ErofsRebuildOpen(path string) (*types.SuperBlkInfo, error) {
+	sbi := &types.SuperBlkInfo{BDev: &types.ErofsVFile{}}
+
+	if err := util.DevOpen(sbi, path, os.O_RDONLY); err != nil {
+		return nil, err
+	}
+	if err := types.ErofsReadSuperblock(sbi); err != nil {
+		types.Error("failed to read superblock of %s: %s", path, err)
+		return nil, err
+	}
+	return sbi, nil
+}
+
+// ErofsRebuildInitDevices sets up the source images as the extra devices
+// of sbi, to which file data is mapped instead of being imported
+func ErofsRebuildInitDevices(sbi *types.SuperBlkInfo, srcs []*types.SuperBlkInfo) error {
+	if sbi.ExtraDevices != 0 {
+		types.Error("extra devices can't be used along with source images")
+		return syscall.Errno(errs.EINVAL)
+	}
+	if len(srcs) > len(sbi.BlobFd) {
+		return syscall.Errno(errs.E2BIG)
+	}
+
+	sbi.Devs = make([]types.DeviceInfo, len(srcs))
+	for i, src := range srcs {
+		if src.BlkSzBits != sbi.BlkSzBits {
+			types.Error("block size of %s differs from the one of the image", src.DevName)
+			return syscall.Errno(errs.EINVAL)
+		}
+		if src.ExtraDevices != 0 {
+			types.Error("%s with extra devices can't be used as a device", src.DevName)
+			return syscall.Errno(errs.EOPNOTSUPP)
+		}
+		sbi.BlobFd[i] = uint32(src.BDev.Fd)
+		sbi.Devs[i].Blocks = uint32(src.PrimaryDeviceBlocks)
+	}
+	sbi.NBlobs = uint32(len(srcs))
+	return erofsReserveDeviceTable(sbi)
+}
+
+// erofsRebuildSetData sets up the data of a regular file loaded from vi
+func erofsRebuildSetData(src *erofsRebuildSrc, inode, vi *types.ErofsInode) error {
+	sbi := src.sbi
+	if inode.ISize == 0 {
+		return nil
+	}
+
+	switch {
+	case vi.DataLayout == types.EROFS_INODE_FLAT_PLAIN && src.deviceID != 0:
+		return erofsBlobMapChunks(inode, src.deviceID, types.ErofsPos(sbi, uint64(vi.IBlkaddr)))
+	case vi.DataLayout == types.EROFS_INODE_FLAT_PLAIN:
+		src.strm.TailOffset = types.ErofsPos(sbi, uint64(vi.IBlkaddr))
+		inode.IDiskbuf = &types.ErofsDiskbuf{}
+		types.ErofsDiskbufReserve(inode.IDiskbuf, src.strm)
+		types.ErofsDiskbufCommit(inode.IDiskbuf, inode.ISize)
+		inode.DataSource = types.EROFS_INODE_DATA_SOURCE_DISKBUF
+		return nil
+	}
+
+	// e.g. inline tails can't be mapped, so the data is imported
+	if src.deviceID != 0 {
+		types.Debug(types.EROFS_DBG, "data of %s is imported as it can't be mapped", inode.ISrcpath)
+	}
+	ios := erofsIostream{r: bufio.NewReaderSize(&erofsInodeReader{inode: vi}, 1<<16)}
+	return erofsIostreamFileData(&ios, nil, inode)
+}
+
+// erofsRebuildLoadInode merges the file vi of an image at relpath
+func erofsRebuildLoadInode(root *types.ErofsInode, src *erofsRebuildSrc, relpath string, vi *types.ErofsInode) error {
+	if err := types.ErofsReadInodeFromDisk(vi); err != nil {
+		return err
+	}
+
+	// whiteouts hide the files of the earlier images
+	if vi.IsWhiteout() && relpath != "" {
+		dir, name := path.Split(relpath)
+		if parent := erofsRebuildLookup(root, dir); parent != nil && parent.IsDir() {
+			if d := erofsDLookup(parent, name); d != nil {
+				erofsRebuildDelDentry(d)
+			}
+		}
+		return nil
+	}
+
+	if !vi.IsDir() && vi.INlink > 1 {
+		if target := src.links[vi.Nid]; target != nil {
+			return erofsRebuildLink(root, relpath, target)
+		}
+	}
+
+	st := syscall.Stat_t{
+		Mode: uint32(vi.IMode),
+		Uid:  vi.IUid,
+		Gid:  vi.IGid,
+		Mtim: syscall.Timespec{Sec: int64(vi.IMtime), Nsec: int64(vi.IMtimeNsec)},
+		Rdev: types.ErofsNewDecodeDev(vi.IRdev),
+	}
+	if vi.IsReg() || vi.IsLnk() {
+		st.Size = int64(vi.ISize)
+	}
+	xattrs, err := erofsReadXattrsFromDisk(vi)
+	if err != nil {
+		return err
+	}
+
+	inode, err := erofsRebuildSetInode(root, relpath, &st)
+	if err != nil {
+		return err
+	}
+	if !vi.IsDir() && vi.INlink > 1 {
+		src.links[vi.Nid] = inode
+	}
+
+	opaqueKey := erofsOvlXattrPrefix() + "opaque"
+	for _, x := range xattrs {
+		if x.key == opaqueKey {
+			// opaque directories hide the entries of the earlier images
+			if inode.IsDir() && string(x.value) == "y" {
+				for pos := inode.ISubdirs.Next; pos != &inode.ISubdirs; {
+					d := types.ErofsDentryFromList(pos)
+
+					pos = pos.Next
+					erofsRebuildDelDentry(d)
+				}
+			}
+			continue
+		}
+		if erofsIsSkippedXattr(x.key) || types.GCfg.InlineXattrTolerance < 0 {
+			continue
+		}
+		if err = erofsSetxattr(inode, x.key, x.value); err != nil {
+			if err != syscall.Errno(errs.ENODATA) {
+				return err
+			}
+			types.Warning("ignored unsupported xattr %s of %s", x.key, inode.ISrcpath)
+		}
+	}
+	if err = erofsRebuildApplyXattrs(inode); err != nil {
+		return err
+	}
+
+	switch {
+	case inode.IsLnk():
+		link := make([]byte, vi.ISize)
+		if err = types.ErofsPread(vi, link, 0); err != nil {
+			return err
+		}
+		inode.ILink = string(link)
+	case inode.IsReg():
+		return erofsRebuildSetData(src, inode, vi)
+	case inode.IsDir():
+		return types.ErofsIterateDir(vi, func(name string, nid uint64, ftype uint8) error {
+			if name == "." || name == ".." {
+				return nil
+			}
+			child := &types.ErofsInode{Sbi: vi.Sbi, Nid: nid}
+			return erofsRebuildLoadInode(root, src, path.Join(relpath, name), child)
+		})
+	}
+	return nil
+}
+
+// ErofsRebuildLoadTree merges the tree of the image sbi into the one at
+// root. Files of later images replace the existing ones, and overlayfs
+// whiteouts and opaque directories hide the files of the earlier images.
+// File data is mapped to the image as the extra device deviceID if it's
+// non-zero, otherwise it's imported.
+func ErofsRebuildLoadTree(root *types.ErofsInode, sbi *types.SuperBlkInfo, deviceID uint16) error {
+	src := &erofsRebuildSrc{
+		sbi:      sbi,
+		deviceID: deviceID,
+		links:    make(map[uint64]*types.ErofsInode),
+		strm:     &types.ErofsDiskBufStrm{Fd: sbi.BDev.Fd, AlignSize: 1},
+	}
+	vi := &types.ErofsInode{Sbi: sbi, Nid: uint64(sbi.RootNid)}
+
+	if err := erofsRebuildLoadInode(root, src, "", vi); err != nil {
+		types.Error("failed to load tree of %s: %s", sbi.DevName, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package writer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/util"
+)
+
+// rebuildTestImage builds an image of the src directory as mkfs does
+func rebuildTestImage(t *testing.T, src string) string {
+	t.Helper()
+
+	img := filepath.Join(t.TempDir(), "test.img")
+	sbi := &types.GSbi
+	*types.GCfg = *types.InitConfigure()
+	*sbi = types.SuperBlkInfo{BDev: &types.ErofsVFile{}}
+	types.MkfsDefaultOptions(sbi)
+	types.GCfg.DebugLevel = types.EROFS_ERR
+	sbi.BlkSzBits = 12
+	sbi.SetTimestamp()
+	types.GCfg.SourcePath = src
+	types.ErofsSetFsRoot(src)
+
+	if err := util.DevOpen(sbi, img, os.O_RDWR|os.O_TRUNC); err != nil {
+		t.Fatal(err)
+	}
+	sbi.Bmgr = types.ErofsBufferInit(sbi, 0)
+	sbBh, err := types.ReserveSuperblock(sbi.Bmgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ErofsBuildSharedXattrsFromPath(sbi, src); err != nil {
+		t.Fatal(err)
+	}
+
+	types.ErofsInodeManagerInit()
+	root, err := ErofsMkfsBuildTreeFromPath(sbi, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sbi.RootNid = uint32(types.ErofsLookupNid(root))
+	types.ErofsIput(root)
+
+	var nblocks uint32
+	if ret := types.WriteSuperBlock(sbi, sbBh, &nblocks); ret != 0 {
+		t.Fatalf("WriteSuperBlock() = %d", ret)
+	}
+	if ret := types.ErofsBflush(sbi.Bmgr, nil); ret != 0 {
+		t.Fatalf("ErofsBflush() = %d", ret)
+	}
+	if ret := types.ErofsDevResize(sbi, nblocks); ret != 0 {
+		t.Fatalf("ErofsDevResize() = %d", ret)
+	}
+	syscall.Close(sbi.BDev.Fd)
+	return img
+}
+
+// rebuildTestWrite creates the regular files of a source tree
+func rebuildTestWrite(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, data := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestErofsRebuildLoadTree(t *testing.T) {
+	big := strings.Repeat("lower data block", 512)
+	lower, upper := t.TempDir(), t.TempDir()
+	rebuildTestWrite(t, lower, map[string]string{
+		"keep":     "lower",
+		"big":      big,
+		"gone":     "lower",
+		"replaced": "lower",
+		"dir/old":  "lower",
+		"dir2/old": "lower",
+	})
+	rebuildTestWrite(t, upper, map[string]string{
+		"replaced": "upper",
+		"added":    "upper",
+		"dir/new":  "upper",
+		"dir2/new": "upper",
+	})
+	// a whiteout of gone and an opaque dir hide the lower files
+	if err := syscall.Mknod(filepath.Join(upper, "gone"), syscall.S_IFCHR|0600, 0); err != nil {
+		t.Skipf("can't create a whiteout: %v", err)
+	}
+	if err := syscall.Setxattr(filepath.Join(upper, "dir"), "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Skipf("can't mark an opaque directory: %v", err)
+	}
+
+	var srcs []*types.SuperBlkInfo
+	for _, dir := range []string{lower, upper} {
+		sbi, err := ErofsRebuildOpen(rebuildTestImage(t, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { syscall.Close(sbi.BDev.Fd) })
+		srcs = append(srcs, sbi)
+	}
+
+	root := erofsTestMakeRoot(t)
+	for _, sbi := range srcs {
+		if err := ErofsRebuildLoadTree(root, sbi, 0); err != nil {
+			t.Fatalf("ErofsRebuildLoadTree() = %v", err)
+		}
+	}
+
+	tests := []struct {
+		path string
+		data string // "" if the path is hidden
+	}{
+		{"keep", "lower"},
+		{"big", big},
+		{"replaced", "upper"},
+		{"added", "upper"},
+		{"gone", ""},
+		{"dir/old", ""},
+		{"dir/new", "upper"},
+		{"dir2/old", "lower"},
+		{"dir2/new", "upper"},
+	}
+
+	for _, tt := range tests {
+		inode := erofsRebuildLookup(root, tt.path)
+		if tt.data == "" {
+			if inode != nil {
+				t.Errorf("%s: not hidden", tt.path)
+			}
+			continue
+		}
+		if inode == nil {
+			t.Errorf("%s: not found", tt.path)
+			continue
+		}
+		if data := erofsTestData(t, inode); data != tt.data {
+			t.Errorf("%s: data %.16q, want %.16q", tt.path, data, tt.data)
+		}
+	}
+	// the opaque xattr isn't kept in the merged tree
+	if dir := erofsRebuildLookup(root, "dir"); dir == nil || dir.IXattrs.Next != &dir.IXattrs {
+		t.Errorf("dir: opaque xattr kept in the merged tree")
+	}
+}
+
+func TestErofsRebuildInitDevices(t *testing.T) {
+	src := t.TempDir()
+	rebuildTestWrite(t, src, map[string]string{"big": strings.Repeat("data", 2048)})
+	img, err := ErofsRebuildOpen(rebuildTestImage(t, src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(img.BDev.Fd)
+
+	root := erofsTestMakeRoot(t)
+	types.GSbi.Bmgr = types.ErofsBufferInit(&types.GSbi, 0)
+	if err = ErofsRebuildInitDevices(&types.GSbi, []*types.SuperBlkInfo{img}); err != nil {
+		t.Fatalf("ErofsRebuildInitDevices() = %v", err)
+	}
+	if types.GSbi.ExtraDevices != 1 || types.GSbi.Devs[0].Blocks != uint32(img.PrimaryDeviceBlocks) {
+		t.Fatalf("devices %d of %d blocks, want 1 of %d", types.GSbi.ExtraDevices,
+			types.GSbi.Devs[0].Blocks, img.PrimaryDeviceBlocks)
+	}
+	if err = ErofsRebuildLoadTree(root, img, 1); err != nil {
+		t.Fatalf("ErofsRebuildLoadTree() = %v", err)
+	}
+
+	// flat data is mapped to the source image rather than imported
+	inode := erofsRebuildLookup(root, "big")
+	if inode == nil || inode.DataLayout != types.EROFS_INODE_CHUNK_BASED {
+		t.Fatal("big: data not mapped")
+	}
+	chunks := erofsInodeChunks(inode, 1)
+	if chunks[0].DeviceID != 1 || chunks[0].ChunkSize != inode.ISize {
+		t.Errorf("big: chunk on device %d of %d bytes, want 1 and %d",
+			chunks[0].DeviceID, chunks[0].ChunkSize, inode.ISize)
+	}
+}
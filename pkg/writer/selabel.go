@@ -0,0 +1,157 @@
+package writer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+const xattrSelinuxSuffix = "selinux"
+
+// selabelSpec is one entry of a file_contexts file
+type selabelSpec struct {
+	regex    *regexp.Regexp
+	mode     uint16 // file type to match, 0 matches any type
+	context  string
+	metaChar bool // the path is a regex rather than a literal
+}
+
+// selabelHandle is a file_contexts database, like a libselinux handle
+type selabelHandle struct {
+	specs []selabelSpec
+}
+
+// erofsSehnd is set once --file-contexts is given
+var erofsSehnd *selabelHandle
+
+var selabelFileTypes = map[string]uint16{
+	"--": types.S_IFREG,
+	"-d": types.S_IFDIR,
+	"-c": types.S_IFCHR,
+	"-b": types.S_IFBLK,
+	"-s": types.S_IFSOCK,
+	"-l": types.S_IFLNK,
+	"-p": types.S_IFIFO,
+}
+
+func selabelHasMetaChars(spec string) bool {
+	for i := 0; i < len(spec); i++ {
+		switch spec[i] {
+		case '.', '^', '$', '?', '*', '+', '|', '[', '(', '{':
+			return true
+		case '\\':
+			// skip the escaped character
+			i++
+		}
+	}
+	return false
+}
+
+// ErofsSelabelOpen loads a file_contexts file, whose labels override
+// the security.selinux xattrs of the source files
+func ErofsSelabelOpen(fcPath string) error {
+	f, err := os.Open(fcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hnd := &selabelHandle{}
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		var spec selabelSpec
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 2:
+			spec.context = fields[1]
+		case 3:
+			mode, ok := selabelFileTypes[fields[1]]
+			if !ok {
+				return fmt.Errorf("%s:%d: invalid file type %q", fcPath, lineno, fields[1])
+			}
+			spec.mode = mode
+			spec.context = fields[2]
+		default:
+			return fmt.Errorf("%s:%d: invalid line: %s", fcPath, lineno, line)
+		}
+
+		spec.regex, err = regexp.Compile("^(?:" + fields[0] + ")$")
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid regex %q: %w", fcPath, lineno, fields[0], err)
+		}
+		spec.metaChar = selabelHasMetaChars(fields[0])
+		hnd.specs = append(hnd.specs, spec)
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	// literal paths take precedence over regexes; otherwise the last
+	// matching entry wins as libselinux does
+	sort.SliceStable(hnd.specs, func(i, j int) bool {
+		return hnd.specs[i].metaChar && !hnd.specs[j].metaChar
+	})
+	erofsSehnd = hnd
+	return nil
+}
+
+// lookup returns the context of fspath, or ENOENT if it isn't labeled
+func (hnd *selabelHandle) lookup(fspath string, mode uint16) (string, error) {
+	for i := len(hnd.specs) - 1; i >= 0; i-- {
+		spec := &hnd.specs[i]
+
+		if spec.mode != 0 && spec.mode != mode&types.S_IFMT {
+			continue
+		}
+		if !spec.regex.MatchString(fspath) {
+			continue
+		}
+		if spec.context == "<<none>>" {
+			break
+		}
+		return spec.context, nil
+	}
+	return "", syscall.Errno(errs.ENOENT)
+}
+
+// erofsIsSkippedXattr tells if an xattr of the source file is dropped
+func erofsIsSkippedXattr(key string) bool {
+	if types.GCfg.OvlfsStrip && strings.HasPrefix(key, erofsOvlXattrPrefix()) {
+		return true
+	}
+	// if sehnd is valid, selabels will be overridden
+	return erofsSehnd != nil && key == xattrTypes[types.EROFSXattrIndexSecurity]+xattrSelinuxSuffix
+}
+
+func erofsGetSelabelXattr(srcpath string, mode uint16) (*xattrItem, error) {
+	if erofsSehnd == nil {
+		return nil, nil
+	}
+
+	fspath := path.Join("/", types.GCfg.MountPoint, types.ErofsFspath(srcpath))
+	secontext, err := erofsSehnd.lookup(fspath, mode)
+	if err != nil {
+		if err == syscall.Errno(errs.ENOENT) {
+			return nil, nil
+		}
+		types.Error("failed to lookup selabel for %s: %s", srcpath, err)
+		return nil, err
+	}
+
+	kvbuf := []byte(xattrSelinuxSuffix + secontext)
+	return getXattritem(types.EROFSXattrIndexSecurity, kvbuf,
+		[2]uint32{uint32(len(xattrSelinuxSuffix)), uint32(len(secontext))}), nil
+}
@@ -0,0 +1,94 @@
+package writer
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+// selabelTestOpen loads the file_contexts text as the labels of the build
+func selabelTestOpen(t *testing.T, contexts string) error {
+	t.Helper()
+
+	fn := filepath.Join(t.TempDir(), "file_contexts")
+	if err := os.WriteFile(fn, []byte(contexts), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { erofsSehnd = nil })
+	return ErofsSelabelOpen(fn)
+}
+
+func TestErofsSelabelLookup(t *testing.T) {
+	const contexts = `# comments and blank lines are skipped
+
+/.*                 u:object_r:system_file:s0
+/system/bin         u:object_r:exec_file:s0
+/system(/.*)?       u:object_r:system_data:s0
+/system/bin/.*  --  u:object_r:exec_file:s0
+/system/bin/sh  --  u:object_r:shell_exec:s0
+/system/tmp(/.*)?   <<none>>
+/system/etc/.*  -d  u:object_r:etc_dir:s0
+`
+	if err := selabelTestOpen(t, contexts); err != nil {
+		t.Fatalf("ErofsSelabelOpen() = %v", err)
+	}
+
+	tests := []struct {
+		path    string
+		mode    uint16
+		context string // empty if the path isn't labeled
+	}{
+		{"/", types.S_IFDIR, "u:object_r:system_file:s0"},
+		{"/vendor/lib", types.S_IFREG, "u:object_r:system_file:s0"},
+		// the last matching regex wins
+		{"/system/lib", types.S_IFREG, "u:object_r:system_data:s0"},
+		{"/system/bin/ls", types.S_IFREG, "u:object_r:exec_file:s0"},
+		{"/system/bin/ls", types.S_IFLNK, "u:object_r:system_data:s0"},
+		// literal paths win over regexes listed after them
+		{"/system/bin", types.S_IFDIR, "u:object_r:exec_file:s0"},
+		{"/system/bin/sh", types.S_IFREG, "u:object_r:shell_exec:s0"},
+		{"/system/bin/sh", types.S_IFDIR, "u:object_r:system_data:s0"},
+		{"/system/etc/init", types.S_IFDIR, "u:object_r:etc_dir:s0"},
+		{"/system/etc/hosts", types.S_IFREG, "u:object_r:system_data:s0"},
+		// <<none>> leaves matching paths unlabeled
+		{"/system/tmp", types.S_IFDIR, ""},
+		{"/system/tmp/a", types.S_IFREG, ""},
+	}
+
+	for _, tt := range tests {
+		context, err := erofsSehnd.lookup(tt.path, tt.mode)
+		if tt.context == "" {
+			if err != syscall.Errno(errs.ENOENT) {
+				t.Errorf("lookup(%s, %#o) = %q, %v, want ENOENT", tt.path, tt.mode, context, err)
+			}
+			continue
+		}
+		if err != nil || context != tt.context {
+			t.Errorf("lookup(%s, %#o) = %q, %v, want %q", tt.path, tt.mode, context, err, tt.context)
+		}
+	}
+}
+
+func TestErofsSelabelOpenMalformed(t *testing.T) {
+	tests := []struct {
+		name     string
+		contexts string
+	}{
+		{"invalid file type", "/system -x u:object_r:system_file:s0\n"},
+		{"missing context", "/system\n"},
+		{"too many fields", "/system -- u:object_r:system_file:s0 extra\n"},
+		{"invalid regex", "/system(/.* u:object_r:system_file:s0\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := selabelTestOpen(t, tt.contexts); err == nil {
+				t.Fatal("ErofsSelabelOpen() succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,1001 @@
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+// tar headers are in the ustar format of POSIX.1-1988 with the GNU and
+// POSIX.1-2001 (PAX) extensions
+const (
+	tarBlockSize = 512
+
+	tarNameOff     = 0
+	tarModeOff     = 100
+	tarUidOff      = 108
+	tarGidOff      = 116
+	tarSizeOff     = 124
+	tarMtimeOff    = 136
+	tarChksumOff   = 148
+	tarTypeflagOff = 156
+	tarLinknameOff = 157
+	tarMagicOff    = 257
+	tarDevmajorOff = 329
+	tarDevminorOff = 337
+	tarPrefixOff   = 345
+
+	// GNU old sparse headers
+	tarGnuSparseOff     = 386
+	tarGnuIsextendedOff = 482
+	tarGnuRealsizeOff   = 483
+	tarGnuSparseEntries = 4
+	tarGnuExtEntries    = 21
+	tarGnuExtIsextended = 504
+)
+
+var tarMagicUstar = []byte("ustar\x00")
+
+// special files of aufs which are used by OCI layers
+const (
+	tarAufsWhiteoutPrefix = ".wh."
+	tarAufsMetaPrefix     = ".wh..wh."
+	tarAufsOpaque         = ".wh..wh..opq"
+)
+
+// decoders of compressed tar streams
+const (
+	EROFS_IOS_DECODER_NONE = iota
+	EROFS_IOS_DECODER_GZIP
+	EROFS_IOS_DECODER_BZIP2
+)
+
+// erofsIostream reads a tar archive sequentially and tracks the offset
+type erofsIostream struct {
+	f       *os.File
+	r       *bufio.Reader
+	gz      *gzip.Reader
+	decoder int
+	pos     uint64 // offset of the next byte to read, after decompression
+
+	// data can be seeked over and read again later, i.e. the archive is
+	// an uncompressed regular file
+	seekable bool
+
+	// sum of all bytes read or skipped while chksum is set, used by
+	// cpio crc archives
+	chksum bool
+	sum    uint32
+}
+
+// erofsIostreamOpenFile opens the archive at path ("-" for stdin) for ios
+func erofsIostreamOpenFile(ios *erofsIostream, path string) error {
+	f := os.Stdin
+	if path != "-" {
+		var err error
+
+		if f, err = os.Open(path); err != nil {
+			return err
+		}
+	}
+	if err := erofsIostreamOpen(ios, f); err != nil {
+		f.Close()
+		return err
+	}
+	return nil
+}
+
+// close releases the decoder and the archive
+func (ios *erofsIostream) close() {
+	if ios.gz != nil {
+		ios.gz.Close()
+	}
+	ios.f.Close()
+}
+
+// erofsIostreamOpen sets up ios for f, compressed archives are detected by
+// their magic numbers and decompressed on the fly
+func erofsIostreamOpen(ios *erofsIostream, f *os.File) error {
+	ios.f = f
+	ios.r = bufio.NewReaderSize(f, 1<<16)
+
+	magic, _ := ios.r.Peek(3)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(ios.r)
+		if err != nil {
+			return err
+		}
+		ios.gz, ios.decoder = gz, EROFS_IOS_DECODER_GZIP
+		ios.r = bufio.NewReaderSize(gz, 1<<16)
+	case bytes.Equal(magic, []byte("BZh")):
+		ios.decoder = EROFS_IOS_DECODER_BZIP2
+		ios.r = bufio.NewReaderSize(bzip2.NewReader(ios.r), 1<<16)
+	default:
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		ios.seekable = fi.Mode().IsRegular()
+	}
+	return nil
+}
+
+func (ios *erofsIostream) read(buf []byte) error {
+	n, err := io.ReadFull(ios.r, buf)
+	ios.pos += uint64(n)
+	if ios.chksum {
+		for _, c := range buf[:n] {
+			ios.sum += uint32(c)
+		}
+	}
+	return err
+}
+
+// lskip skips n bytes, seeking over the data which isn't buffered if the
+// stream is seekable
+func (ios *erofsIostream) lskip(n uint64) error {
+	if ios.chksum {
+		buf := make([]byte, min(n, 1<<16))
+
+		for n != 0 {
+			m := min(n, uint64(len(buf)))
+			if err := ios.read(buf[:m]); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			n -= m
+		}
+		return nil
+	}
+	if !ios.seekable {
+		m, err := io.CopyN(io.Discard, ios.r, int64(n))
+		ios.pos += uint64(m)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	if buffered := uint64(ios.r.Buffered()); n > buffered {
+		off, err := ios.f.Seek(int64(n-buffered), io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		// seeking beyond the end of truncated archives doesn't fail
+		fi, err := ios.f.Stat()
+		if err != nil {
+			return err
+		}
+		if off > fi.Size() {
+			return io.ErrUnexpectedEOF
+		}
+		ios.r.Reset(ios.f)
+		ios.pos += n
+		return nil
+	}
+	_, err := ios.r.Discard(int(n))
+	ios.pos += n
+	return err
+}
+
+type tarSparseEntry struct {
+	offset   uint64
+	numbytes uint64
+}
+
+// erofsPaxHeader collects the attributes of the next member given by PAX
+// extended headers and GNU long name entries
+type erofsPaxHeader struct {
+	path, link       string
+	usePath, useLink bool
+
+	size    uint64
+	useSize bool
+
+	uid, gid       uint32
+	useUid, useGid bool
+
+	mtime     int64
+	mtimeNsec uint32
+	useMtime  bool
+
+	xattrs              []xattrPair
+	aclAccess, aclDflt  string
+	useAccess, useDflt  bool
+	sparse              bool
+	sparseMajor         int
+	sparseRealsize      uint64
+	sparseName          string
+	sparseMap           []tarSparseEntry
+	sparseNumbytesValid bool
+}
+
+// ErofsTarfile is a tar archive used as the source of the tree
+type ErofsTarfile struct {
+	ios    erofsIostream
+	global erofsPaxHeader
+
+	// Aufs turns the whiteouts and opaque markers of OCI layers into
+	// the ones of overlayfs
+	Aufs bool
+
+	// Flatten applies the whiteouts and opaque markers of an OCI layer
+	// to the tree built from the lower layers instead
+	Flatten  bool
+	unpacked map[string]bool // paths of this layer, kept by opaque markers
+
+	// IndexMode only generates metadata, file data is mapped to the
+	// archive which is used as the extra device. Sparse files are still
+	// stored in the image as their holes can't be mapped.
+	IndexMode bool
+
+	// file data is referenced right in seekable archives, otherwise it's
+	// spooled into diskbuf stream 0 as are sparse files to keep holes
+	strm *types.ErofsDiskBufStrm
+}
+
+// ErofsTarOpen opens the tar archive at path ("-" for stdin), which may be
+// compressed by gzip or bzip2. File data of archives which can't be read
+// again later is spooled by the diskbuf streams.
+func ErofsTarOpen(path string) (*ErofsTarfile, error) {
+	tar := &ErofsTarfile{}
+
+	if err := erofsIostreamOpenFile(&tar.ios, path); err != nil {
+		types.Error("failed to open tar source %s: %v", path, err)
+		return nil, err
+	}
+
+	if tar.ios.seekable {
+		tar.strm = &types.ErofsDiskBufStrm{Fd: int(tar.ios.f.Fd()), AlignSize: 1}
+	}
+	return tar, nil
+}
+
+// ErofsTarIndexInit sets up the archive as the only extra device for the
+// index mode, so its size has to be a multiple of the block size
+func ErofsTarIndexInit(sbi *types.SuperBlkInfo, tar *ErofsTarfile) error {
+	if tar.strm == nil {
+		types.Error("only seekable uncompressed tar archives can be indexed")
+		return syscall.Errno(errs.EOPNOTSUPP)
+	}
+	if sbi.ExtraDevices != 0 {
+		types.Error("extra devices can't be used along with tar index mode")
+		return syscall.Errno(errs.EINVAL)
+	}
+
+	fi, err := tar.ios.f.Stat()
+	if err != nil {
+		return err
+	}
+	sbi.BlobFd[0] = uint32(tar.ios.f.Fd())
+	sbi.NBlobs = 1
+	sbi.Devs = []types.DeviceInfo{{Blocks: uint32(types.BlkRoundUp(sbi, uint64(fi.Size())))}}
+	tar.IndexMode = true
+	return erofsReserveDeviceTable(sbi)
+}
+
+// ErofsTarClose closes the archive
+func ErofsTarClose(tar *ErofsTarfile) {
+	tar.ios.close()
+}
+
+// tarString returns a NUL-terminated string field
+func tarString(field []byte) string {
+	if i := bytes.IndexByte(field, 0); i >= 0 {
+		field = field[:i]
+	}
+	return string(field)
+}
+
+// tarParseNumber decodes an octal number field, or a base-256 one as GNU
+// tar does for values which don't fit
+func tarParseNumber(field []byte) (int64, error) {
+	if len(field) != 0 && field[0]&0x80 != 0 {
+		var inv byte
+		var x uint64
+
+		if field[0]&0x40 != 0 {
+			inv = 0xff // negative numbers in two's complement
+		}
+		for i, c := range field {
+			c ^= inv
+			if i == 0 {
+				c &= 0x7f
+			}
+			if x>>56 != 0 {
+				return 0, syscall.Errno(errs.ERANGE)
+			}
+			x = x<<8 | uint64(c)
+		}
+		if x>>63 != 0 {
+			return 0, syscall.Errno(errs.ERANGE)
+		}
+		if inv != 0 {
+			return ^int64(x), nil
+		}
+		return int64(x), nil
+	}
+
+	s := strings.Trim(string(field), " \x00")
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 8, 64)
+}
+
+func tarVerifyChecksum(th []byte) bool {
+	var unsigned, signed int64
+
+	chksum, err := tarParseNumber(th[tarChksumOff : tarChksumOff+8])
+	if err != nil {
+		return false
+	}
+	for i, c := range th {
+		if i >= tarChksumOff && i < tarChksumOff+8 {
+			c = ' '
+		}
+		unsigned += int64(c)
+		signed += int64(int8(c))
+	}
+	return chksum == unsigned || chksum == signed
+}
+
+// tarParsePaxTime parses "sec[.nsec]" of PAX time records
+func tarParsePaxTime(s string) (int64, uint32, error) {
+	sec, frac, _ := strings.Cut(s, ".")
+	n, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if frac == "" {
+		return n, 0, nil
+	}
+	ns, err := strconv.ParseUint((frac + "000000000")[:9], 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	if strings.HasPrefix(sec, "-") && ns != 0 {
+		return n - 1, uint32(1000000000 - ns), nil
+	}
+	return n, uint32(ns), nil
+}
+
+// tarParseSparseMap parses "offset,numbytes[,offset,numbytes...]"
+func tarParseSparseMap(s string) ([]tarSparseEntry, error) {
+	fields := strings.Split(s, ",")
+	if len(fields)%2 != 0 {
+		return nil, syscall.Errno(errs.EBADMSG)
+	}
+
+	smap := make([]tarSparseEntry, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		off, err1 := strconv.ParseUint(fields[i], 10, 64)
+		n, err2 := strconv.ParseUint(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, syscall.Errno(errs.EBADMSG)
+		}
+		smap = append(smap, tarSparseEntry{offset: off, numbytes: n})
+	}
+	return smap, nil
+}
+
+// tarerofsParsePaxHeader parses the "len key=value\n" records of a PAX
+// extended header into eh
+func tarerofsParsePaxHeader(eh *erofsPaxHeader, data []byte) error {
+	for len(data) != 0 {
+		sp := bytes.IndexByte(data, ' ')
+		if sp <= 0 {
+			return syscall.Errno(errs.EBADMSG)
+		}
+		n, err := strconv.Atoi(string(data[:sp]))
+		if err != nil || n <= sp+1 || n > len(data) || data[n-1] != '\n' {
+			return syscall.Errno(errs.EBADMSG)
+		}
+		kv := data[sp+1 : n-1]
+		data = data[n:]
+
+		eq := bytes.IndexByte(kv, '=')
+		if eq < 0 {
+			return syscall.Errno(errs.EBADMSG)
+		}
+		key, value := string(kv[:eq]), kv[eq+1:]
+
+		switch {
+		case key == "path":
+			eh.path, eh.usePath = string(value), true
+		case key == "linkpath":
+			eh.link, eh.useLink = string(value), true
+		case key == "size":
+			if eh.size, err = strconv.ParseUint(string(value), 10, 64); err != nil {
+				return syscall.Errno(errs.EBADMSG)
+			}
+			eh.useSize = true
+		case key == "uid" || key == "gid":
+			id, err := strconv.ParseUint(string(value), 10, 32)
+			if err != nil {
+				return syscall.Errno(errs.EBADMSG)
+			}
+			if key == "uid" {
+				eh.uid, eh.useUid = uint32(id), true
+			} else {
+				eh.gid, eh.useGid = uint32(id), true
+			}
+		case key == "mtime":
+			if eh.mtime, eh.mtimeNsec, err = tarParsePaxTime(string(value)); err != nil {
+				return syscall.Errno(errs.EBADMSG)
+			}
+			eh.useMtime = true
+		case strings.HasPrefix(key, "SCHILY.xattr."):
+			eh.xattrs = append(eh.xattrs, xattrPair{
+				key:   key[len("SCHILY.xattr."):],
+				value: append([]byte(nil), value...),
+			})
+		case strings.HasPrefix(key, "LIBARCHIVE.xattr."):
+			// names are URL-encoded and values are base64-encoded
+			name, err := url.QueryUnescape(key[len("LIBARCHIVE.xattr."):])
+			if err != nil {
+				return syscall.Errno(errs.EBADMSG)
+			}
+			v, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(string(value), "="))
+			if err != nil {
+				return syscall.Errno(errs.EBADMSG)
+			}
+			eh.xattrs = append(eh.xattrs, xattrPair{key: name, value: v})
+		case key == "SCHILY.acl.access":
+			eh.aclAccess, eh.useAccess = string(value), true
+		case key == "SCHILY.acl.default":
+			eh.aclDflt, eh.useDflt = string(value), true
+		case key == "GNU.sparse.major":
+			eh.sparse = true
+			if eh.sparseMajor, err = strconv.Atoi(string(value)); err != nil {
+				return syscall.Errno(errs.EBADMSG)
+			}
+		case key == "GNU.sparse.name":
+			eh.sparse, eh.sparseName = true, string(value)
+		case key == "GNU.sparse.size" || key == "GNU.sparse.realsize":
+			eh.sparse = true
+			if eh.sparseRealsize, err = strconv.ParseUint(string(value), 10, 64); err != nil {
+				return syscall.Errno(errs.EBADMSG)
+			}
+		case key == "GNU.sparse.map": // format 0.1
+			eh.sparse = true
+			if eh.sparseMap, err = tarParseSparseMap(string(value)); err != nil {
+				return err
+			}
+		case key == "GNU.sparse.offset": // format 0.0
+			off, err := strconv.ParseUint(string(value), 10, 64)
+			if err != nil {
+				return syscall.Errno(errs.EBADMSG)
+			}
+			eh.sparse = true
+			eh.sparseMap = append(eh.sparseMap, tarSparseEntry{offset: off})
+			eh.sparseNumbytesValid = false
+		case key == "GNU.sparse.numbytes":
+			n, err := strconv.ParseUint(string(value), 10, 64)
+			if err != nil || len(eh.sparseMap) == 0 || eh.sparseNumbytesValid {
+				return syscall.Errno(errs.EBADMSG)
+			}
+			eh.sparseMap[len(eh.sparseMap)-1].numbytes = n
+			eh.sparseNumbytesValid = true
+		default:
+			types.Debug(types.EROFS_DBG, "ignored PAX record %s", key)
+		}
+	}
+	return nil
+}
+
+// tarerofsReadPayload reads the whole payload of a metadata member
+func tarerofsReadPayload(tar *ErofsTarfile, size int64) ([]byte, error) {
+	if size < 0 || size > 1<<30 {
+		return nil, syscall.Errno(errs.EBADMSG)
+	}
+
+	buf := make([]byte, types.RoundUp(uint64(size), tarBlockSize))
+	if err := tar.ios.read(buf); err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+// tarerofsReadGnuSparse reads the sparse map of a GNU 'S' member
+func tarerofsReadGnuSparse(tar *ErofsTarfile, th []byte) ([]tarSparseEntry, error) {
+	var smap []tarSparseEntry
+
+	parse := func(p []byte, count int) error {
+		for i := 0; i < count; i++ {
+			ent := p[i*24 : i*24+24]
+			if ent[0] == 0 {
+				break
+			}
+			off, err1 := tarParseNumber(ent[:12])
+			n, err2 := tarParseNumber(ent[12:])
+			if err1 != nil || err2 != nil || off < 0 || n < 0 {
+				return syscall.Errno(errs.EBADMSG)
+			}
+			smap = append(smap, tarSparseEntry{offset: uint64(off), numbytes: uint64(n)})
+		}
+		return nil
+	}
+
+	if err := parse(th[tarGnuSparseOff:], tarGnuSparseEntries); err != nil {
+		return nil, err
+	}
+	for ext := th[tarGnuIsextendedOff] != 0; ext; {
+		blk := make([]byte, tarBlockSize)
+		if err := tar.ios.read(blk); err != nil {
+			return nil, err
+		}
+		if err := parse(blk, tarGnuExtEntries); err != nil {
+			return nil, err
+		}
+		ext = blk[tarGnuExtIsextended] != 0
+	}
+	return smap, nil
+}
+
+// tarerofsReadSparseMap1 reads the sparse map of PAX format 1.0 files,
+// which is stored as decimal lines at the beginning of the data
+func tarerofsReadSparseMap1(tar *ErofsTarfile, size *uint64) ([]tarSparseEntry, error) {
+	var buf []byte
+	var nums []uint64
+
+	count := -1
+	for count < 0 || len(nums) < 2*count {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			if *size < tarBlockSize {
+				return nil, syscall.Errno(errs.EBADMSG)
+			}
+			blk := make([]byte, tarBlockSize)
+			if err := tar.ios.read(blk); err != nil {
+				return nil, err
+			}
+			*size -= tarBlockSize
+			buf = append(buf, blk...)
+			continue
+		}
+
+		n, err := strconv.ParseUint(string(buf[:i]), 10, 64)
+		if err != nil {
+			return nil, syscall.Errno(errs.EBADMSG)
+		}
+		buf = buf[i+1:]
+		if count < 0 {
+			count = int(n)
+			if n > 1<<20 {
+				return nil, syscall.Errno(errs.EBADMSG)
+			}
+			continue
+		}
+		nums = append(nums, n)
+	}
+
+	smap := make([]tarSparseEntry, 0, count)
+	for i := 0; i < len(nums); i += 2 {
+		smap = append(smap, tarSparseEntry{offset: nums[i], numbytes: nums[i+1]})
+	}
+	return smap, nil
+}
+
+// erofsIostreamFileData takes the next ISize bytes of ios as the data of
+// inode, which is referenced in place by strm if the archive is seekable
+func erofsIostreamFileData(ios *erofsIostream, strm *types.ErofsDiskBufStrm, inode *types.ErofsInode) error {
+	if strm == nil {
+		size := inode.ISize
+		smap := []tarSparseEntry{{offset: 0, numbytes: inode.ISize}}
+		return erofsIostreamSpool(ios, inode, smap, &size)
+	}
+
+	strm.TailOffset = ios.pos
+	inode.IDiskbuf = &types.ErofsDiskbuf{}
+	types.ErofsDiskbufReserve(inode.IDiskbuf, strm)
+	inode.DataSource = types.EROFS_INODE_DATA_SOURCE_DISKBUF
+	if err := ios.lskip(inode.ISize); err != nil {
+		return err
+	}
+	types.ErofsDiskbufCommit(inode.IDiskbuf, inode.ISize)
+	return nil
+}
+
+// erofsIostreamSpool copies the data segments of a file from ios into
+// diskbuf stream 0, leaving holes in between
+func erofsIostreamSpool(ios *erofsIostream, inode *types.ErofsInode,
+	smap []tarSparseEntry, size *uint64) error {
+	var st syscall.Stat_t
+
+	strm := types.ErofsDiskbufStream(0)
+	if strm == nil {
+		types.Error("no diskbuf stream to spool %s", inode.ISrcpath)
+		return syscall.Errno(errs.EINVAL)
+	}
+
+	db := &types.ErofsDiskbuf{}
+	fd, off := types.ErofsDiskbufReserve(db, strm)
+	buf := make([]byte, 1<<16)
+
+	for _, ent := range smap {
+		if ent.offset+ent.numbytes > inode.ISize || ent.numbytes > *size {
+			types.Error("invalid sparse map of %s", inode.ISrcpath)
+			return syscall.Errno(errs.EBADMSG)
+		}
+		for pos := uint64(0); pos < ent.numbytes; {
+			n := min(uint64(len(buf)), ent.numbytes-pos)
+			if err := ios.read(buf[:n]); err != nil {
+				return err
+			}
+			if _, err := syscall.Pwrite(fd, buf[:n], int64(off+ent.offset+pos)); err != nil {
+				return err
+			}
+			pos += n
+		}
+		*size -= ent.numbytes
+	}
+
+	// a trailing hole has to be inside of the stream as well
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if uint64(st.Size) < off+inode.ISize {
+		if err := unix.Ftruncate(fd, int64(off+inode.ISize)); err != nil {
+			return err
+		}
+	}
+	types.ErofsDiskbufCommit(db, inode.ISize)
+	inode.IDiskbuf = db
+	inode.DataSource = types.EROFS_INODE_DATA_SOURCE_DISKBUF
+	return nil
+}
+
+// tarerofsApplyXattrs sets the xattrs of a member, the ones added by
+// selinux labels, capabilities and the manifest are kept on top
+func tarerofsApplyXattrs(inode *types.ErofsInode, eh *erofsPaxHeader) error {
+	if types.GCfg.InlineXattrTolerance < 0 {
+		return nil
+	}
+
+	for _, x := range eh.xattrs {
+		if erofsIsSkippedXattr(x.key) {
+			continue
+		}
+		if err := erofsSetxattr(inode, x.key, x.value); err != nil {
+			if err != syscall.Errno(errs.ENODATA) {
+				return err
+			}
+			types.Warning("ignored unsupported xattr %s of %s", x.key, inode.ISrcpath)
+		}
+	}
+	if eh.useAccess && eh.aclAccess != "" {
+		err := erofsInodeSetAclFromText(inode, types.EROFSXattrIndexPosixACLAccess, eh.aclAccess)
+		if err != nil {
+			return err
+		}
+	}
+	if eh.useDflt && eh.aclDflt != "" {
+		err := erofsInodeSetAclFromText(inode, types.EROFSXattrIndexPosixACLDefault, eh.aclDflt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return erofsRebuildApplyXattrs(inode)
+}
+
+// TarerofsParseTar parses the next member of the archive into the tree at
+// root. io.EOF is returned at the end of the archive.
+func TarerofsParseTar(root *types.ErofsInode, tar *ErofsTarfile) error {
+	eh := tar.global
+	eh.xattrs = append([]xattrPair(nil), tar.global.xattrs...)
+	th := make([]byte, tarBlockSize)
+
+restart:
+	tarOffset := tar.ios.pos
+	if err := tar.ios.read(th); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		types.Error("failed to read header block @ %d: %s", tarOffset, err)
+		return err
+	}
+
+	// the end of the archive is marked by zero blocks
+	if erofsIsZeroed(th) {
+		return io.EOF
+	}
+
+	if !tarVerifyChecksum(th) {
+		types.Error("chksum mismatch @ %d", tarOffset)
+		return syscall.Errno(errs.EBADMSG)
+	}
+
+	typeflag := th[tarTypeflagOff]
+	size, err := tarParseNumber(th[tarSizeOff : tarSizeOff+12])
+	if err != nil || size < 0 {
+		types.Error("invalid size of member @ %d", tarOffset)
+		return syscall.Errno(errs.EBADMSG)
+	}
+	if eh.useSize && typeflag != 'x' && typeflag != 'g' {
+		size = int64(eh.size)
+	}
+
+	switch typeflag {
+	case 'x', 'g':
+		data, err := tarerofsReadPayload(tar, size)
+		if err != nil {
+			return err
+		}
+		if typeflag == 'g' {
+			// global records apply to all the following members
+			if err = tarerofsParsePaxHeader(&tar.global, data); err != nil {
+				types.Error("invalid PAX global header @ %d", tarOffset)
+				return err
+			}
+		}
+		if err = tarerofsParsePaxHeader(&eh, data); err != nil {
+			types.Error("invalid PAX header @ %d", tarOffset)
+			return err
+		}
+		goto restart
+	case 'L', 'K':
+		data, err := tarerofsReadPayload(tar, size)
+		if err != nil {
+			return err
+		}
+		if typeflag == 'L' {
+			eh.path, eh.usePath = tarString(data), true
+		} else {
+			eh.link, eh.useLink = tarString(data), true
+		}
+		goto restart
+	case 'V':
+		// volume labels aren't files
+		if err = tar.ios.lskip(types.RoundUp(uint64(size), tarBlockSize)); err != nil {
+			return err
+		}
+		goto restart
+	}
+
+	// prefix is only used by POSIX ustar headers
+	name := tarString(th[tarNameOff:tarModeOff])
+	if bytes.Equal(th[tarMagicOff:tarMagicOff+6], tarMagicUstar) {
+		if prefix := tarString(th[tarPrefixOff : tarPrefixOff+155]); prefix != "" {
+			name = prefix + "/" + name
+		}
+	}
+	if eh.usePath {
+		name = eh.path
+	}
+	if eh.sparseName != "" {
+		name = eh.sparseName
+	}
+	link := tarString(th[tarLinknameOff:tarMagicOff])
+	if eh.useLink {
+		link = eh.link
+	}
+
+	mode, err := tarParseNumber(th[tarModeOff : tarModeOff+8])
+	if err != nil {
+		return syscall.Errno(errs.EBADMSG)
+	}
+	st := syscall.Stat_t{Mode: uint32(mode) & 07777}
+
+	if eh.useUid {
+		st.Uid = eh.uid
+	} else if v, err := tarParseNumber(th[tarUidOff : tarUidOff+8]); err == nil {
+		st.Uid = uint32(v)
+	}
+	if eh.useGid {
+		st.Gid = eh.gid
+	} else if v, err := tarParseNumber(th[tarGidOff : tarGidOff+8]); err == nil {
+		st.Gid = uint32(v)
+	}
+	if eh.useMtime {
+		st.Mtim = syscall.Timespec{Sec: eh.mtime, Nsec: int64(eh.mtimeNsec)}
+	} else if v, err := tarParseNumber(th[tarMtimeOff : tarMtimeOff+12]); err == nil {
+		st.Mtim.Sec = v
+	}
+
+	var smap []tarSparseEntry
+	dataSize := uint64(size)
+	switch typeflag {
+	case '0', 0, '7':
+		st.Mode |= syscall.S_IFREG
+		// old archives mark directories with a trailing slash
+		if strings.HasSuffix(name, "/") {
+			st.Mode = st.Mode&^syscall.S_IFMT | syscall.S_IFDIR
+		}
+	case 'S':
+		st.Mode |= syscall.S_IFREG
+		if smap, err = tarerofsReadGnuSparse(tar, th); err != nil {
+			return err
+		}
+		realsize, err := tarParseNumber(th[tarGnuRealsizeOff : tarGnuRealsizeOff+12])
+		if err != nil || realsize < 0 {
+			return syscall.Errno(errs.EBADMSG)
+		}
+		eh.sparse, eh.sparseRealsize = true, uint64(realsize)
+	case '1':
+		st.Mode |= syscall.S_IFREG
+	case '2':
+		st.Mode |= syscall.S_IFLNK
+		st.Size = int64(len(link))
+	case '3', '4':
+		if typeflag == '3' {
+			st.Mode |= syscall.S_IFCHR
+		} else {
+			st.Mode |= syscall.S_IFBLK
+		}
+		major, err1 := tarParseNumber(th[tarDevmajorOff : tarDevmajorOff+8])
+		minor, err2 := tarParseNumber(th[tarDevminorOff : tarDevminorOff+8])
+		if err1 != nil || err2 != nil {
+			return syscall.Errno(errs.EBADMSG)
+		}
+		st.Rdev = unix.Mkdev(uint32(major), uint32(minor))
+	case '5', 'D':
+		// GNU dumpdir members are directories with a listing as data
+		st.Mode |= syscall.S_IFDIR
+	case '6':
+		st.Mode |= syscall.S_IFIFO
+	default:
+		// unknown types are extracted as regular files per POSIX
+		types.Warning("unknown typeflag %q of %s, treated as a regular file", typeflag, name)
+		st.Mode |= syscall.S_IFREG
+	}
+
+	if st.Mode&syscall.S_IFMT == syscall.S_IFREG && typeflag != '1' {
+		st.Size = size
+		if eh.sparse {
+			if eh.sparseMajor == 1 {
+				if smap, err = tarerofsReadSparseMap1(tar, &dataSize); err != nil {
+					types.Error("invalid sparse map of %s", name)
+					return err
+				}
+			} else if smap == nil {
+				smap = eh.sparseMap
+			}
+			st.Size = int64(eh.sparseRealsize)
+		}
+	}
+
+	relpath := erofsRebuildPath(name)
+	if err = tarerofsAddMember(root, tar, &eh, typeflag, relpath, link, &st, smap, &dataSize); err != nil {
+		types.Error("failed to add %s @ %d: %s", name, tarOffset, err)
+		return err
+	}
+
+	// skip the remaining data and the padding
+	return tar.ios.lskip(types.RoundUp(uint64(size), tarBlockSize) - (uint64(size) - dataSize))
+}
+
+// tarerofsOpaqueDir drops the entries of dir at relpath which come from
+// the lower layers
+func tarerofsOpaqueDir(tar *ErofsTarfile, dir *types.ErofsInode, relpath string) {
+	for pos := dir.ISubdirs.Next; pos != &dir.ISubdirs; {
+		d := types.ErofsDentryFromList(pos)
+
+		pos = pos.Next
+		if !tar.unpacked[path.Join(relpath, d.Name)] {
+			erofsRebuildDelDentry(d)
+		}
+	}
+}
+
+// tarerofsAddMember adds a member to the tree, consuming its data if it is
+// a regular file. dataSize is decreased by the amount of data consumed.
+func tarerofsAddMember(root *types.ErofsInode, tar *ErofsTarfile, eh *erofsPaxHeader,
+	typeflag byte, relpath, link string, st *syscall.Stat_t, smap []tarSparseEntry, dataSize *uint64) error {
+	var d *types.ErofsDentry
+	var inode *types.ErofsInode
+	var err error
+
+	if tar.Aufs || tar.Flatten {
+		dir, name := path.Split(relpath)
+
+		switch {
+		case name == tarAufsOpaque:
+			// the parent directory hides the lower layers
+			parent, err := erofsRebuildGetDir(root, dir)
+			if err != nil {
+				return err
+			}
+			if tar.Flatten {
+				tarerofsOpaqueDir(tar, parent, dir)
+			} else {
+				parent.Opaque = true
+			}
+			return nil
+		case strings.HasPrefix(name, tarAufsMetaPrefix):
+			types.Debug(types.EROFS_DBG, "ignored aufs metadata %s", relpath)
+			return nil
+		case strings.HasPrefix(name, tarAufsWhiteoutPrefix):
+			name = name[len(tarAufsWhiteoutPrefix):]
+			if name == "" {
+				return syscall.Errno(errs.EINVAL)
+			}
+			if tar.Flatten {
+				// nothing to hide if the lower layers don't have it
+				parent := erofsRebuildLookup(root, dir)
+				if parent != nil && parent.IsDir() {
+					if d = erofsDLookup(parent, name); d != nil {
+						erofsRebuildDelDentry(d)
+					}
+				}
+				return nil
+			}
+			parent, err := erofsRebuildGetDir(root, dir)
+			if err != nil {
+				return err
+			}
+			parent.Whiteouts = true
+
+			// overlayfs whiteouts are 0/0 character devices
+			relpath, typeflag = dir+name, '3'
+			st.Mode = syscall.S_IFCHR | st.Mode&07777
+			st.Rdev = 0
+			st.Size = 0
+		}
+	}
+
+	if tar.Flatten {
+		if tar.unpacked == nil {
+			tar.unpacked = make(map[string]bool)
+		}
+		for p := relpath; p != "." && !tar.unpacked[p]; p = path.Dir(p) {
+			tar.unpacked[p] = true
+		}
+	}
+
+	if typeflag == '1' {
+		target := erofsRebuildLookup(root, erofsRebuildPath(link))
+		if target == nil || target.IsDir() {
+			types.Error("invalid hardlink target %s", link)
+			return syscall.Errno(errs.ENOENT)
+		}
+		return erofsRebuildLink(root, relpath, target)
+	}
+
+	if inode, err = erofsRebuildSetInode(root, relpath, st); err != nil {
+		return err
+	}
+	if err = tarerofsApplyXattrs(inode, eh); err != nil {
+		return err
+	}
+
+	switch {
+	case inode.IsLnk():
+		inode.ILink = link
+	case inode.IsReg() && eh.sparse:
+		return erofsIostreamSpool(&tar.ios, inode, smap, dataSize)
+	case inode.IsReg() && inode.ISize != 0:
+		if inode.ISize != *dataSize {
+			return syscall.Errno(errs.EBADMSG)
+		}
+		if tar.IndexMode {
+			if err = erofsBlobMapChunks(inode, 1, tar.ios.pos); err != nil {
+				return err
+			}
+			*dataSize = 0
+			return tar.ios.lskip(inode.ISize)
+		}
+		if err = erofsIostreamFileData(&tar.ios, tar.strm, inode); err != nil {
+			return err
+		}
+		*dataSize = 0
+	}
+	return nil
+}
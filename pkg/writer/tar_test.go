@@ -0,0 +1,375 @@
+package writer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+func TestTarParseNumber(t *testing.T) {
+	tests := []struct {
+		name  string
+		field []byte
+		want  int64
+		fails bool
+	}{
+		{"octal", []byte("0000644\x00"), 0644, false},
+		{"octal with spaces", []byte("  755 \x00"), 0755, false},
+		{"empty", []byte("\x00\x00\x00\x00"), 0, false},
+		{"blank", []byte("        "), 0, false},
+		{"largest octal size", []byte("77777777777\x00"), 1<<33 - 1, false},
+		{"invalid digit", []byte("0000089\x00"), 0, true},
+		{"base-256", []byte{0x80, 0, 0, 0, 0, 0, 0, 0x02, 0, 0, 0, 0}, 1 << 33, false},
+		{"base-256 large", []byte{0x80, 0, 0, 0, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 1<<63 - 1, false},
+		{"base-256 negative", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}, -2, false},
+		{"base-256 overflow", []byte{0x80, 0, 0, 0, 0x80, 0, 0, 0, 0, 0, 0, 0}, 0, true},
+		{"base-256 too long", []byte{0x80, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tarParseNumber(tt.field)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("tarParseNumber(%q) = %d, want an error", tt.field, got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("tarParseNumber(%q) = %d, %v, want %d", tt.field, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTarParsePaxTime(t *testing.T) {
+	tests := []struct {
+		in    string
+		sec   int64
+		nsec  uint32
+		fails bool
+	}{
+		{"1700000000", 1700000000, 0, false},
+		{"1700000000.5", 1700000000, 500000000, false},
+		{"1.000000001", 1, 1, false},
+		{"1.1234567899", 1, 123456789, false},
+		{"-1.25", -2, 750000000, false},
+		{"-3", -3, 0, false},
+		{"", 0, 0, true},
+		{"abc", 0, 0, true},
+		{"1.5x", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		sec, nsec, err := tarParsePaxTime(tt.in)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("tarParsePaxTime(%q) = %d.%09d, want an error", tt.in, sec, nsec)
+			}
+			continue
+		}
+		if err != nil || sec != tt.sec || nsec != tt.nsec {
+			t.Errorf("tarParsePaxTime(%q) = %d, %d, %v, want %d, %d",
+				tt.in, sec, nsec, err, tt.sec, tt.nsec)
+		}
+	}
+}
+
+// tarTestSum fills in the checksum of header block th
+func tarTestSum(th []byte) []byte {
+	var sum int
+
+	copy(th[tarChksumOff:tarChksumOff+8], "        ")
+	for _, c := range th {
+		sum += int(c)
+	}
+	copy(th[tarChksumOff:], fmt.Sprintf("%06o\x00 ", sum))
+	return th
+}
+
+// tarTestHeader returns the ustar header block of a member
+func tarTestHeader(name string, typeflag byte, size int64) []byte {
+	th := make([]byte, tarBlockSize)
+
+	copy(th[tarNameOff:], name)
+	copy(th[tarModeOff:], "0000644\x00")
+	copy(th[tarUidOff:], "0001750\x00")
+	copy(th[tarGidOff:], "0001750\x00")
+	copy(th[tarSizeOff:], fmt.Sprintf("%011o\x00", size))
+	copy(th[tarMtimeOff:], fmt.Sprintf("%011o\x00", 1700000000))
+	th[tarTypeflagOff] = typeflag
+	copy(th[tarMagicOff:], "ustar\x0000")
+	return tarTestSum(th)
+}
+
+// tarTestPad pads data to whole tar blocks
+func tarTestPad(data []byte) []byte {
+	return append(data, make([]byte, types.RoundUp(uint64(len(data)), tarBlockSize)-uint64(len(data)))...)
+}
+
+// tarTestMember returns a member with its header and padded data
+func tarTestMember(name string, typeflag byte, data string) []byte {
+	return append(tarTestHeader(name, typeflag, int64(len(data))), tarTestPad([]byte(data))...)
+}
+
+// tarTestPax returns a PAX extended header member of "key=value" records
+func tarTestPax(typeflag byte, records ...string) []byte {
+	var data string
+
+	for _, kv := range records {
+		// the length field counts itself
+		n := len(kv) + 2
+		for n != len(strconv.Itoa(n))+len(kv)+2 {
+			n = len(strconv.Itoa(n)) + len(kv) + 2
+		}
+		data += fmt.Sprintf("%d %s\n", n, kv)
+	}
+	return tarTestMember("PaxHeaders/x", typeflag, data)
+}
+
+// tarTestGnuSparse returns an old GNU sparse member of data stored in the
+// segments of smap
+func tarTestGnuSparse(name string, realsize int64, smap []tarSparseEntry, data string) []byte {
+	th := tarTestHeader(name, 'S', int64(len(data)))
+
+	copy(th[tarMagicOff:], "ustar  \x00")
+	for i, ent := range smap {
+		p := th[tarGnuSparseOff+i*24:]
+		copy(p, fmt.Sprintf("%011o\x00%011o\x00", ent.offset, ent.numbytes))
+	}
+	copy(th[tarGnuRealsizeOff:], fmt.Sprintf("%011o\x00", realsize))
+	return append(tarTestSum(th), tarTestPad([]byte(data))...)
+}
+
+// erofsTestMakeRoot sets up the filesystem for a tree built in memory and
+// returns its root
+func erofsTestMakeRoot(t *testing.T) *types.ErofsInode {
+	t.Helper()
+
+	types.GCfg.DebugLevel = types.EROFS_ERR
+	types.GSbi.BlkSzBits = 12
+	types.GSbi.BDev = &types.ErofsVFile{}
+	types.ErofsInodeManagerInit()
+	if err := types.ErofsDiskbufInit(1); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(types.ErofsDiskbufExit)
+
+	root, err := ErofsRebuildMakeRoot(&types.GSbi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// erofsTestData reads the data of a regular file back from its diskbuf
+func erofsTestData(t *testing.T, inode *types.ErofsInode) string {
+	t.Helper()
+
+	if inode.IDiskbuf == nil {
+		t.Fatalf("%s has no data", inode.ISrcpath)
+	}
+	strm := (*types.ErofsDiskBufStrm)(inode.IDiskbuf.Sp)
+	buf := make([]byte, inode.ISize)
+	if _, err := syscall.Pread(strm.Fd, buf, int64(inode.IDiskbuf.Offset+strm.DevPos)); err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+// tarTestParse parses the archive of members into a new tree
+func tarTestParse(t *testing.T, members ...[]byte) (*types.ErofsInode, error) {
+	t.Helper()
+
+	fn := filepath.Join(t.TempDir(), "test.tar")
+	archive := append(bytes.Join(members, nil), make([]byte, 2*tarBlockSize)...)
+	if err := os.WriteFile(fn, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root := erofsTestMakeRoot(t)
+	tar, err := ErofsTarOpen(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ErofsTarClose(tar) })
+
+	for {
+		if err = TarerofsParseTar(root, tar); err == io.EOF {
+			return root, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func TestTarerofsParseTar(t *testing.T) {
+	hole := string(make([]byte, 8188))
+	smap := []tarSparseEntry{{0, 4}, {8192, 4}}
+
+	tests := []struct {
+		name    string
+		members [][]byte
+		path    string
+		size    uint64
+		uid     uint32
+		mtime   uint64
+		nsec    uint32
+		data    string
+	}{
+		{
+			name:    "ustar",
+			members: [][]byte{tarTestMember("dir/file", '0', "hello")},
+			path:    "dir/file", size: 5, uid: 1000, mtime: 1700000000, data: "hello",
+		},
+		{
+			name: "pax overrides",
+			members: [][]byte{
+				tarTestPax('x', "path=a/very/long/name", "uid=42", "mtime=1600000000.25", "size=3"),
+				tarTestMember("short", '0', "abc"),
+			},
+			path: "a/very/long/name", size: 3, uid: 42, mtime: 1600000000, nsec: 250000000, data: "abc",
+		},
+		{
+			name: "pax global header",
+			members: [][]byte{
+				tarTestPax('g', "uid=7"),
+				tarTestMember("first", '0', "1"),
+				tarTestMember("second", '0', "2"),
+			},
+			path: "second", size: 1, uid: 7, mtime: 1700000000, data: "2",
+		},
+		{
+			name: "gnu long name",
+			members: [][]byte{
+				tarTestMember("././@LongLink", 'L', "long/path/of/file\x00"),
+				tarTestMember("long/path/of/f", '0', "x"),
+			},
+			path: "long/path/of/file", size: 1, uid: 1000, mtime: 1700000000, data: "x",
+		},
+		{
+			name:    "gnu sparse",
+			members: [][]byte{tarTestGnuSparse("sparse", 8196, smap, "AAAABBBB")},
+			path:    "sparse", size: 8196, uid: 1000, mtime: 1700000000, data: "AAAA" + hole + "BBBB",
+		},
+		{
+			name: "pax sparse 0.1",
+			members: [][]byte{
+				tarTestPax('x', "GNU.sparse.map=0,4,8192,4", "GNU.sparse.realsize=8196",
+					"GNU.sparse.name=sparse"),
+				tarTestMember("GNUSparseFile.0/sparse", '0', "AAAABBBB"),
+			},
+			path: "sparse", size: 8196, uid: 1000, mtime: 1700000000, data: "AAAA" + hole + "BBBB",
+		},
+		{
+			name: "pax sparse 0.0",
+			members: [][]byte{
+				tarTestPax('x', "GNU.sparse.offset=0", "GNU.sparse.numbytes=4",
+					"GNU.sparse.offset=8192", "GNU.sparse.numbytes=4",
+					"GNU.sparse.size=8196", "GNU.sparse.name=sparse"),
+				tarTestMember("GNUSparseFile.0/sparse", '0', "AAAABBBB"),
+			},
+			path: "sparse", size: 8196, uid: 1000, mtime: 1700000000, data: "AAAA" + hole + "BBBB",
+		},
+		{
+			name: "pax sparse 1.0",
+			members: [][]byte{
+				tarTestPax('x', "GNU.sparse.major=1", "GNU.sparse.minor=0",
+					"GNU.sparse.realsize=8196", "GNU.sparse.name=sparse"),
+				tarTestMember("GNUSparseFile.0/sparse", '0',
+					string(tarTestPad([]byte("2\n0\n4\n8192\n4\n")))+"AAAABBBB"),
+			},
+			path: "sparse", size: 8196, uid: 1000, mtime: 1700000000, data: "AAAA" + hole + "BBBB",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := tarTestParse(t, tt.members...)
+			if err != nil {
+				t.Fatalf("TarerofsParseTar() = %v", err)
+			}
+			inode := erofsRebuildLookup(root, tt.path)
+			if inode == nil {
+				t.Fatalf("%s not found", tt.path)
+			}
+			if inode.ISize != tt.size || inode.IUid != tt.uid ||
+				inode.IMtime != tt.mtime || inode.IMtimeNsec != tt.nsec {
+				t.Errorf("%s: size %d uid %d mtime %d.%09d, want %d %d %d.%09d", tt.path,
+					inode.ISize, inode.IUid, inode.IMtime, inode.IMtimeNsec,
+					tt.size, tt.uid, tt.mtime, tt.nsec)
+			}
+			if data := erofsTestData(t, inode); data != tt.data {
+				t.Errorf("%s: data %q, want %q", tt.path, data, tt.data)
+			}
+		})
+	}
+}
+
+func TestTarerofsParseTarMalformed(t *testing.T) {
+	badChksum := tarTestMember("file", '0', "x")
+	badChksum[tarNameOff] = 'F'
+
+	badSize := tarTestHeader("file", '0', 0)
+	copy(badSize[tarSizeOff:], "0000000009x\x00")
+	tarTestSum(badSize)
+
+	tests := []struct {
+		name    string
+		members [][]byte
+		errno   syscall.Errno // 0 if any error is fine
+	}{
+		{"checksum mismatch", [][]byte{badChksum}, syscall.Errno(errs.EBADMSG)},
+		{"invalid size", [][]byte{badSize}, syscall.Errno(errs.EBADMSG)},
+		{"truncated data", [][]byte{tarTestHeader("file", '0', 4096)}, 0},
+		{"pax record length", [][]byte{tarTestMember("PaxHeaders/x", 'x', "99 path=x\n")}, syscall.Errno(errs.EBADMSG)},
+		{"pax record without value", [][]byte{tarTestPax('x', "path")}, syscall.Errno(errs.EBADMSG)},
+		{"pax invalid mtime", [][]byte{tarTestPax('x', "mtime=abc")}, syscall.Errno(errs.EBADMSG)},
+		{"pax invalid uid", [][]byte{tarTestPax('x', "uid=-1")}, syscall.Errno(errs.EBADMSG)},
+		{"odd sparse map", [][]byte{tarTestPax('x', "GNU.sparse.map=0,4,8192")}, syscall.Errno(errs.EBADMSG)},
+		{"sparse numbytes without offset", [][]byte{tarTestPax('x', "GNU.sparse.numbytes=4")}, syscall.Errno(errs.EBADMSG)},
+		{
+			"sparse map beyond the file",
+			[][]byte{
+				tarTestPax('x', "GNU.sparse.map=0,4,8192,4", "GNU.sparse.realsize=4096"),
+				tarTestMember("sparse", '0', "AAAABBBB"),
+			},
+			syscall.Errno(errs.EBADMSG),
+		},
+		{
+			"sparse map beyond the data",
+			[][]byte{tarTestGnuSparse("sparse", 8196, []tarSparseEntry{{0, 4}, {8192, 4}}, "AAAA")},
+			syscall.Errno(errs.EBADMSG),
+		},
+		{
+			"sparse 1.0 map without count",
+			[][]byte{
+				tarTestPax('x', "GNU.sparse.major=1", "GNU.sparse.realsize=8196"),
+				tarTestMember("sparse", '0', "x\n"),
+			},
+			syscall.Errno(errs.EBADMSG),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tarTestParse(t, tt.members...)
+			if err == nil {
+				t.Fatal("TarerofsParseTar() succeeded, want an error")
+			}
+			if tt.errno != 0 && !errors.Is(err, tt.errno) {
+				t.Fatalf("TarerofsParseTar() = %v, want %v", err, tt.errno)
+			}
+		})
+	}
+}
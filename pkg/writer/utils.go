@@ -1 +1,58 @@
 package writer
+
+import (
+	"unsafe"
+
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+// ErofsModeToFtype converts a file mode to the on-disk dirent file type
+func ErofsModeToFtype(mode uint16) uint8 {
+	switch mode & types.S_IFMT {
+	case types.S_IFREG:
+		return types.EROFS_FT_REG_FILE
+	case types.S_IFDIR:
+		return types.EROFS_FT_DIR
+	case types.S_IFCHR:
+		return types.EROFS_FT_CHRDEV
+	case types.S_IFBLK:
+		return types.EROFS_FT_BLKDEV
+	case types.S_IFIFO:
+		return types.EROFS_FT_FIFO
+	case types.S_IFSOCK:
+		return types.EROFS_FT_SOCK
+	case types.S_IFLNK:
+		return types.EROFS_FT_SYMLINK
+	}
+	return types.EROFS_FT_UNKNOWN
+}
+
+// erofsIdata returns the tail-end data of the inode as a byte slice
+func erofsIdata(inode *types.ErofsInode) []byte {
+	if inode.Idata == nil || inode.IdataSize == 0 {
+		return nil
+	}
+	return unsafe.Slice((*byte)(inode.Idata), inode.IdataSize)
+}
+
+// erofsSetIdata stores data as the tail-end data of the inode
+func erofsSetIdata(inode *types.ErofsInode, data []byte) {
+	inode.IdataSize = uint16(len(data))
+	if len(data) == 0 {
+		inode.Idata = nil
+		return
+	}
+	inode.Idata = unsafe.Pointer(&data[0])
+}
+
+// erofsInodeXattrIcount is EROFS_INODE_XATTR_ICOUNT
+func erofsInodeXattrIcount(xattrIsize uint32) uint16 {
+	if xattrIsize == 0 {
+		return 0
+	}
+	return uint16(1 + (xattrIsize-types.EROFS_XATTR_IBODY_HDR_SIZE)/types.EROFS_XATTR_ENTRY_SIZE)
+}
+
+func isDotDotdot(name string) bool {
+	return name == "." || name == ".."
+}
@@ -1 +1,693 @@
 package writer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/util"
+	"golang.org/x/sys/unix"
+)
+
+// xattrItem is a deduplicated xattr name/value pair
+type xattrItem struct {
+	nextSharedXattr *xattrItem
+	kvbuf           []byte    // name (without its prefix) followed by value
+	len             [2]uint32 // name and value length
+	count           uint32
+	sharedXattrID   int
+	prefix          uint8
+}
+
+// inodeXattrNode links an xattr item into ErofsInode.IXattrs
+type inodeXattrNode struct {
+	list types.ListHead
+	item *xattrItem
+}
+
+// xattrPair is an xattr given by its full name
+type xattrPair struct {
+	key   string
+	value []byte
+}
+
+type xattrKey struct {
+	prefix  uint8
+	nameLen uint32
+	kv      string
+}
+
+var (
+	xattrHashmap = make(map[xattrKey]*xattrItem)
+
+	sharedXattrsList  *xattrItem
+	sharedXattrsCount uint32
+)
+
+// eaTypeNode is a registered long xattr name prefix
+type eaTypeNode struct {
+	prefix    string
+	index     uint8 // EROFSXattrLongPrefix | the position in eaNamePrefixes
+	baseIndex uint8
+	baseLen   int
+}
+
+var eaNamePrefixes []*eaTypeNode
+
+// xattrTypes are the builtin name prefixes indexed by EROFSXattrIndex*
+var xattrTypes = [...]string{
+	types.EROFSXattrIndexUser:            "user.",
+	types.EROFSXattrIndexPosixACLAccess:  "system.posix_acl_access",
+	types.EROFSXattrIndexPosixACLDefault: "system.posix_acl_default",
+	types.EROFSXattrIndexTrusted:         "trusted.",
+	types.EROFSXattrIndexSecurity:        "security.",
+}
+
+func inodeXattrNodeFromList(list *types.ListHead) *inodeXattrNode {
+	offset := unsafe.Offsetof(inodeXattrNode{}.list)
+	return (*inodeXattrNode)(unsafe.Pointer(uintptr(unsafe.Pointer(list)) - offset))
+}
+
+// EROFS_XATTR_ALIGN
+func erofsXattrAlign(size uint32) uint32 {
+	return (size + types.EROFS_XATTR_ENTRY_SIZE - 1) &^ (types.EROFS_XATTR_ENTRY_SIZE - 1)
+}
+
+func matchBasePrefix(key string) (uint8, int, bool) {
+	for index, prefix := range xattrTypes {
+		if prefix != "" && len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+			return uint8(index), len(prefix), true
+		}
+	}
+	return 0, 0, false
+}
+
+func matchPrefix(key string) (uint8, int, bool) {
+	for _, tnode := range eaNamePrefixes {
+		if strings.HasPrefix(key, tnode.prefix) {
+			return tnode.index, len(tnode.prefix), true
+		}
+	}
+	return matchBasePrefix(key)
+}
+
+// ErofsXattrInsertNamePrefix registers a long xattr name prefix, which
+// has to start with one of the builtin prefixes
+func ErofsXattrInsertNamePrefix(prefix string) error {
+	if len(eaNamePrefixes) >= types.EROFSXattrLongPrefix || len(prefix) > math.MaxUint8 {
+		return syscall.Errno(errs.EOVERFLOW)
+	}
+
+	baseIndex, baseLen, ok := matchBasePrefix(prefix)
+	if !ok {
+		return syscall.Errno(errs.ENODATA)
+	}
+
+	eaNamePrefixes = append(eaNamePrefixes, &eaTypeNode{
+		prefix:    prefix,
+		index:     types.EROFSXattrLongPrefix | uint8(len(eaNamePrefixes)),
+		baseIndex: baseIndex,
+		baseLen:   baseLen,
+	})
+	return nil
+}
+
+// ErofsXattrFlushNamePrefixes writes the long xattr name prefix table to
+// the metadata area and sets the XATTR_PREFIXES feature
+func ErofsXattrFlushNamePrefixes(sbi *types.SuperBlkInfo) error {
+	if len(eaNamePrefixes) == 0 {
+		return nil
+	}
+
+	var prefixSize uint32
+	for _, tnode := range eaNamePrefixes {
+		// __le16 size, base_index and infix
+		prefixSize = erofsXattrAlign(prefixSize + 2 + 1 + uint32(len(tnode.prefix)-tnode.baseLen))
+	}
+
+	bh, err := types.Balloc(sbi.Bmgr, types.XATTR, uint64(prefixSize), 0, 0)
+	if err != nil {
+		return err
+	}
+	bh.Op = &types.DropDirectlyBhops
+
+	types.MapBh(nil, bh.Block)
+	offset := types.BhTell(bh, false)
+	if offset > math.MaxUint32 {
+		types.BDrop(bh, false)
+		return syscall.Errno(errs.EOVERFLOW)
+	}
+	sbi.XattrPrefixStart = uint32(offset >> 2)
+	sbi.XattrPrefixCount = uint8(len(eaNamePrefixes))
+	sbi.XattrPrefixes = make([]types.XattrPrefixItem, 0, len(eaNamePrefixes))
+
+	buf := make([]byte, prefixSize)
+	p := uint32(0)
+	for _, tnode := range eaNamePrefixes {
+		infix := []byte(tnode.prefix[tnode.baseLen:])
+		length := 1 + uint32(len(infix))
+
+		binary.LittleEndian.PutUint16(buf[p:], uint16(length))
+		buf[p+2] = tnode.baseIndex
+		copy(buf[p+3:], infix)
+		p = erofsXattrAlign(p + 2 + length)
+
+		sbi.XattrPrefixes = append(sbi.XattrPrefixes, types.XattrPrefixItem{
+			Prefix:   &types.XattrLongPrefix{BaseIndex: tnode.baseIndex, Infix: infix},
+			InfixLen: uint8(len(infix)),
+		})
+	}
+
+	ret := types.ErofsDevWrite(sbi, buf, offset, len(buf))
+	types.BDrop(bh, false)
+	if ret != 0 {
+		return syscall.Errno(-ret)
+	}
+	types.ErofsSbSetXattrPrefixes(sbi)
+	return nil
+}
+
+func getXattritem(prefix uint8, kvbuf []byte, len [2]uint32) *xattrItem {
+	key := xattrKey{prefix: prefix, nameLen: len[0], kv: string(kvbuf)}
+
+	if item, ok := xattrHashmap[key]; ok {
+		item.count++
+		return item
+	}
+
+	item := &xattrItem{
+		kvbuf:         kvbuf,
+		len:           len,
+		count:         1,
+		sharedXattrID: -1,
+		prefix:        prefix,
+	}
+	xattrHashmap[key] = item
+	return item
+}
+
+func parseOneXattr(path, key string) (*xattrItem, error) {
+	prefix, prefixlen, ok := matchPrefix(key)
+	if !ok {
+		types.Info("skipping unidentified xattr: %s", key)
+		return nil, nil
+	}
+
+	// determine length of the value
+	vallen, err := unix.Lgetxattr(path, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	kvbuf := make([]byte, len(key)-prefixlen+vallen)
+	copy(kvbuf, key[prefixlen:])
+	if vallen != 0 {
+		// copy value to buffer
+		n, err := unix.Lgetxattr(path, key, kvbuf[len(key)-prefixlen:])
+		if err != nil {
+			return nil, err
+		}
+		vallen = n
+		kvbuf = kvbuf[:len(key)-prefixlen+vallen]
+	}
+
+	if erofsIsAclIndex(prefix) {
+		if err = erofsAclValidateXattr(path, kvbuf[len(key)-prefixlen:]); err != nil {
+			return nil, err
+		}
+	}
+	return getXattritem(prefix, kvbuf, [2]uint32{uint32(len(key) - prefixlen), uint32(vallen)}), nil
+}
+
+// erofsInodeXattrDel removes the xattr named key from ixattrs if any
+func erofsInodeXattrDel(ixattrs *types.ListHead, key string) {
+	prefix, prefixlen, ok := matchPrefix(key)
+	if !ok {
+		return
+	}
+	name := key[prefixlen:]
+
+	for pos := ixattrs.Next; pos != ixattrs; {
+		n := pos.Next
+		item := inodeXattrNodeFromList(pos).item
+
+		if item.prefix == prefix && string(item.kvbuf[:item.len[0]]) == name {
+			types.ListDel(pos)
+		}
+		pos = n
+	}
+}
+
+// erofsOvlXattrPrefix returns the namespace of overlayfs xattrs
+func erofsOvlXattrPrefix() string {
+	if types.GCfg.OvlfsUserXattr {
+		return "user.overlay."
+	}
+	return "trusted.overlay."
+}
+
+// erofsSetOpaqueXattr marks dir as an opaque overlayfs directory
+func erofsSetOpaqueXattr(dir *types.ErofsInode) error {
+	return erofsSetxattr(dir, erofsOvlXattrPrefix()+"opaque", []byte("y"))
+}
+
+// erofsSetxattr sets the xattr key of inode, replacing the existing one
+func erofsSetxattr(inode *types.ErofsInode, key string, value []byte) error {
+	prefix, prefixlen, ok := matchPrefix(key)
+	if !ok {
+		return syscall.Errno(errs.ENODATA)
+	}
+	if erofsIsAclIndex(prefix) {
+		if err := erofsAclValidateXattr(inode.ISrcpath, value); err != nil {
+			return err
+		}
+	}
+
+	name := key[prefixlen:]
+	kvbuf := append([]byte(name), value...)
+	erofsInodeXattrDel(&inode.IXattrs, key)
+	inodeXattrAdd(&inode.IXattrs, getXattritem(prefix, kvbuf,
+		[2]uint32{uint32(len(name)), uint32(len(value))}))
+	return nil
+}
+
+func inodeXattrAdd(ixattrs *types.ListHead, item *xattrItem) {
+	node := &inodeXattrNode{item: item}
+	types.InitListHead(&node.list)
+	types.ListAddTail(&node.list, ixattrs)
+}
+
+func sharedXattrAdd(item *xattrItem) {
+	if item.count == uint32(types.GCfg.InlineXattrTolerance)+1 {
+		item.nextSharedXattr = sharedXattrsList
+		sharedXattrsList = item
+		sharedXattrsCount++
+	}
+}
+
+// erofsXattrDiskName returns the full name of an on-disk xattr entry
+func erofsXattrDiskName(sbi *types.SuperBlkInfo, index uint8, name []byte) (string, bool) {
+	if index&types.EROFSXattrLongPrefix != 0 {
+		i := int(index &^ types.EROFSXattrLongPrefix)
+		if i >= len(sbi.XattrPrefixes) {
+			return "", false
+		}
+		p := sbi.XattrPrefixes[i].Prefix
+		if int(p.BaseIndex) >= len(xattrTypes) || xattrTypes[p.BaseIndex] == "" {
+			return "", false
+		}
+		return xattrTypes[p.BaseIndex] + string(p.Infix) + string(name), true
+	}
+	if int(index) >= len(xattrTypes) || xattrTypes[index] == "" {
+		return "", false
+	}
+	return xattrTypes[index] + string(name), true
+}
+
+// erofsReadXattrsFromDisk returns the xattrs of an inode in an image,
+// including the shared ones
+func erofsReadXattrsFromDisk(vi *types.ErofsInode) ([]xattrPair, error) {
+	sbi := vi.Sbi
+	if vi.XattrIsize == 0 {
+		return nil, nil
+	}
+	if vi.XattrIsize < types.EROFS_XATTR_IBODY_HDR_SIZE {
+		return nil, syscall.Errno(errs.EFSCORRUPTED)
+	}
+
+	ibody := make([]byte, vi.XattrIsize)
+	pos := types.ErofsIloc(vi) + uint64(vi.InodeIsize)
+	if _, err := types.ErofsDevRead(sbi, 0, ibody, pos, int64(len(ibody))); err != nil {
+		return nil, err
+	}
+
+	var xattrs []xattrPair
+	add := func(entry []byte) (uint32, error) {
+		if len(entry) < types.EROFS_XATTR_ENTRY_SIZE {
+			return 0, syscall.Errno(errs.EFSCORRUPTED)
+		}
+		nameLen := uint32(entry[0])
+		valueSize := uint32(binary.LittleEndian.Uint16(entry[2:]))
+		size := types.EROFS_XATTR_ENTRY_SIZE + nameLen + valueSize
+		if uint32(len(entry)) < size {
+			return 0, syscall.Errno(errs.EFSCORRUPTED)
+		}
+
+		kv := entry[types.EROFS_XATTR_ENTRY_SIZE:size]
+		key, ok := erofsXattrDiskName(sbi, entry[1], kv[:nameLen])
+		if !ok {
+			types.Warning("ignored xattr of unknown prefix %d @ nid %d", entry[1], vi.Nid)
+		} else {
+			xattrs = append(xattrs, xattrPair{key: key, value: append([]byte(nil), kv[nameLen:]...)})
+		}
+		return erofsXattrAlign(size), nil
+	}
+
+	// shared xattr ids come first, followed by inline xattrs
+	shared := uint32(ibody[4])
+	p := uint32(types.EROFS_XATTR_IBODY_HDR_SIZE)
+	if p+4*shared > vi.XattrIsize {
+		return nil, syscall.Errno(errs.EFSCORRUPTED)
+	}
+	for i := uint32(0); i < shared; i++ {
+		var hdr [types.EROFS_XATTR_ENTRY_SIZE]byte
+
+		off := types.ErofsPos(sbi, uint64(sbi.XattrBlkAddr)) +
+			4*uint64(binary.LittleEndian.Uint32(ibody[p:]))
+		if _, err := types.ErofsDevRead(sbi, 0, hdr[:], off, int64(len(hdr))); err != nil {
+			return nil, err
+		}
+		entry := make([]byte, types.EROFS_XATTR_ENTRY_SIZE+uint32(hdr[0])+
+			uint32(binary.LittleEndian.Uint16(hdr[2:])))
+		if _, err := types.ErofsDevRead(sbi, 0, entry, off, int64(len(entry))); err != nil {
+			return nil, err
+		}
+		if _, err := add(entry); err != nil {
+			return nil, err
+		}
+		p += 4
+	}
+	for p < vi.XattrIsize {
+		n, err := add(ibody[p:])
+		if err != nil {
+			types.Error("corrupted xattrs @ nid %d", vi.Nid)
+			return nil, err
+		}
+		p += n
+	}
+	return xattrs, nil
+}
+
+// readXattrsFromFile adds the xattrs of path to ixattrs, or counts them
+// as candidates of shared xattrs if ixattrs is nil
+func readXattrsFromFile(path string, mode uint16, ixattrs *types.ListHead) error {
+	// determine the length of all keys
+	kllen, err := unix.Llistxattr(path, nil)
+	if err != nil && !errors.Is(err, unix.ENODATA) && !errors.Is(err, unix.EOPNOTSUPP) {
+		types.Error("llistxattr to get the size of names for %s failed", path)
+		return err
+	}
+
+	if kllen > 1 {
+		keylst := make([]byte, kllen)
+		// copy the list of attribute keys to the buffer
+		kllen, err = unix.Llistxattr(path, keylst)
+		if err != nil {
+			types.Error("llistxattr to get names for %s failed", path)
+			return err
+		}
+
+		for _, key := range bytes.Split(keylst[:kllen], []byte{0}) {
+			if len(key) == 0 || erofsIsSkippedXattr(string(key)) {
+				continue
+			}
+			item, err := parseOneXattr(path, string(key))
+			if err != nil {
+				return err
+			}
+			if item == nil {
+				continue
+			}
+			if ixattrs == nil {
+				sharedXattrAdd(item)
+				continue
+			}
+			inodeXattrAdd(ixattrs, item)
+		}
+	}
+
+	// if some selabel is available, it needs to be inserted into the inode
+	item, err := erofsGetSelabelXattr(path, mode)
+	if err != nil {
+		return err
+	}
+	if item != nil {
+		if ixattrs == nil {
+			sharedXattrAdd(item)
+		} else {
+			inodeXattrAdd(ixattrs, item)
+		}
+	}
+	return nil
+}
+
+// ErofsScanFileXattrs collects the xattrs of the source file of inode
+func ErofsScanFileXattrs(inode *types.ErofsInode) error {
+	// check if xattr is disabled
+	if types.GCfg.InlineXattrTolerance < 0 {
+		return nil
+	}
+	if err := readXattrsFromFile(inode.ISrcpath, inode.IMode, &inode.IXattrs); err != nil {
+		return err
+	}
+	if err := erofsDroidXattrSetCaps(inode); err != nil {
+		return err
+	}
+	return erofsManifestApplyXattrs(inode)
+}
+
+func erofsCountAllXattrsFromPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		types.Error("failed to opendir at %s: %s", path, err)
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		var st syscall.Stat_t
+
+		if isDotDotdot(name) {
+			continue
+		}
+		buf := filepath.Join(path, name)
+		if err = syscall.Lstat(buf, &st); err != nil {
+			return err
+		}
+		if err = readXattrsFromFile(buf, uint16(st.Mode), nil); err != nil {
+			return err
+		}
+		if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			continue
+		}
+		if err = erofsCountAllXattrsFromPath(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// erofsCleanxattrs drops all xattr items, keeping the shared ones if
+// sharedxattrs is set
+func erofsCleanxattrs(sharedxattrs bool) {
+	for key, item := range xattrHashmap {
+		if sharedxattrs && item.sharedXattrID >= 0 {
+			continue
+		}
+		delete(xattrHashmap, key)
+	}
+	if sharedxattrs {
+		return
+	}
+	sharedXattrsList = nil
+	sharedXattrsCount = 0
+}
+
+// ErofsBuildSharedXattrsFromPath scans the whole source tree and moves
+// xattrs used by more than InlineXattrTolerance files into the shared
+// xattr area, which inodes reference by index instead
+func ErofsBuildSharedXattrsFromPath(sbi *types.SuperBlkInfo, path string) error {
+	// check if xattr or shared xattr is disabled
+	if types.GCfg.InlineXattrTolerance < 0 ||
+		types.GCfg.InlineXattrTolerance == math.MaxInt32 {
+		return nil
+	}
+
+	if err := erofsCountAllXattrsFromPath(path); err != nil {
+		return err
+	}
+
+	if sharedXattrsCount == 0 {
+		erofsCleanxattrs(true)
+		return nil
+	}
+
+	var sharedXattrsSize uint32
+	sortedN := make([]*xattrItem, 0, sharedXattrsCount)
+	for item := sharedXattrsList; item != nil; item = item.nextSharedXattr {
+		sortedN = append(sortedN, item)
+		sharedXattrsSize += types.EROFS_XATTR_ENTRY_SIZE
+		sharedXattrsSize = erofsXattrAlign(sharedXattrsSize + item.len[0] + item.len[1])
+	}
+	sort.Slice(sortedN, func(i, j int) bool {
+		return bytes.Compare(sortedN[i].kvbuf, sortedN[j].kvbuf) < 0
+	})
+
+	buf := make([]byte, sharedXattrsSize)
+	bh, err := types.Balloc(sbi.Bmgr, types.XATTR, uint64(sharedXattrsSize), 0, 0)
+	if err != nil {
+		return err
+	}
+	bh.Op = &types.DropDirectlyBhops
+
+	types.MapBh(nil, bh.Block)
+	off := types.BhTell(bh, false)
+
+	sbi.XattrBlkAddr = uint32(off >> sbi.BlkSzBits)
+	off &= uint64(types.ErofsBlkSiz(sbi)) - 1
+	p := uint32(0)
+	for i, item := range sortedN {
+		buf[p] = uint8(item.len[0])
+		buf[p+1] = item.prefix
+		binary.LittleEndian.PutUint16(buf[p+2:], uint16(item.len[1]))
+
+		item.sharedXattrID = int((off + uint64(p)) / 4)
+		if i+1 < len(sortedN) {
+			item.nextSharedXattr = sortedN[i+1]
+		} else {
+			item.nextSharedXattr = nil
+		}
+
+		p += types.EROFS_XATTR_ENTRY_SIZE
+		copy(buf[p:], item.kvbuf[:item.len[0]+item.len[1]])
+		p = erofsXattrAlign(p + item.len[0] + item.len[1])
+	}
+	sharedXattrsList = sortedN[0]
+
+	ret := types.ErofsDevWrite(sbi, buf, types.BhTell(bh, false), len(buf))
+	types.BDrop(bh, false)
+	if ret != 0 {
+		return syscall.Errno(-ret)
+	}
+	erofsCleanxattrs(true)
+	return nil
+}
+
+// ErofsPrepareXattrIbody calculates the size of the xattr ibody of inode
+func ErofsPrepareXattrIbody(inode *types.ErofsInode) error {
+	ixattrs := &inode.IXattrs
+
+	if types.IsListEmpty(ixattrs) {
+		inode.XattrIsize = 0
+		return nil
+	}
+
+	// get xattr ibody size
+	ret := uint32(types.EROFS_XATTR_IBODY_HDR_SIZE)
+	inode.XattrSharedCount = 0
+	for pos := ixattrs.Next; pos != ixattrs; pos = pos.Next {
+		item := inodeXattrNodeFromList(pos).item
+
+		if item.sharedXattrID >= 0 {
+			inode.XattrSharedCount++
+			ret += 4
+			continue
+		}
+		ret += types.EROFS_XATTR_ENTRY_SIZE
+		ret = erofsXattrAlign(ret + item.len[0] + item.len[1])
+	}
+	inode.XattrIsize = ret
+	return nil
+}
+
+func erofsXattrFilterHashbit(item *xattrItem) (uint32, error) {
+	prefix := item.prefix
+	key := item.kvbuf[:item.len[0]]
+
+	if prefix&types.EROFSXattrLongPrefix != 0 {
+		var name string
+
+		for _, tnode := range eaNamePrefixes {
+			if tnode.index == item.prefix {
+				name = tnode.prefix + string(key)
+				break
+			}
+		}
+		if name == "" {
+			return 0, syscall.Errno(errs.ENOENT)
+		}
+
+		base, prefixLen, ok := matchBasePrefix(name)
+		if !ok {
+			return 0, syscall.Errno(errs.ENOENT)
+		}
+		prefix = base
+		key = []byte(name[prefixLen:])
+	}
+
+	return util.Xxh32(key, types.EROFSXattrFilterSeed+uint32(prefix)) &
+		(types.EROFSXattrFilterBits - 1), nil
+}
+
+// erofsXattrFilterMap computes the xattr name bloom filter of ixattrs, in
+// which a set bit means that no xattr name is hashed to it
+func erofsXattrFilterMap(ixattrs *types.ListHead) uint32 {
+	var nameFilter uint32
+
+	for pos := ixattrs.Next; pos != ixattrs; pos = pos.Next {
+		hashbit, err := erofsXattrFilterHashbit(inodeXattrNodeFromList(pos).item)
+		if err != nil {
+			types.Warning("failed to generate xattr name filter: %s", err)
+			return 0
+		}
+		nameFilter |= 1 << hashbit
+	}
+	return types.EROFSXattrFilterDefault &^ nameFilter
+}
+
+// erofsExportXattrIbody encodes the xattr ibody of inode
+func erofsExportXattrIbody(inode *types.ErofsInode) []byte {
+	ixattrs := &inode.IXattrs
+	buf := make([]byte, inode.XattrIsize)
+	p := uint32(types.EROFS_XATTR_IBODY_HDR_SIZE)
+
+	if types.GCfg.XattrNameFilter {
+		binary.LittleEndian.PutUint32(buf[0:], erofsXattrFilterMap(ixattrs))
+	}
+
+	// shared xattr ids come first, followed by inline xattrs
+	for pos := ixattrs.Next; pos != ixattrs; pos = pos.Next {
+		item := inodeXattrNodeFromList(pos).item
+
+		if item.sharedXattrID < 0 {
+			continue
+		}
+		binary.LittleEndian.PutUint32(buf[p:], uint32(item.sharedXattrID))
+		p += 4
+		buf[4]++ // h_shared_count
+	}
+
+	for pos := ixattrs.Next; pos != ixattrs; pos = pos.Next {
+		item := inodeXattrNodeFromList(pos).item
+
+		if item.sharedXattrID >= 0 {
+			continue
+		}
+		buf[p] = uint8(item.len[0])
+		buf[p+1] = item.prefix
+		binary.LittleEndian.PutUint16(buf[p+2:], uint16(item.len[1]))
+		p += types.EROFS_XATTR_ENTRY_SIZE
+		copy(buf[p:], item.kvbuf[:item.len[0]+item.len[1]])
+		p = erofsXattrAlign(p + item.len[0] + item.len[1])
+	}
+
+	for pos := ixattrs.Next; pos != ixattrs; {
+		n := pos.Next
+		types.ListDel(pos)
+		pos = n
+	}
+	return buf
+}
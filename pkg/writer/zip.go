@@ -0,0 +1,223 @@
+package writer
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+
+	errs "github.com/PsychoPunkSage/ErgoFS/pkg/errors"
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+// Info-ZIP "new Unix" extra field holding the owner of an entry
+const zipExtraUnixN = 0x7875
+
+// ErofsZipfile is a ZIP archive used as the source of the tree
+type ErofsZipfile struct {
+	f    *os.File
+	zr   *zip.Reader
+	next int // index of the next entry to parse
+
+	// stored entries are referenced right in the archive, others are
+	// decompressed into diskbuf stream 0
+	strm *types.ErofsDiskBufStrm
+}
+
+// ErofsZipOpen opens the ZIP archive at path, which has to be seekable as
+// the central directory is at the end
+func ErofsZipOpen(path string) (*ErofsZipfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		f.Close()
+		types.Error("failed to open zip source %s: %v", path, err)
+		return nil, syscall.Errno(errs.EBADMSG)
+	}
+	return &ErofsZipfile{
+		f:    f,
+		zr:   zr,
+		strm: &types.ErofsDiskBufStrm{Fd: int(f.Fd()), AlignSize: 1},
+	}, nil
+}
+
+// ErofsZipClose closes the archive
+func ErofsZipClose(z *ErofsZipfile) {
+	z.f.Close()
+}
+
+// zipUnixMode converts the mode of an entry, which is given by the unix
+// attributes if any, to the one of stat(2)
+func zipUnixMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+
+	if m&fs.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+
+	switch {
+	case m.IsDir():
+		mode |= syscall.S_IFDIR
+	case m&fs.ModeSymlink != 0:
+		mode |= syscall.S_IFLNK
+	case m&fs.ModeNamedPipe != 0:
+		mode |= syscall.S_IFIFO
+	case m&fs.ModeSocket != 0:
+		mode |= syscall.S_IFSOCK
+	default:
+		// devices can't be recreated without their numbers
+		mode |= syscall.S_IFREG
+	}
+	return mode
+}
+
+// zipParseOwner returns the uid and gid in the extra fields of an entry
+func zipParseOwner(extra []byte) (uint32, uint32, bool) {
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+
+		// version, then the lengths and values of uid and gid
+		if tag != zipExtraUnixN || size < 1 || field[0] != 1 {
+			continue
+		}
+		var ids [2]uint64
+		field = field[1:]
+		for i := range ids {
+			if len(field) < 1 || int(field[0]) > 8 || len(field) < 1+int(field[0]) {
+				return 0, 0, false
+			}
+			n := int(field[0])
+			for j := n - 1; j >= 0; j-- {
+				ids[i] = ids[i]<<8 | uint64(field[1+j])
+			}
+			field = field[1+n:]
+		}
+		return uint32(ids[0]), uint32(ids[1]), true
+	}
+	return 0, 0, false
+}
+
+// erofsZipFileData sets up the data of a regular file
+func erofsZipFileData(z *ErofsZipfile, f *zip.File, inode *types.ErofsInode) error {
+	if inode.ISize == 0 {
+		return nil
+	}
+
+	if f.Method == zip.Store {
+		off, err := f.DataOffset()
+		if err != nil {
+			return err
+		}
+		z.strm.TailOffset = uint64(off)
+		inode.IDiskbuf = &types.ErofsDiskbuf{}
+		types.ErofsDiskbufReserve(inode.IDiskbuf, z.strm)
+		types.ErofsDiskbufCommit(inode.IDiskbuf, inode.ISize)
+		inode.DataSource = types.EROFS_INODE_DATA_SOURCE_DISKBUF
+		return nil
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	ios := erofsIostream{r: bufio.NewReaderSize(rc, 1<<16)}
+	if err = erofsIostreamFileData(&ios, nil, inode); err != nil {
+		return err
+	}
+	// the CRC is only checked at the end of the entry
+	if _, err = ios.r.ReadByte(); err != io.EOF {
+		if err == nil {
+			err = syscall.Errno(errs.EBADMSG)
+		}
+		return err
+	}
+	return nil
+}
+
+// ErofsZipParse parses the next entry of the archive into the tree at
+// root. io.EOF is returned at the end of the archive.
+func ErofsZipParse(root *types.ErofsInode, z *ErofsZipfile) error {
+	if z.next >= len(z.zr.File) {
+		return io.EOF
+	}
+	f := z.zr.File[z.next]
+	z.next++
+
+	st := syscall.Stat_t{
+		Mode: zipUnixMode(f.Mode()),
+		Uid:  uint32(syscall.Getuid()),
+		Gid:  uint32(syscall.Getgid()),
+		Mtim: syscall.Timespec{Sec: f.Modified.Unix()},
+	}
+	if strings.HasSuffix(f.Name, "/") {
+		st.Mode = st.Mode&^syscall.S_IFMT | syscall.S_IFDIR
+	}
+	if uid, gid, ok := zipParseOwner(f.Extra); ok {
+		st.Uid, st.Gid = uid, gid
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFREG {
+		st.Size = int64(f.UncompressedSize64)
+	}
+
+	var link []byte
+	if st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		if f.UncompressedSize64 == 0 || f.UncompressedSize64 > syscall.PathMax {
+			types.Error("invalid symlink %s", f.Name)
+			return syscall.Errno(errs.EBADMSG)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		link, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			types.Error("failed to read symlink %s: %s", f.Name, err)
+			return err
+		}
+		st.Size = int64(len(link))
+	}
+
+	inode, err := erofsRebuildSetInode(root, erofsRebuildPath(f.Name), &st)
+	if err == nil {
+		err = erofsRebuildApplyXattrs(inode)
+	}
+	if err == nil {
+		switch {
+		case inode.IsLnk():
+			inode.ILink = string(link)
+		case inode.IsReg():
+			err = erofsZipFileData(z, f, inode)
+		}
+	}
+	if err != nil {
+		types.Error("failed to add %s: %s", f.Name, err)
+	}
+	return err
+}
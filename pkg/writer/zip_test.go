@@ -0,0 +1,130 @@
+package writer
+
+import (
+	"archive/zip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/PsychoPunkSage/ErgoFS/pkg/types"
+)
+
+func TestZipParseOwner(t *testing.T) {
+	tests := []struct {
+		name     string
+		extra    []byte
+		uid, gid uint32
+		ok       bool
+	}{
+		{"4-byte ids", []byte{0x75, 0x78, 11, 0, 1, 4, 0xe8, 3, 0, 0, 4, 0xe9, 3, 0, 0}, 1000, 1001, true},
+		{"mixed sizes", []byte{0x75, 0x78, 6, 0, 1, 1, 42, 2, 0x10, 0x27}, 42, 10000, true},
+		{"after another field", []byte{0x55, 0x54, 5, 0, 1, 0, 0, 0, 0, 0x75, 0x78, 5, 0, 1, 1, 7, 1, 8}, 7, 8, true},
+		{"unknown version", []byte{0x75, 0x78, 5, 0, 2, 1, 7, 1, 8}, 0, 0, false},
+		{"id too long", []byte{0x75, 0x78, 5, 0, 1, 9, 7, 1, 8}, 0, 0, false},
+		{"truncated gid", []byte{0x75, 0x78, 4, 0, 1, 1, 7, 1}, 0, 0, false},
+		{"truncated field", []byte{0x75, 0x78, 11, 0, 1, 4, 0xe8, 3}, 0, 0, false},
+		{"no owner", []byte{0x55, 0x54, 5, 0, 1, 0, 0, 0, 0}, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		uid, gid, ok := zipParseOwner(tt.extra)
+		if uid != tt.uid || gid != tt.gid || ok != tt.ok {
+			t.Errorf("%s: zipParseOwner() = %d, %d, %v, want %d, %d, %v",
+				tt.name, uid, gid, ok, tt.uid, tt.gid, tt.ok)
+		}
+	}
+}
+
+func TestErofsZipParse(t *testing.T) {
+	type zipTestEntry struct {
+		name   string
+		mode   fs.FileMode
+		method uint16
+		extra  []byte
+		data   string
+	}
+	entries := []zipTestEntry{
+		{"dir/", fs.ModeDir | 0750, zip.Store, []byte{0x75, 0x78, 5, 0, 1, 1, 0, 1, 1}, ""},
+		{"dir/stored", 0644, zip.Store, []byte{0x75, 0x78, 7, 0, 1, 2, 0xe8, 3, 2, 0xe9, 3}, "stored data"},
+		{"dir/deflated", fs.ModeSetuid | 0755, zip.Deflate, nil, "deflated data, deflated data"},
+		{"link", fs.ModeSymlink | 0777, zip.Store, nil, "dir/stored"},
+	}
+
+	fn := filepath.Join(t.TempDir(), "test.zip")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, ent := range entries {
+		fh := &zip.FileHeader{Name: ent.name, Method: ent.method, Extra: ent.extra,
+			Modified: time.Unix(1700000000, 0)}
+		fh.SetMode(ent.mode)
+		w, err := zw.CreateHeader(fh)
+		if err == nil {
+			_, err = io.WriteString(w, ent.data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = zw.Close(); err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := erofsTestMakeRoot(t)
+	z, err := ErofsZipOpen(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ErofsZipClose(z)
+	for err == nil {
+		err = ErofsZipParse(root, z)
+	}
+	if err != io.EOF {
+		t.Fatalf("ErofsZipParse() = %v", err)
+	}
+
+	uid, gid := uint32(syscall.Getuid()), uint32(syscall.Getgid())
+	tests := []struct {
+		path     string
+		mode     uint16
+		uid, gid uint32
+		data     string
+	}{
+		{"dir", types.S_IFDIR | 0750, 0, 1, ""},
+		{"dir/stored", types.S_IFREG | 0644, 1000, 1001, "stored data"},
+		{"dir/deflated", types.S_IFREG | syscall.S_ISUID | 0755, uid, gid, "deflated data, deflated data"},
+		{"link", types.S_IFLNK | 0777, uid, gid, ""},
+	}
+
+	for _, tt := range tests {
+		inode := erofsRebuildLookup(root, tt.path)
+		if inode == nil {
+			t.Errorf("%s: not found", tt.path)
+			continue
+		}
+		if inode.IMode != tt.mode || inode.IUid != tt.uid || inode.IGid != tt.gid {
+			t.Errorf("%s: mode %#o owner %d:%d, want %#o %d:%d",
+				tt.path, inode.IMode, inode.IUid, inode.IGid, tt.mode, tt.uid, tt.gid)
+		}
+		if inode.IMtime != 1700000000 {
+			t.Errorf("%s: mtime %d, want 1700000000", tt.path, inode.IMtime)
+		}
+		if tt.data != "" {
+			if data := erofsTestData(t, inode); data != tt.data {
+				t.Errorf("%s: data %q, want %q", tt.path, data, tt.data)
+			}
+		}
+	}
+	if inode := erofsRebuildLookup(root, "link"); inode != nil && inode.ILink != "dir/stored" {
+		t.Errorf("link: target %q, want %q", inode.ILink, "dir/stored")
+	}
+}